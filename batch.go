@@ -0,0 +1,199 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "runtime"
+    "sync"
+    "time"
+)
+
+// defaultMaxBatchQueries caps the queries accepted by one batch mapping request
+const defaultMaxBatchQueries = 10000
+
+// BatchQuery is one intent of a batch mapping request. K, MinScore, Filter and Mode
+// override the batch defaults when set.
+type BatchQuery struct {
+    ID       string   `json:"id,omitempty"`
+    Intent   string   `json:"intent"`
+    K        int      `json:"k,omitempty"`
+    MinScore *float64 `json:"min_score,omitempty"`
+    Filter   string   `json:"filter,omitempty"`
+    Mode     string   `json:"mode,omitempty"`
+}
+
+// BatchMatchResult is the outcome of one BatchQuery. Index is the query's position in the
+// request; Error is set instead of a match when the query could not be answered.
+type BatchMatchResult struct {
+    Index int    `json:"index"`
+    ID    string `json:"id,omitempty"`
+    IntentMatchResult
+    Error string `json:"error,omitempty"`
+}
+
+// batchOptions applies a query's overrides to the batch defaults
+func batchOptions(defaults SearchOptions, query BatchQuery) (SearchOptions, error) {
+    opts := defaults
+    if query.K != 0 {
+        if query.K < 1 || query.K > maxTopK {
+            return opts, fmt.Errorf("k must be between 1 and %d", maxTopK)
+        }
+        opts.K = query.K
+    }
+    if query.MinScore != nil {
+        opts.MinScore = *query.MinScore
+    }
+    if query.Filter != "" {
+        filter, err := ParseFilter(query.Filter)
+        if err != nil {
+            return opts, fmt.Errorf("invalid filter: %v", err)
+        }
+        opts.Filter = filter
+    }
+    if query.Mode != "" {
+        if query.Mode != searchVector && query.Mode != searchHybrid {
+            return opts, fmt.Errorf("mode must be %s or %s", searchVector, searchHybrid)
+        }
+        opts.Mode = query.Mode
+    }
+    return opts, nil
+}
+
+// MapIntentBatch maps every query against one snapshot of the collection using up to
+// workers goroutines, and calls emit with the results in request order as soon as each
+// one and all before it are ready. A failed query gets an error result without stopping
+// the others. Closing stop abandons the queries not yet started.
+func MapIntentBatch(collection *Collection, queries []BatchQuery, defaults SearchOptions, workers int, stop <-chan struct{}, emit func(BatchMatchResult) error) error {
+    if workers < 1 {
+        workers = runtime.NumCPU()
+    }
+    if workers > len(queries) {
+        workers = len(queries)
+    }
+    embeddings, index, lexical := collection.Store.Snapshot()
+
+    results := make([]chan BatchMatchResult, len(queries))
+    for i := range results {
+        results[i] = make(chan BatchMatchResult, 1)
+    }
+    jobs := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range jobs {
+                results[i] <- mapBatchQuery(collection, embeddings, index, lexical, queries[i], i, defaults)
+            }
+        }()
+    }
+
+    done := make(chan struct{})
+    defer func() {
+        close(done)
+        wg.Wait()
+    }()
+    go func() {
+        defer close(jobs)
+        for i := range queries {
+            select {
+            case jobs <- i:
+            case <-stop:
+                return
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    for i := range queries {
+        select {
+        case result := <-results[i]:
+            if err := emit(result); err != nil {
+                return err
+            }
+        case <-stop:
+            return fmt.Errorf("batch abandoned after %d of %d queries", i, len(queries))
+        }
+    }
+    return nil
+}
+
+func mapBatchQuery(collection *Collection, embeddings []Embedding, index *HNSWIndex, lexical *BM25Index, query BatchQuery, i int, defaults SearchOptions) BatchMatchResult {
+    result := BatchMatchResult{Index: i, ID: query.ID, IntentMatchResult: IntentMatchResult{Intent: query.Intent, Candidates: []IntentCandidate{}}}
+    if query.Intent == "" {
+        result.Error = "missing intent"
+        return result
+    }
+    opts, err := batchOptions(defaults, query)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    match, err := MapIntentToProject(query.Intent, collection.Embedder, embeddings, index, lexical, opts)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    result.IntentMatchResult = match
+    return result
+}
+
+// MapIntentBatchHandler maps many intents in one request. The body is
+// {"queries": [{"id", "intent", "k", "min_score", "filter"}]}; the query parameters of
+// /map-intent set the defaults. Results stream back as NDJSON, one line per query in
+// request order, each with its own error if it failed.
+func MapIntentBatchHandler(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Queries []BatchQuery `json:"queries"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if len(req.Queries) == 0 {
+        http.Error(w, "'queries' must not be empty", http.StatusBadRequest)
+        return
+    }
+    if limit := envInt("MAP_BATCH_MAX_QUERIES", defaultMaxBatchQueries); len(req.Queries) > limit {
+        http.Error(w, fmt.Sprintf("Too many queries: %d (at most %d)", len(req.Queries), limit), http.StatusRequestEntityTooLarge)
+        return
+    }
+    log.Printf("Handling request to map %d intents", len(req.Queries))
+
+    defaults, err := parseSearchOptions(r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := collection.CheckEmbedder(); err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    defaults.Thresholds = collection.Config.Thresholds
+
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    flusher, _ := w.(http.Flusher)
+    encoder := json.NewEncoder(w)
+    start := time.Now()
+    err = MapIntentBatch(collection, req.Queries, defaults, envInt("MAP_BATCH_WORKERS", 0), r.Context().Done(), func(result BatchMatchResult) error {
+        if err := encoder.Encode(result); err != nil {
+            return err
+        }
+        if flusher != nil {
+            flusher.Flush()
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Error streaming batch results: %v", err)
+        return
+    }
+    log.Printf("Mapped %d intents in %s", len(req.Queries), time.Since(start))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "math"
+    "sort"
+    "sync"
+)
+
+// Default BM25 parameters: k1 controls term frequency saturation, b length normalisation
+const (
+    defaultBM25K1 = 1.2
+    defaultBM25B  = 0.75
+)
+
+// BM25Index is an inverted index over the text of the stored embeddings: intent, project,
+// params and every string metadata value. Documents are identified by the same labels as
+// the HNSW index, so the two rankings can be fused.
+type BM25Index struct {
+    k1, b float64
+
+    mu          sync.RWMutex
+    postings    map[string]map[int]int // term -> label -> term frequency
+    lengths     map[int]int            // label -> document length in tokens
+    totalLength int
+}
+
+// LexicalHit is a labelled result of a BM25 search
+type LexicalHit struct {
+    Label int
+    Score float64
+}
+
+// NewBM25Index creates an empty index; non-positive parameters take the defaults
+func NewBM25Index(k1, b float64) *BM25Index {
+    if k1 <= 0 {
+        k1 = defaultBM25K1
+    }
+    if b < 0 || b > 1 {
+        b = defaultBM25B
+    }
+    return &BM25Index{
+        k1:       k1,
+        b:        b,
+        postings: make(map[string]map[int]int),
+        lengths:  make(map[int]int),
+    }
+}
+
+// buildLexicalIndex indexes every embedding under its position, like buildIndex
+func buildLexicalIndex(embeddings []Embedding) *BM25Index {
+    index := NewBM25Index(envFloat("BM25_K1", defaultBM25K1), envFloat("BM25_B", defaultBM25B))
+    for i := range embeddings {
+        index.Add(i, &embeddings[i])
+    }
+    return index
+}
+
+// lexicalTokens returns the tokens of the text fields of an embedding
+func lexicalTokens(embedding *Embedding) []string {
+    tokens := tokenize(embedding.Intent)
+    tokens = append(tokens, tokenize(embedding.Project)...)
+    tokens = append(tokens, tokenize(embedding.Params)...)
+    for _, value := range embedding.Metadata {
+        switch v := value.(type) {
+        case string:
+            tokens = append(tokens, tokenize(v)...)
+        case []interface{}:
+            for _, element := range v {
+                if s, ok := element.(string); ok {
+                    tokens = append(tokens, tokenize(s)...)
+                }
+            }
+        }
+    }
+    return tokens
+}
+
+// Add indexes an embedding under the given label
+func (x *BM25Index) Add(label int, embedding *Embedding) {
+    tokens := lexicalTokens(embedding)
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    if _, exists := x.lengths[label]; exists {
+        return
+    }
+    for _, token := range tokens {
+        postings, exists := x.postings[token]
+        if !exists {
+            postings = make(map[int]int)
+            x.postings[token] = postings
+        }
+        postings[label]++
+    }
+    x.lengths[label] = len(tokens)
+    x.totalLength += len(tokens)
+}
+
+// Delete removes a label from the index. Only the terms of the given embedding are
+// visited, so it must be the one the label was added with.
+func (x *BM25Index) Delete(label int, embedding *Embedding) {
+    tokens := lexicalTokens(embedding)
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    length, exists := x.lengths[label]
+    if !exists {
+        return
+    }
+    for _, token := range tokens {
+        if postings, ok := x.postings[token]; ok {
+            delete(postings, label)
+            if len(postings) == 0 {
+                delete(x.postings, token)
+            }
+        }
+    }
+    delete(x.lengths, label)
+    x.totalLength -= length
+}
+
+// Len returns the number of indexed documents
+func (x *BM25Index) Len() int {
+    x.mu.RLock()
+    defer x.mu.RUnlock()
+    return len(x.lengths)
+}
+
+// Search scores the documents sharing a term with the query and returns the best k whose
+// label passes accept, all when accept is nil. Repeated query terms count once.
+func (x *BM25Index) Search(query string, k int, accept func(label int) bool) []LexicalHit {
+    x.mu.RLock()
+    defer x.mu.RUnlock()
+
+    documents := len(x.lengths)
+    if documents == 0 || k < 1 {
+        return nil
+    }
+    averageLength := float64(x.totalLength) / float64(documents)
+    if averageLength == 0 {
+        return nil
+    }
+
+    scores := make(map[int]float64)
+    seen := make(map[string]bool)
+    for _, term := range tokenize(query) {
+        if seen[term] {
+            continue
+        }
+        seen[term] = true
+        postings := x.postings[term]
+        if len(postings) == 0 {
+            continue
+        }
+        df := float64(len(postings))
+        idf := math.Log(1 + (float64(documents)-df+0.5)/(df+0.5))
+        for label, tf := range postings {
+            if accept != nil && !accept(label) {
+                continue
+            }
+            norm := x.k1 * (1 - x.b + x.b*float64(x.lengths[label])/averageLength)
+            scores[label] += idf * float64(tf) * (x.k1 + 1) / (float64(tf) + norm)
+        }
+    }
+
+    hits := make([]LexicalHit, 0, len(scores))
+    for label, score := range scores {
+        hits = append(hits, LexicalHit{Label: label, Score: score})
+    }
+    sort.Slice(hits, func(i, j int) bool {
+        if hits[i].Score != hits[j].Score {
+            return hits[i].Score > hits[j].Score
+        }
+        return hits[i].Label < hits[j].Label
+    })
+    if len(hits) > k {
+        hits = hits[:k]
+    }
+    return hits
+}
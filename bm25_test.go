@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func testLexicalIndex() (*BM25Index, []Embedding) {
+    embeddings := []Embedding{
+        {Intent: "scrape financial news", Project: "scraper"},
+        {Intent: "check bank interest rates", Project: "bank"},
+        {Intent: "scrape news headlines from many different websites every day", Project: "crawler"},
+        {Intent: "forecast sales", Project: "forecast", Metadata: Metadata{"tag": []interface{}{"finance", "news"}}},
+    }
+    index := NewBM25Index(0, -1)
+    for i := range embeddings {
+        index.Add(i, &embeddings[i])
+    }
+    return index, embeddings
+}
+
+func TestBM25Ranking(t *testing.T) {
+    index, embeddings := testLexicalIndex()
+    if index.k1 != defaultBM25K1 || index.b != defaultBM25B {
+        t.Errorf("out of range parameters gave k1 %v, b %v; want the defaults", index.k1, index.b)
+    }
+
+    hits := index.Search("bank rates", 10, nil)
+    if len(hits) != 1 || hits[0].Label != 1 {
+        t.Fatalf("searching bank rates found %v, want only label 1", hits)
+    }
+
+    // Both documents match both terms; the shorter one ranks first
+    hits = index.Search("Scrape NEWS scrape", 10, nil)
+    if len(hits) < 2 || hits[0].Label != 0 || hits[1].Label != 2 {
+        t.Fatalf("searching scrape news found %v, want labels 0 and 2 first", hits)
+    }
+    for i := 1; i < len(hits); i++ {
+        if hits[i].Score > hits[i-1].Score {
+            t.Fatalf("hits are not ordered best first: %v", hits)
+        }
+    }
+
+    // Metadata strings are indexed too, and accept filters labels
+    hits = index.Search("finance", 10, nil)
+    if len(hits) != 1 || hits[0].Label != 3 {
+        t.Fatalf("searching metadata found %v, want label 3", hits)
+    }
+    hits = index.Search("news", 10, func(label int) bool { return label != 0 })
+    for _, hit := range hits {
+        if hit.Label == 0 {
+            t.Fatalf("filtered search returned label 0: %v", hits)
+        }
+    }
+    if got := len(index.Search("news", 1, nil)); got != 1 {
+        t.Errorf("search with k 1 returned %d hits", got)
+    }
+
+    index.Delete(0, &embeddings[0])
+    if index.Len() != 3 {
+        t.Errorf("Len() = %d after a delete, want 3", index.Len())
+    }
+    for _, hit := range index.Search("scrape", 10, nil) {
+        if hit.Label == 0 {
+            t.Fatal("search returned a deleted label")
+        }
+    }
+}
+
+func TestFuseRankings(t *testing.T) {
+    vector := []SearchHit{{Label: 1, Score: 0.9}, {Label: 2, Score: 0.8}, {Label: 3, Score: 0.7}}
+    lexical := []LexicalHit{{Label: 3, Score: 5}, {Label: 4, Score: 4}}
+    fused := fuseRankings(vector, lexical, 60)
+
+    want := []int{3, 1, 2, 4}
+    if len(fused) != len(want) {
+        t.Fatalf("fused %d hits, want %d", len(fused), len(want))
+    }
+    for i, label := range want {
+        if fused[i].Label != label {
+            t.Fatalf("fused order %v, want labels %v", fused, want)
+        }
+    }
+    if top := fused[0]; top.VectorRank != 3 || top.LexicalRank != 1 || top.Fused != 1.0/63+1.0/61 {
+        t.Errorf("label 3 fused as %+v", top)
+    }
+    // Labels 2 and 4 tie; label 4 was only found lexically, so it ranks last
+    if last := fused[3]; last.VectorRank != 0 || last.LexicalRank != 2 {
+        t.Errorf("label 4 fused as %+v", last)
+    }
+
+    tied := fuseRankings([]SearchHit{{Label: 1}, {Label: 2}}, []LexicalHit{{Label: 2}, {Label: 1}}, 0)
+    if tied[0].Label != 1 {
+        t.Errorf("tie went to label %d, want the better vector rank", tied[0].Label)
+    }
+}
+
+func TestTopTwoSimilaritiesIgnoresFusedOrder(t *testing.T) {
+    candidates := []IntentCandidate{{Similarity: 0.5}, {Similarity: 0.9}, {Similarity: 0.7}, {Similarity: 0.6}}
+    best, second := topTwoSimilarities(candidates)
+    if best != 0.9 || second != 0.7 {
+        t.Errorf("top two similarities = %v, %v; want 0.9, 0.7", best, second)
+    }
+}
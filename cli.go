@@ -0,0 +1,326 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+)
+
+// runCommand runs a command-line subcommand instead of starting the server
+func runCommand(name string, args []string, embedderSpec string) error {
+    switch name {
+    case "reembed":
+        return reembedCommand(args)
+    case "import":
+        return importCommand(args, embedderSpec)
+    case "export":
+        return exportCommand(args, embedderSpec)
+    case "calibrate":
+        return calibrateCommand(args, embedderSpec)
+    case "eval":
+        return evalCommand(args, embedderSpec)
+    case "help", "-h", "--help":
+        printUsage()
+        return nil
+    }
+    printUsage()
+    return fmt.Errorf("unknown command %q", name)
+}
+
+func printUsage() {
+    fmt.Println(`Usage: embeddings-service [command] [flags]
+
+Without a command the HTTP server is started on port 8085.
+
+Commands:
+  reembed   recompute the vector of every intent embedding with the configured embedder
+  import    load embeddings into a collection from JSONL, CSV, .npy or .fvecs
+  export    write a collection as JSONL, CSV, .npy, .fvecs or .ivecs ground truth
+  calibrate fit a collection's match thresholds to a labelled set of intents
+  eval      report recall@k, MRR and nDCG of one or more configurations on a labelled set
+
+Stop the server before importing into a segment log store, or import through the API.
+Stop it before calibrating with -apply too, or it will overwrite the thresholds.`)
+}
+
+// reembedCommand rewrites the vectors in an embeddings file from the text each record was
+// embedded from, so the stored vectors come from the same embedder as the queries
+func reembedCommand(args []string) error {
+    flags := flag.NewFlagSet("reembed", flag.ExitOnError)
+    path := flags.String("file", envString("EMBEDDINGS_PATH", "data/embeddings.json"), "embeddings file to rewrite")
+    batchSize := flags.Int("batch", 32, "number of intents sent to the embedder at once")
+    flags.Parse(args)
+
+    embeddings, err := LoadEmbeddings(*path)
+    if err != nil {
+        return err
+    }
+    if sentenceComposition != compositionMean {
+        RefreshCorpusStats(embeddings)
+    }
+
+    if *batchSize < 1 {
+        *batchSize = 1
+    }
+    for start := 0; start < len(embeddings); start += *batchSize {
+        end := start + *batchSize
+        if end > len(embeddings) {
+            end = len(embeddings)
+        }
+        texts := make([]string, 0, end-start)
+        for _, embedding := range embeddings[start:end] {
+            texts = append(texts, embedding.SourceText())
+        }
+        vectors, err := activeEmbedder.Embed(texts)
+        if err != nil {
+            return fmt.Errorf("failed to embed intents %d-%d: %v", start, end-1, err)
+        }
+        for i, vector := range vectors {
+            embeddings[start+i].Vector = queryVector(vector)
+            embeddings[start+i].Model = activeEmbedder.Name()
+        }
+    }
+
+    if err := writeJSONFileAtomic(*path, embeddings); err != nil {
+        return err
+    }
+    log.Printf("Re-embedded %d intents in %s with %s", len(embeddings), *path, activeEmbedder.Name())
+    return nil
+}
+
+// importCommand streams a file into a collection and prints the import report
+func importCommand(args []string, embedderSpec string) error {
+    flags := flag.NewFlagSet("import", flag.ExitOnError)
+    name := flags.String("collection", defaultCollection, "collection to import into")
+    path := flags.String("file", "", "file to import")
+    format := flags.String("format", "", "jsonl, csv, npy or fvecs (default: from the file extension)")
+    metadataPath := flags.String("metadata", "", "JSONL metadata sidecar for npy and fvecs files")
+    flags.Parse(args)
+
+    if *path == "" {
+        return fmt.Errorf("import needs -file")
+    }
+    if *format == "" {
+        *format = detectTransferFormat(*path)
+    }
+
+    registry, err := openCollections(embedderSpec)
+    if err != nil {
+        return err
+    }
+    collection, err := registry.Get(*name)
+    if err != nil {
+        return fmt.Errorf("collection %q: %v", *name, err)
+    }
+
+    data, err := os.Open(*path)
+    if err != nil {
+        return err
+    }
+    defer data.Close()
+    var metadata io.Reader
+    if *metadataPath != "" {
+        file, err := os.Open(*metadataPath)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        metadata = file
+    }
+
+    report := ImportCollection(collection, *format, data, metadata)
+    encoder := json.NewEncoder(os.Stdout)
+    encoder.SetIndent("", "  ")
+    encoder.Encode(report)
+    if report.Error != "" {
+        return fmt.Errorf("import stopped: %s", report.Error)
+    }
+    log.Printf("Imported %d of %d rows into %s", report.Imported, report.Rows, collection.Config.Name)
+    return nil
+}
+
+// exportCommand writes a collection to a file, plus the metadata sidecar for npy and fvecs
+func exportCommand(args []string, embedderSpec string) error {
+    flags := flag.NewFlagSet("export", flag.ExitOnError)
+    name := flags.String("collection", defaultCollection, "collection to export")
+    path := flags.String("file", "", "file to write")
+    format := flags.String("format", "", "jsonl, csv, npy, fvecs or ivecs (default: from the file extension)")
+    metadataPath := flags.String("metadata", "", "also write the JSONL metadata sidecar of an npy or fvecs export here")
+    k := flags.Int("k", 100, "neighbours per vector in an ivecs ground truth export")
+    flags.Parse(args)
+
+    if *path == "" {
+        return fmt.Errorf("export needs -file")
+    }
+    if *format == "" {
+        *format = detectTransferFormat(*path)
+    }
+
+    registry, err := openCollections(embedderSpec)
+    if err != nil {
+        return err
+    }
+    collection, err := registry.Get(*name)
+    if err != nil {
+        return fmt.Errorf("collection %q: %v", *name, err)
+    }
+
+    if err := exportFile(*path, collection, *format, partVectors, *k); err != nil {
+        return err
+    }
+    if *metadataPath != "" {
+        if err := exportFile(*metadataPath, collection, *format, partMetadata, *k); err != nil {
+            return err
+        }
+    }
+    log.Printf("Exported %s to %s", collection.Config.Name, *path)
+    return nil
+}
+
+// calibrateCommand fits a collection's thresholds to a labelled set and prints the report
+func calibrateCommand(args []string, embedderSpec string) error {
+    flags := flag.NewFlagSet("calibrate", flag.ExitOnError)
+    name := flags.String("collection", defaultCollection, "collection to calibrate")
+    path := flags.String("file", "", "labelled intents as JSONL or a JSON array of {\"intent\", \"project\"}")
+    target := flags.Float64("target", defaultTargetPrecision, "precision the accepted matches must reach")
+    mode := flags.String("mode", searchVector, "search mode the thresholds are fitted for: vector or hybrid")
+    apply := flags.Bool("apply", false, "store the fitted thresholds in the collections manifest")
+    flags.Parse(args)
+
+    if *path == "" {
+        return fmt.Errorf("calibrate needs -file")
+    }
+    if *target <= 0 || *target > 1 {
+        return fmt.Errorf("-target must be between 0 and 1")
+    }
+    if *mode != searchVector && *mode != searchHybrid {
+        return fmt.Errorf("-mode must be %s or %s", searchVector, searchHybrid)
+    }
+
+    file, err := os.Open(*path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    examples, err := ReadLabelledIntents(file)
+    if err != nil {
+        return err
+    }
+
+    registry, err := openCollections(embedderSpec)
+    if err != nil {
+        return err
+    }
+    collection, err := registry.Get(*name)
+    if err != nil {
+        return fmt.Errorf("collection %q: %v", *name, err)
+    }
+
+    report, err := Calibrate(collection, examples, SearchOptions{Mode: *mode}, *target)
+    if err != nil {
+        return err
+    }
+    if *apply {
+        if _, err := registry.SetThresholds(*name, report.Thresholds); err != nil {
+            return err
+        }
+        report.Applied = true
+    }
+    encoder := json.NewEncoder(os.Stdout)
+    encoder.SetIndent("", "  ")
+    encoder.Encode(report)
+    if !report.Reached {
+        log.Printf("No thresholds reach precision %.2f on %s; the most precise were fitted", *target, collection.Config.Name)
+    }
+    return nil
+}
+
+// evalConfigFlags collects repeated -config flags
+type evalConfigFlags []EvalConfig
+
+func (f *evalConfigFlags) String() string {
+    return fmt.Sprint(*f)
+}
+
+func (f *evalConfigFlags) Set(value string) error {
+    config, err := parseEvalConfig(value)
+    if err != nil {
+        return err
+    }
+    *f = append(*f, config)
+    return nil
+}
+
+// evalCommand evaluates configurations on a labelled set and prints the report, merged
+// with an earlier report when -baseline is given
+func evalCommand(args []string, embedderSpec string) error {
+    flags := flag.NewFlagSet("eval", flag.ExitOnError)
+    name := flags.String("collection", defaultCollection, "collection to evaluate")
+    path := flags.String("file", "", "labelled intents as JSONL or a JSON array of {\"intent\", \"project\"}")
+    k := flags.Int("k", defaultEvalK, "ranking depth for recall, MRR and nDCG")
+    baselinePath := flags.String("baseline", "", "earlier report to compare against")
+    var configs evalConfigFlags
+    flags.Var(&configs, "config", "configuration as name:params, e.g. hybrid:mode=hybrid&rrf_k=30, sif:composition=sif&subwords=false or ollama:embedder=ollama:nomic-embed-text (repeatable)")
+    flags.Parse(args)
+
+    if *path == "" {
+        return fmt.Errorf("eval needs -file")
+    }
+    file, err := os.Open(*path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    examples, err := ReadLabelledIntents(file)
+    if err != nil {
+        return err
+    }
+    var baseline EvalReport
+    if *baselinePath != "" {
+        data, err := ioutil.ReadFile(*baselinePath)
+        if err != nil {
+            return err
+        }
+        if err := json.Unmarshal(data, &baseline); err != nil {
+            return fmt.Errorf("invalid baseline report %s: %v", *baselinePath, err)
+        }
+    }
+
+    registry, err := openCollections(embedderSpec)
+    if err != nil {
+        return err
+    }
+    collection, err := registry.Get(*name)
+    if err != nil {
+        return fmt.Errorf("collection %q: %v", *name, err)
+    }
+
+    report, _, err := registry.Evaluate(collection, examples, configs, *k)
+    if err != nil {
+        return err
+    }
+    if *baselinePath != "" {
+        if err := report.MergeBaseline(baseline); err != nil {
+            return err
+        }
+    }
+    encoder := json.NewEncoder(os.Stdout)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(report)
+}
+
+func exportFile(path string, collection *Collection, format, part string, k int) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    if err := ExportCollection(file, collection, format, part, k); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
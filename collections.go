@@ -0,0 +1,423 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// CollectionConfig describes a collection; all but the default one are kept in the manifest,
+// which also records the default collection's thresholds and the embedder it was
+// re-embedded with
+type CollectionConfig struct {
+    Name string `json:"name"`
+    // Dimension is fixed when set; 0 takes it from the first stored embedding
+    Dimension int    `json:"dimension,omitempty"`
+    Metric    string `json:"metric"`
+    Embedder  string `json:"embedder"`
+    // PreviousEmbedder is the embedder before the last re-embedding
+    PreviousEmbedder string    `json:"previousEmbedder,omitempty"`
+    CreatedAt        time.Time `json:"createdAt"`
+    // Thresholds decide when intent queries abstain instead of naming a match
+    Thresholds Thresholds `json:"thresholds"`
+}
+
+// Collection is a named set of embeddings with its own dimension, similarity metric and embedder
+type Collection struct {
+    Config   CollectionConfig
+    Store    *EmbeddingStore
+    Embedder Embedder
+}
+
+// CollectionInfo is what the collection endpoints report
+type CollectionInfo struct {
+    CollectionConfig
+    EmbedderName string `json:"embedderName"`
+    // Model is the embedder recorded on the stored vectors
+    Model string `json:"model,omitempty"`
+    Count int    `json:"count"`
+    Path  string `json:"path"`
+    // Migration reports the latest re-embedding job, if any
+    Migration *MigrationStatus `json:"migration,omitempty"`
+}
+
+// Info summarises the collection and its current contents
+func (c *Collection) Info() CollectionInfo {
+    status := c.Store.Status()
+    info := CollectionInfo{
+        CollectionConfig: c.Config,
+        EmbedderName:     c.Embedder.Name(),
+        Model:            status.Model,
+        Count:            status.Count,
+        Path:             status.Path,
+    }
+    info.Dimension = c.Store.Dimension()
+    return info
+}
+
+// CheckEmbedder refuses queries whose vectors would come from a different model than the
+// stored ones, since their scores would be meaningless. Collections whose records predate
+// model tracking are not checked.
+func (c *Collection) CheckEmbedder() error {
+    if model := c.Store.Model(); model != "" && model != c.Embedder.Name() {
+        return fmt.Errorf("collection %s holds vectors from %s but queries are embedded with %s; re-embed the collection or change its embedder", c.Config.Name, model, c.Embedder.Name())
+    }
+    return nil
+}
+
+// defaultCollection is the intent catalog configured with EMBEDDINGS_PATH. It always exists
+// and is used when a request names no collection.
+const defaultCollection = "intents"
+
+// collectionManifest lists the created collections inside the collections directory
+const collectionManifest = "collections.json"
+
+var (
+    errCollectionNotFound = errors.New("collection not found")
+    errCollectionExists   = errors.New("collection already exists")
+    collectionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+// CollectionRegistry holds the open collections. Created collections live under dir,
+// stored with the same backend as the default collection.
+type CollectionRegistry struct {
+    dir         string
+    storeKind   string
+    indexConfig HNSWConfig
+
+    // mu is never held while waiting on a store, since a store's swap takes it
+    mu          sync.RWMutex
+    collections map[string]*Collection
+    migrations  map[string]*migration
+    // switching holds collections whose new embedder is recorded in the manifest ahead of
+    // the swap to its vectors
+    switching map[string]*Collection
+}
+
+// collections is the process-wide registry used by the handlers
+var collections *CollectionRegistry
+
+// NewCollectionRegistry creates a registry holding only the default collection
+func NewCollectionRegistry(dir, storeKind string, indexConfig HNSWConfig, intents *EmbeddingStore, embedder Embedder, embedderSpec string) *CollectionRegistry {
+    r := &CollectionRegistry{
+        dir:         dir,
+        storeKind:   storeKind,
+        indexConfig: indexConfig,
+        collections: make(map[string]*Collection),
+        migrations:  make(map[string]*migration),
+        switching:   make(map[string]*Collection),
+    }
+    r.collections[defaultCollection] = &Collection{
+        Config:   CollectionConfig{Name: defaultCollection, Metric: intents.Metric(), Embedder: embedderSpec, Thresholds: thresholdsFromEnv()},
+        Store:    intents,
+        Embedder: embedder,
+    }
+    return r
+}
+
+// Load opens every collection in the manifest. A collection that fails to open is logged
+// and left out rather than stopping the others. Thresholds recorded for the default
+// collection replace those from the environment.
+func (r *CollectionRegistry) Load() error {
+    data, err := ioutil.ReadFile(filepath.Join(r.dir, collectionManifest))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to read collections manifest: %v", err)
+    }
+    var configs []CollectionConfig
+    if err := json.Unmarshal(data, &configs); err != nil {
+        return fmt.Errorf("failed to unmarshal collections manifest: %v", err)
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, config := range configs {
+        if config.Name == defaultCollection {
+            intents := r.collections[defaultCollection]
+            intents.Config.Thresholds = config.Thresholds
+            // A re-embedding recorded here wins over EMBEDDER only when the stored
+            // vectors come from it and not from EMBEDDER
+            spec, embedder, err := reconcileEmbedder(intents.Store, intents.Config.Embedder, config.Embedder, config.PreviousEmbedder)
+            if err != nil {
+                log.Printf("Error restoring the embedder of %s: %v", defaultCollection, err)
+                continue
+            }
+            if spec != intents.Config.Embedder {
+                log.Printf("Collection %s was re-embedded with %s; using it instead of EMBEDDER=%s", defaultCollection, spec, intents.Config.Embedder)
+                intents.Config.Embedder, intents.Embedder = spec, embedder
+            }
+            intents.Config.PreviousEmbedder = config.PreviousEmbedder
+            continue
+        }
+        collection, err := r.open(config)
+        if err != nil {
+            log.Printf("Error opening collection %s: %v", config.Name, err)
+            continue
+        }
+        r.collections[config.Name] = collection
+    }
+    return nil
+}
+
+// reservedCollectionName reports names whose storage would collide with the manifest in
+// the collections directory
+func reservedCollectionName(name string) bool {
+    return name+".json" == collectionManifest
+}
+
+// open builds the embedder and store for a collection and loads its embeddings
+func (r *CollectionRegistry) open(config CollectionConfig) (*Collection, error) {
+    if reservedCollectionName(config.Name) {
+        return nil, fmt.Errorf("the collection name %q is reserved", config.Name)
+    }
+    if _, err := NewEmbedder(config.Embedder); err != nil {
+        return nil, err
+    }
+
+    var backend embeddingBackend
+    switch r.storeKind {
+    case storeSegments:
+        backend = &segmentLogBackend{dir: filepath.Join(r.dir, config.Name), opts: DefaultSegmentLogOptions()}
+    default:
+        path := filepath.Join(r.dir, config.Name+".json")
+        if _, err := os.Stat(path); os.IsNotExist(err) {
+            if err := writeJSONFileAtomic(path, []Embedding{}); err != nil {
+                return nil, err
+            }
+        }
+        backend = &jsonFileBackend{path: path}
+    }
+
+    indexConfig := r.indexConfig
+    indexConfig.Metric = config.Metric
+    store := NewEmbeddingStore(backend, indexConfig, config.Dimension)
+    if err := store.Reload(); err != nil {
+        return nil, err
+    }
+    spec, embedder, err := reconcileEmbedder(store, config.Embedder, config.PreviousEmbedder)
+    if err != nil {
+        return nil, err
+    }
+    if spec != config.Embedder {
+        log.Printf("Collection %s holds vectors from %s, its embedder before an unfinished re-embedding", config.Name, spec)
+        config.Embedder = spec
+    }
+    return &Collection{Config: config, Store: store, Embedder: embedder}, nil
+}
+
+// reconcileEmbedder returns the first of the embedder specs whose model produced the
+// stored vectors, or the first spec when none did or the store is empty, so a crash
+// between recording a re-embedding and swapping in its vectors leaves a usable collection
+func reconcileEmbedder(store *EmbeddingStore, specs ...string) (string, Embedder, error) {
+    model := store.Model()
+    var first Embedder
+    for i, spec := range specs {
+        if spec == "" && i > 0 {
+            continue
+        }
+        embedder, err := NewEmbedder(spec)
+        if err != nil {
+            return "", nil, err
+        }
+        if i == 0 {
+            first = embedder
+        }
+        if model == "" || embedder.Name() == model {
+            return spec, embedder, nil
+        }
+    }
+    return specs[0], first, nil
+}
+
+// Get returns the named collection; an empty name is the default collection
+func (r *CollectionRegistry) Get(name string) (*Collection, error) {
+    if name == "" {
+        name = defaultCollection
+    }
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    collection, exists := r.collections[name]
+    if !exists {
+        return nil, errCollectionNotFound
+    }
+    return collection, nil
+}
+
+// List returns the collections sorted by name
+func (r *CollectionRegistry) List() []*Collection {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    list := make([]*Collection, 0, len(r.collections))
+    for _, collection := range r.collections {
+        list = append(list, collection)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Config.Name < list[j].Config.Name
+    })
+    return list
+}
+
+// Create validates the config, creates the collection's storage and records it in the manifest.
+// Metric defaults to cosine and the embedder to word-average.
+func (r *CollectionRegistry) Create(config CollectionConfig) (*Collection, error) {
+    if !collectionNamePattern.MatchString(config.Name) {
+        return nil, fmt.Errorf("invalid collection name %q: use up to 64 lowercase letters, digits, '-' and '_'", config.Name)
+    }
+    if reservedCollectionName(config.Name) {
+        return nil, fmt.Errorf("the collection name %q is reserved", config.Name)
+    }
+    if config.Metric == "" {
+        config.Metric = metricCosine
+    }
+    if !validMetric(config.Metric) {
+        return nil, fmt.Errorf("unknown metric %q (expected %s, %s or %s)", config.Metric, metricCosine, metricDot, metricEuclidean)
+    }
+    if config.Embedder == "" {
+        config.Embedder = embedderWordAverage
+    }
+    if config.Dimension < 0 {
+        return nil, fmt.Errorf("dimension must not be negative")
+    }
+    if err := config.Thresholds.validate(); err != nil {
+        return nil, err
+    }
+    if config.Embedder == embedderWordAverage && config.Dimension != 0 && wordEmbeddings.size() > 0 && config.Dimension != embeddingDimension {
+        return nil, fmt.Errorf("dimension %d does not match the word vectors (%d)", config.Dimension, embeddingDimension)
+    }
+    config.CreatedAt = time.Now()
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, exists := r.collections[config.Name]; exists {
+        return nil, errCollectionExists
+    }
+    collection, err := r.open(config)
+    if err != nil {
+        return nil, err
+    }
+    r.collections[config.Name] = collection
+    if err := r.saveManifest(); err != nil {
+        delete(r.collections, config.Name)
+        collection.Store.Drop()
+        return nil, err
+    }
+    log.Printf("Created collection %s (metric %s, embedder %s)", config.Name, config.Metric, config.Embedder)
+    return collection, nil
+}
+
+// Drop deletes a collection and its storage. The default collection cannot be dropped.
+func (r *CollectionRegistry) Drop(name string) error {
+    if name == defaultCollection {
+        return fmt.Errorf("the %s collection cannot be dropped", defaultCollection)
+    }
+    r.mu.Lock()
+    collection, exists := r.collections[name]
+    if !exists {
+        r.mu.Unlock()
+        return errCollectionNotFound
+    }
+    delete(r.collections, name)
+    if err := r.saveManifest(); err != nil {
+        r.collections[name] = collection
+        r.mu.Unlock()
+        return err
+    }
+    r.mu.Unlock()
+    if err := collection.Store.Drop(); err != nil {
+        log.Printf("Error removing storage of dropped collection %s: %v", name, err)
+    }
+    log.Printf("Dropped collection %s", name)
+    return nil
+}
+
+// saveManifest writes the configs of the collections, with the embedders recorded ahead of
+// a switchover. Only the thresholds and embedders of the default collection are read back,
+// since the rest of its config comes from the environment. Callers hold mu.
+func (r *CollectionRegistry) saveManifest() error {
+    configs := []CollectionConfig{}
+    for name, collection := range r.collections {
+        config := collection.Config
+        if switched, exists := r.switching[name]; exists {
+            config.Embedder = switched.Config.Embedder
+            config.PreviousEmbedder = switched.Config.PreviousEmbedder
+            config.Dimension = switched.Config.Dimension
+        }
+        configs = append(configs, config)
+    }
+    sort.Slice(configs, func(i, j int) bool {
+        return configs[i].Name < configs[j].Name
+    })
+    return writeJSONFileAtomic(filepath.Join(r.dir, collectionManifest), configs)
+}
+
+// ListCollectionsHandler lists the collections with their configuration and size
+func ListCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+    infos := []CollectionInfo{}
+    for _, collection := range collections.List() {
+        infos = append(infos, collections.Info(collection))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(infos)
+}
+
+// GetCollectionHandler describes one collection
+func GetCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    collection, err := collections.Get(name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(collections.Info(collection))
+}
+
+// CreateCollectionHandler creates a collection from {"name", "dimension", "metric", "embedder"}
+func CreateCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    var config CollectionConfig
+    if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    log.Printf("Handling request to create collection %s", config.Name)
+
+    collection, err := collections.Create(config)
+    if err == errCollectionExists {
+        http.Error(w, fmt.Sprintf("Collection %q already exists", config.Name), http.StatusConflict)
+        return
+    } else if err != nil {
+        http.Error(w, fmt.Sprintf("Error creating collection: %v", err), http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(collection.Info())
+}
+
+// DropCollectionHandler deletes a collection and its stored embeddings
+func DropCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    log.Printf("Handling request to drop collection %s", name)
+    if err := collections.Drop(name); err == errCollectionNotFound {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, fmt.Sprintf("Error dropping collection: %v", err), http.StatusBadRequest)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// Sentence composition strategies for turning word vectors into an intent vector
+const (
+    compositionMean  = "mean"
+    compositionTFIDF = "tfidf"
+    compositionSIF   = "sif"
+)
+
+// sentenceComposition is the strategy word-average embedders use unless they set their own
+var sentenceComposition = compositionMean
+
+// sifWeightA is the smoothing constant a in the SIF weight a / (a + p(w))
+var sifWeightA = 1e-3
+
+// maxReadmeBytes bounds how much of each README is read into the corpus
+const maxReadmeBytes = 1 << 20
+
+// corpusStats holds the word frequencies of the intent catalog and project READMEs
+type corpusStats struct {
+    documents  int
+    readmes    int
+    docFreq    map[string]int
+    termFreq   map[string]int
+    totalTerms int
+    // sifA overrides sifWeightA when positive
+    sifA float64
+    // commonComponent is the first singular vector of the SIF-weighted document vectors,
+    // removed from every sentence vector under the sif strategy
+    commonComponent []float64
+}
+
+var (
+    corpusMu sync.RWMutex
+    corpus   = newCorpusStats()
+    // corpusBuildMu serialises refreshes, so the last to finish started from the newest records
+    corpusBuildMu sync.Mutex
+)
+
+func newCorpusStats() *corpusStats {
+    return &corpusStats{docFreq: make(map[string]int), termFreq: make(map[string]int)}
+}
+
+// currentCorpus returns the corpus statistics in use
+func currentCorpus() *corpusStats {
+    corpusMu.RLock()
+    defer corpusMu.RUnlock()
+    return corpus
+}
+
+// SetSentenceComposition selects the composition strategy by name
+func SetSentenceComposition(name string) error {
+    if err := checkComposition(name); err != nil {
+        return err
+    }
+    sentenceComposition = name
+    return nil
+}
+
+func checkComposition(name string) error {
+    switch name {
+    case compositionMean, compositionTFIDF, compositionSIF:
+        return nil
+    }
+    return fmt.Errorf("unknown sentence composition %q (expected mean, tfidf or sif)", name)
+}
+
+// RefreshCorpusStats rebuilds the word statistics from the intent catalog and the READMEs
+// of the projects under PROJECT_PATHS, and swaps them in for new queries
+func RefreshCorpusStats(embeddings []Embedding) {
+    refreshCorpus(func() []Embedding { return embeddings })
+}
+
+func refreshCorpus(records func() []Embedding) {
+    corpusBuildMu.Lock()
+    defer corpusBuildMu.Unlock()
+
+    embeddings := records()
+    stats := (&WordAverageEmbedder{}).buildCorpus(embeddings, readProjectReadmes())
+
+    corpusMu.Lock()
+    corpus = stats
+    corpusMu.Unlock()
+
+    log.Printf("Built corpus statistics from %d documents (%d intents, %d READMEs), %d distinct terms",
+        stats.documents, len(embeddings), stats.readmes, len(stats.termFreq))
+}
+
+// corpusRefresher rebuilds the corpus statistics in the background after the intent
+// catalog changes, one refresh at a time. Changes made while a refresh runs start one
+// more when it ends, so a burst of writes costs at most two.
+type corpusRefresher struct {
+    mu      sync.Mutex
+    running bool
+    pending bool
+    records func() []Embedding
+}
+
+func newCorpusRefresher(records func() []Embedding) *corpusRefresher {
+    return &corpusRefresher{records: records}
+}
+
+// Changed schedules a refresh without waiting for it
+func (c *corpusRefresher) Changed() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.running {
+        c.pending = true
+        return
+    }
+    c.running = true
+    go c.run()
+}
+
+func (c *corpusRefresher) run() {
+    for {
+        refreshCorpus(c.records)
+
+        c.mu.Lock()
+        if !c.pending {
+            c.running = false
+            c.mu.Unlock()
+            return
+        }
+        c.pending = false
+        c.mu.Unlock()
+    }
+}
+
+// buildCorpus computes the word statistics of the intent catalog and READMEs as this
+// embedder tokenises and composes them
+func (e *WordAverageEmbedder) buildCorpus(embeddings []Embedding, readmes []string) *corpusStats {
+    var documents []string
+    for _, embedding := range embeddings {
+        documents = append(documents, embedding.Intent+" "+embedding.Project)
+    }
+
+    stats := buildCorpusStats(append(documents, readmes...), e.tokens)
+    stats.readmes = len(readmes)
+    stats.sifA = e.SIFWeightA
+    if e.composition() == compositionSIF {
+        stats.commonComponent = stats.firstSingularVector(e, documents, readmes)
+    }
+    return stats
+}
+
+// readProjectReadmes reads README.md from every project directory under the base paths
+func readProjectReadmes() []string {
+    basePaths, err := projectBasePaths()
+    if err != nil {
+        log.Printf("Skipping README corpus: %v", err)
+        return nil
+    }
+
+    var readmes []string
+    for _, basePath := range basePaths {
+        entries, err := ioutil.ReadDir(basePath)
+        if err != nil {
+            continue
+        }
+        for _, entry := range entries {
+            if !entry.IsDir() {
+                continue
+            }
+            file, err := os.Open(filepath.Join(basePath, entry.Name(), "README.md"))
+            if err != nil {
+                continue
+            }
+            data, err := ioutil.ReadAll(io.LimitReader(file, maxReadmeBytes))
+            file.Close()
+            if err == nil && len(data) > 0 {
+                readmes = append(readmes, string(data))
+            }
+        }
+    }
+    return readmes
+}
+
+func buildCorpusStats(documents []string, tokenize func(string) []string) *corpusStats {
+    stats := newCorpusStats()
+    for _, document := range documents {
+        tokens := tokenize(document)
+        if len(tokens) == 0 {
+            continue
+        }
+        stats.documents++
+        seen := make(map[string]bool)
+        for _, token := range tokens {
+            stats.termFreq[token]++
+            stats.totalTerms++
+            if !seen[token] {
+                stats.docFreq[token]++
+                seen[token] = true
+            }
+        }
+    }
+    return stats
+}
+
+// idf is the smoothed inverse document frequency of a word
+func (c *corpusStats) idf(word string) float64 {
+    return math.Log(float64(c.documents+1)/float64(c.docFreq[word]+1)) + 1
+}
+
+// sifWeight is a / (a + p(w)); words never seen in the corpus get full weight
+func (c *corpusStats) sifWeight(word string) float64 {
+    if c.totalTerms == 0 {
+        return 1
+    }
+    a := sifWeightA
+    if c.sifA > 0 {
+        a = c.sifA
+    }
+    p := float64(c.termFreq[word]) / float64(c.totalTerms)
+    return a / (a + p)
+}
+
+// firstSingularVector estimates the dominant direction of the SIF-weighted document vectors
+// by power iteration, without centering, as in the SIF paper
+func (c *corpusStats) firstSingularVector(e *WordAverageEmbedder, documentSets ...[]string) []float64 {
+    var vectors [][]float64
+    for _, documents := range documentSets {
+        for _, document := range documents {
+            tokens := e.tokens(document)
+            if len(tokens) == 0 {
+                continue
+            }
+            wordVectors := make([][]float64, len(tokens))
+            for i, token := range tokens {
+                wordVectors[i], _ = lookupWordEmbedding(token, !e.NoSubwords)
+            }
+            vectors = append(vectors, c.weightedAverage(tokens, wordVectors, compositionSIF))
+        }
+    }
+    if len(vectors) < 2 {
+        return nil
+    }
+
+    component := make([]float64, embeddingDimension)
+    for i := range component {
+        component[i] = 1 / math.Sqrt(float64(len(component)))
+    }
+    for iteration := 0; iteration < 50; iteration++ {
+        next := make([]float64, len(component))
+        for _, vector := range vectors {
+            projection := dot(vector, component)
+            for i, value := range vector {
+                next[i] += projection * value
+            }
+        }
+        norm := math.Sqrt(dot(next, next))
+        if norm == 0 {
+            return nil
+        }
+        for i := range next {
+            next[i] /= norm
+        }
+        component = next
+    }
+    return component
+}
+
+// weightedAverage combines word vectors using the per-word weight of the given strategy
+func (c *corpusStats) weightedAverage(tokens []string, vectors [][]float64, strategy string) []float64 {
+    result := make([]float64, embeddingDimension)
+    var totalWeight float64
+    for i, vector := range vectors {
+        weight := 1.0
+        switch strategy {
+        case compositionTFIDF:
+            // Repeated tokens are visited once per occurrence, which supplies the tf factor
+            weight = c.idf(tokens[i])
+        case compositionSIF:
+            weight = c.sifWeight(tokens[i])
+        }
+        for j, value := range vector {
+            result[j] += weight * value
+        }
+        totalWeight += weight
+    }
+    if strategy == compositionSIF {
+        // SIF averages the weighted vectors over the sentence length
+        totalWeight = float64(len(vectors))
+    }
+    if totalWeight > 0 {
+        for j := range result {
+            result[j] /= totalWeight
+        }
+    }
+    return result
+}
+
+// composeSentenceVector builds a sentence vector from its token vectors with the embedder's strategy
+func (e *WordAverageEmbedder) composeSentenceVector(tokens []string, vectors [][]float64) []float64 {
+    composition := e.composition()
+    if composition == compositionMean || len(vectors) == 0 {
+        return averageVectors(vectors)
+    }
+
+    stats := e.corpusStats()
+    result := stats.weightedAverage(tokens, vectors, composition)
+    if composition == compositionSIF && len(stats.commonComponent) == len(result) {
+        projection := dot(result, stats.commonComponent)
+        for i := range result {
+            result[i] -= projection * stats.commonComponent[i]
+        }
+    }
+    return result
+}
+
+// dot returns the dot product of two equal-length vectors
+func dot(a, b []float64) float64 {
+    var sum float64
+    for i := range a {
+        sum += a[i] * b[i]
+    }
+    return sum
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "log"
+    "os"
+    "strconv"
+    "time"
+)
+
+// Configuration is read from environment variables, falling back to the defaults below
+
+// envString returns the value of an environment variable or a default when unset
+func envString(key, def string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return def
+}
+
+// envDuration parses a duration such as "5s" from an environment variable
+func envDuration(key string, def time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+        log.Printf("Invalid %s=%q, using default %s: %v", key, value, def, err)
+        return def
+    }
+    return parsed
+}
+
+// envInt parses an integer from an environment variable
+func envInt(key string, def int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    parsed, err := strconv.Atoi(value)
+    if err != nil {
+        log.Printf("Invalid %s=%q, using default %d: %v", key, value, def, err)
+        return def
+    }
+    return parsed
+}
+
+// envFloat parses a floating point number from an environment variable
+func envFloat(key string, def float64) float64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    parsed, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        log.Printf("Invalid %s=%q, using default %g: %v", key, value, def, err)
+        return def
+    }
+    return parsed
+}
@@ -45,10 +45,74 @@ type Repo struct {
 
 
 type Embedding struct {
+    ID       string    `json:"id"`
     Intent   string    `json:"intent"`
     Project  string    `json:"project"`
     Params   string    `json:"params"`
-    Vector   []float64 `json:"vector"`
+    Metadata Metadata  `json:"metadata,omitempty"`
+    // Model names the embedder that produced Vector; empty for records stored before
+    // models were recorded
+    Model string `json:"model,omitempty"`
+    // Text is what Vector was embedded from when that was not Intent, so re-embedding
+    // with another model starts from the same string
+    Text   string    `json:"text,omitempty"`
+    Vector []float32 `json:"vector,omitempty"`
+}
+
+// SourceText returns the text the record's vector was embedded from
+func (e *Embedding) SourceText() string {
+    if e.Text != "" {
+        return e.Text
+    }
+    return e.Intent
+}
+
+// IntentCandidate is one ranked embedding returned for an intent query
+type IntentCandidate struct {
+    ID         string  `json:"id"`
+    Intent     string  `json:"intent"`
+    Project    string  `json:"project"`
+    Params     string   `json:"params"`
+    Metadata   Metadata `json:"metadata,omitempty"`
+    Similarity float64  `json:"similarity"`
+    // Hybrid search reports both sides; ranks are 1-based and 0 when that side did not
+    // return the embedding
+    VectorScore  *float64 `json:"vectorScore,omitempty"`
+    VectorRank   int      `json:"vectorRank,omitempty"`
+    LexicalScore *float64 `json:"lexicalScore,omitempty"`
+    LexicalRank  int      `json:"lexicalRank,omitempty"`
+    FusedScore   float64  `json:"fusedScore,omitempty"`
+}
+
+// IntentMatchResult holds the ranked candidates for an intent query.
+// Margin is the similarity gap between the first and second ranked embeddings
+// and is 0 when fewer than two embeddings were scored.
+// Abstained is set when there are candidates but the best one fails the collection's
+// thresholds, which AbstainReasons lists.
+type IntentMatchResult struct {
+    Intent         string            `json:"intent"`
+    Candidates     []IntentCandidate `json:"candidates"`
+    Margin         float64           `json:"margin"`
+    Coverage       TokenCoverage     `json:"coverage"`
+    NoMatch        bool              `json:"noMatch"`
+    Reason         string            `json:"reason,omitempty"`
+    Abstained      bool              `json:"abstained,omitempty"`
+    AbstainReasons []AbstainReason   `json:"abstainReasons,omitempty"`
+
+    signals matchSignals
+}
+
+// EmbeddingRequest is the body of the embedding create and update endpoints. When Vector is
+// empty the server embeds Text, or the intent when Text is empty too. Model names the
+// embedder a supplied Vector came from and defaults to the collection's.
+type EmbeddingRequest struct {
+    Intent   string    `json:"intent"`
+    Project  string    `json:"project"`
+    Params   string    `json:"params"`
+    Metadata Metadata  `json:"metadata,omitempty"`
+    Model    string    `json:"model,omitempty"`
+    Vector   []float32 `json:"vector,omitempty"`
+    Text     string    `json:"text,omitempty"`
 }
 
 type EmbeddingResult struct {
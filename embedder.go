@@ -0,0 +1,203 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+// Embedder turns text into vectors. Queries and stored embeddings must come from the same one.
+type Embedder interface {
+    // Name identifies the backend and model, e.g. "ollama:nomic-embed-text". It is recorded
+    // on every stored embedding, so it must change whenever the vector space does.
+    Name() string
+    // Embed returns one vector per input text
+    Embed(texts []string) ([][]float64, error)
+}
+
+// Embedder backends selectable with the EMBEDDER environment variable
+const (
+    embedderWordAverage = "word-average"
+    embedderOllama      = "ollama"
+)
+
+// activeEmbedder produces intent vectors for queries
+var activeEmbedder Embedder = &WordAverageEmbedder{}
+
+// NewEmbedder builds the embedder with the given backend name. An Ollama model can be
+// named after a colon, as in "ollama:mxbai-embed-large"; otherwise OLLAMA_EMBED_MODEL is used.
+func NewEmbedder(backend string) (Embedder, error) {
+    name, model := backend, ""
+    if i := strings.Index(backend, ":"); i >= 0 {
+        name, model = backend[:i], backend[i+1:]
+    }
+    switch name {
+    case "", embedderWordAverage:
+        return &WordAverageEmbedder{}, nil
+    case embedderOllama:
+        if model == "" {
+            model = envString("OLLAMA_EMBED_MODEL", defaultOllamaEmbedModel)
+        }
+        return NewOllamaEmbedder(envString("OLLAMA_URL", defaultOllamaURL), model), nil
+    }
+    return nil, fmt.Errorf("unknown embedder %q (expected %s or %s)", backend, embedderWordAverage, embedderOllama)
+}
+
+// WordAverageEmbedder composes the loaded word vectors. The zero value uses the configured
+// sentence composition and the shared corpus statistics; evaluations set the fields to
+// compare other weighting and tokenisation.
+type WordAverageEmbedder struct {
+    // Composition overrides SENTENCE_COMPOSITION when set
+    Composition string
+    // SIFWeightA overrides SIF_WEIGHT_A when positive
+    SIFWeightA float64
+    // NoSubwords leaves out-of-vocabulary tokens as zero vectors instead of composing them
+    // from subword n-grams
+    NoSubwords bool
+    // MinTokenLength drops tokens with fewer characters
+    MinTokenLength int
+
+    // corpus replaces the shared corpus statistics when set
+    corpus *corpusStats
+}
+
+// Name includes the word vector file and dimension, as in "word-average:mean:glove.6B.50d.txt:50",
+// since loading other word vectors changes the space, followed by the options that differ
+// from the defaults
+func (e *WordAverageEmbedder) Name() string {
+    name := embedderWordAverage + ":" + e.composition()
+    if wordVectorStats.Path != "" {
+        name += fmt.Sprintf(":%s:%d", filepath.Base(wordVectorStats.Path), embeddingDimension)
+    }
+    if e.SIFWeightA > 0 && e.composition() == compositionSIF {
+        name += fmt.Sprintf(":a=%g", e.SIFWeightA)
+    }
+    if e.NoSubwords {
+        name += ":nosubwords"
+    }
+    if e.MinTokenLength > 1 {
+        name += fmt.Sprintf(":min%d", e.MinTokenLength)
+    }
+    return name
+}
+
+func (e *WordAverageEmbedder) Embed(texts []string) ([][]float64, error) {
+    vectors := make([][]float64, len(texts))
+    for i, text := range texts {
+        vectors[i], _ = e.convertIntentToVector(text)
+    }
+    return vectors, nil
+}
+
+func (e *WordAverageEmbedder) composition() string {
+    if e.Composition != "" {
+        return e.Composition
+    }
+    return sentenceComposition
+}
+
+// tokens splits text into the tokens the embedder composes
+func (e *WordAverageEmbedder) tokens(text string) []string {
+    tokens := tokenize(text)
+    if e.MinTokenLength <= 1 {
+        return tokens
+    }
+    kept := tokens[:0]
+    for _, token := range tokens {
+        if utf8.RuneCountInString(token) >= e.MinTokenLength {
+            kept = append(kept, token)
+        }
+    }
+    return kept
+}
+
+// corpusStats returns the statistics tfidf and sif weights come from
+func (e *WordAverageEmbedder) corpusStats() *corpusStats {
+    if e.corpus != nil {
+        return e.corpus
+    }
+    return currentCorpus()
+}
+
+// Defaults for the Ollama embedding backend
+const (
+    defaultOllamaURL        = "http://localhost:11434"
+    defaultOllamaEmbedModel = "nomic-embed-text"
+)
+
+// OllamaEmbedder calls the Ollama /api/embed endpoint
+type OllamaEmbedder struct {
+    URL    string
+    Model  string
+    client *http.Client
+}
+
+func NewOllamaEmbedder(url, model string) *OllamaEmbedder {
+    return &OllamaEmbedder{URL: url, Model: model, client: &http.Client{Timeout: 60 * time.Second}}
+}
+
+func (e *OllamaEmbedder) Name() string {
+    return embedderOllama + ":" + e.Model
+}
+
+func (e *OllamaEmbedder) Embed(texts []string) ([][]float64, error) {
+    payload := map[string]interface{}{
+        "model": e.Model,
+        "input": texts,
+    }
+    jsonData, err := json.Marshal(payload)
+    if err != nil {
+        return nil, fmt.Errorf("error marshalling payload: %w", err)
+    }
+
+    req, err := http.NewRequest("POST", e.URL+"/api/embed", bytes.NewBuffer(jsonData))
+    if err != nil {
+        return nil, fmt.Errorf("error creating request: %w", err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := e.client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("error sending request: %w", err)
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("error reading response: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("ollama returned %s: %s", resp.Status, bytes.TrimSpace(body))
+    }
+
+    var result struct {
+        Embeddings [][]float64 `json:"embeddings"`
+    }
+    if err := json.Unmarshal(body, &result); err != nil {
+        return nil, fmt.Errorf("error unmarshalling response: %w", err)
+    }
+    if len(result.Embeddings) != len(texts) {
+        return nil, fmt.Errorf("ollama returned %d embeddings for %d inputs", len(result.Embeddings), len(texts))
+    }
+    return result.Embeddings, nil
+}
+
+// embedIntent embeds a query with the given embedder. Token coverage is only known
+// for the word-average backend.
+func embedIntent(embedder Embedder, intent string) ([]float64, TokenCoverage, error) {
+    if wordAverage, ok := embedder.(*WordAverageEmbedder); ok {
+        vector, coverage := wordAverage.convertIntentToVector(intent)
+        return vector, coverage, nil
+    }
+    vectors, err := embedder.Embed([]string{intent})
+    if err != nil {
+        return nil, TokenCoverage{}, fmt.Errorf("failed to embed intent with %s: %v", embedder.Name(), err)
+    }
+    return vectors[0], TokenCoverage{}, nil
+}
@@ -5,37 +5,45 @@ import (
     "fmt"
     "io/ioutil"
     "math"
+    "sort"
     "strings"
     "unicode"
     "log"
-    "os"
 )
 
 
 // Global variables for word embeddings
-var wordEmbeddings = make(map[string][]float64)
+var wordEmbeddings = newWordVectorTable(4, 0)
 var embeddingDimension = 4 // Default dimension; adjust based on your data
 
-// LoadWordEmbeddings loads word embeddings from a JSON file
-func LoadWordEmbeddings(filePath string) error {
-    file, err := os.Open(filePath)
-    if err != nil {
-        return fmt.Errorf("failed to open embeddings file: %v", err)
-    }
-    defer file.Close()
+// Ranking limits for intent queries
+const (
+    defaultTopK = 5
+    maxTopK     = 100
+)
 
-    decoder := json.NewDecoder(file)
-    if err := decoder.Decode(&wordEmbeddings); err != nil {
-        return fmt.Errorf("failed to decode embeddings: %v", err)
-    }
+// Search modes: vector ranks by embedding similarity alone, hybrid fuses it with BM25
+const (
+    searchVector = "vector"
+    searchHybrid = "hybrid"
+)
 
-    // Set the embedding dimension based on the first vector in the map
-    for _, vec := range wordEmbeddings {
-        embeddingDimension = len(vec)
-        break
-    }
-    log.Printf("Loaded %d word embeddings with dimension %d", len(wordEmbeddings), embeddingDimension)
-    return nil
+const (
+    // defaultRRFK is the rank offset of reciprocal rank fusion; larger values flatten the
+    // advantage of the top ranks
+    defaultRRFK = 60
+    // minHybridDepth is the least number of hits taken from each side before fusing
+    minHybridDepth = 50
+    // Diversification picks k results from the best k*diversityDepthFactor hits, and at
+    // least minDiversityDepth
+    diversityDepthFactor = 10
+    minDiversityDepth    = 50
+)
+
+// LoadWordEmbeddings loads word embeddings from a JSON file
+func LoadWordEmbeddings(filePath string) error {
+    var stats WordVectorStats
+    return loadJSONWordVectors(filePath, 0, &stats)
 }
 
 // LoadEmbeddings loads intent embeddings from a JSON file
@@ -49,6 +57,9 @@ func LoadEmbeddings(filePath string) ([]Embedding, error) {
     if err := json.Unmarshal(data, &embeddings); err != nil {
         return nil, fmt.Errorf("failed to unmarshal embeddings: %v", err)
     }
+    if err := validateEmbeddings(embeddings); err != nil {
+        return nil, fmt.Errorf("invalid embeddings in %s: %v", filePath, err)
+    }
     return embeddings, nil
 }
 
@@ -86,14 +97,31 @@ func tokenize(sentence string) []string {
     return tokens
 }
 
-// getWordEmbedding retrieves the embedding for a word, or a zero vector if the word is not found
-func getWordEmbedding(word string) []float64 {
-    if embedding, exists := wordEmbeddings[word]; exists {
-        return embedding
+// Where lookupWordEmbedding found a token's vector
+const (
+    tokenInVocabulary = iota
+    tokenSubword
+    tokenMissing
+)
+
+// lookupWordEmbedding resolves a word through the word table, then, with subwords, the
+// subword n-gram buckets, and finally a zero vector, reporting which of the three was used
+func lookupWordEmbedding(word string, subwords bool) ([]float64, int) {
+    if embedding, exists := wordEmbeddings.lookup(word); exists {
+        vector := make([]float64, len(embedding))
+        for i, value := range embedding {
+            vector[i] = float64(value)
+        }
+        return vector, tokenInVocabulary
+    }
+    if subwords && subwordVectors != nil && subwordVectors.dimension == embeddingDimension {
+        if vector, ok := subwordVectors.vector(word); ok {
+            return vector, tokenSubword
+        }
     }
     // Return a zero vector if the word is not in the lookup table
     zeroVector := make([]float64, embeddingDimension)
-    return zeroVector
+    return zeroVector, tokenMissing
 }
 
 // averageVectors averages a list of vectors to create a single sentence vector
@@ -116,35 +144,306 @@ func averageVectors(vectors [][]float64) []float64 {
     return result
 }
 
-// convertIntentToVector converts an intent into a sentence vector
-func convertIntentToVector(intent string) []float64 {
-    tokens := tokenize(intent)
+// convertIntentToVector converts an intent into a sentence vector and reports how many
+// of its tokens were out of vocabulary
+func (e *WordAverageEmbedder) convertIntentToVector(intent string) ([]float64, TokenCoverage) {
+    tokens := e.tokens(intent)
     var vectors [][]float64
+    coverage := TokenCoverage{Tokens: len(tokens)}
 
     for _, token := range tokens {
-        vectors = append(vectors, getWordEmbedding(token))
+        vector, source := lookupWordEmbedding(token, !e.NoSubwords)
+        switch source {
+        case tokenInVocabulary:
+            coverage.InVocabulary++
+        case tokenSubword:
+            coverage.Subword++
+        default:
+            coverage.Missing++
+        }
+        vectors = append(vectors, vector)
+    }
+    if coverage.Tokens > 0 {
+        coverage.OOVRate = float64(coverage.Tokens-coverage.InVocabulary) / float64(coverage.Tokens)
     }
 
-    sentenceVector := averageVectors(vectors)
-    log.Printf("Generated vector for intent '%s': %v", intent, sentenceVector)
+    sentenceVector := e.composeSentenceVector(tokens, vectors)
+    log.Printf("Generated vector for intent '%s' (OOV rate %.2f, dimension %d)", intent, coverage.OOVRate, len(sentenceVector))
 
-    return sentenceVector
+    return sentenceVector, coverage
 }
 
-// MapIntentToProject maps a given intent to the most relevant project using embeddings similarity
-func MapIntentToProject(intent string, embeddings []Embedding) (Embedding, float64) {
-    intentVector := convertIntentToVector(intent)
-    var bestMatch Embedding
-    highestSimilarity := -1.0
+// SearchOptions controls how MapIntentToProject ranks candidates
+type SearchOptions struct {
+    K        int
+    MinScore float64
+    // Exact scores every embedding instead of searching the HNSW graph
+    Exact bool
+    // Ef overrides the index's default candidate list size when positive
+    Ef int
+    // Filter restricts the search to matching embeddings; nil matches everything
+    Filter *Filter
+    // Mode is searchVector (the default) or searchHybrid
+    Mode string
+    // RRFK is the rank offset used by hybrid fusion; 0 uses defaultRRFK
+    RRFK int
+    // MMR re-ranks the results by maximal marginal relevance, trading relevance against
+    // similarity to the results already picked: 1 is pure relevance, 0 pure diversity
+    MMR       bool
+    MMRLambda float64
+    // MaxPerProject caps the results from any one project when positive
+    MaxPerProject int
+    // Abstain checks the best candidate against Thresholds
+    Abstain    bool
+    Thresholds Thresholds
+}
+
+// defaultMMRLambda weighs relevance and diversity equally
+const defaultMMRLambda = 0.5
+
+// diversifying reports whether MMR or the per-project cap re-ranks the results
+func (o SearchOptions) diversifying() bool {
+    return o.MMR || o.MaxPerProject > 0
+}
+
+// MapIntentToProject embeds an intent with the collection's embedder, ranks the indexed
+// embeddings against it and returns up to k candidates scoring at least the minimum score,
+// best first. In hybrid mode the vector ranking is fused with the BM25 ranking of the
+// lexical index; the minimum score still applies to the vector similarity. NoMatch is set,
+// with a reason, when nothing qualifies, and Abstained when the best candidate fails the
+// thresholds. An error is returned only when the intent cannot be embedded.
+func MapIntentToProject(intent string, embedder Embedder, embeddings []Embedding, index *HNSWIndex, lexical *BM25Index, opts SearchOptions) (IntentMatchResult, error) {
+    result := IntentMatchResult{Intent: intent, Candidates: []IntentCandidate{}}
+    if len(embeddings) == 0 || index.Len() == 0 {
+        result.NoMatch = true
+        result.Reason = "no embeddings loaded"
+        log.Printf("No match for intent '%s': %s", intent, result.Reason)
+        return result, nil
+    }
 
-    for _, embedding := range embeddings {
-        similarity := CalculateCosineSimilarity(intentVector, embedding.Vector)
-        if similarity > highestSimilarity {
-            highestSimilarity = similarity
-            bestMatch = embedding
+    intentVector, coverage, err := embedIntent(embedder, intent)
+    if err != nil {
+        return result, err
+    }
+    result.Coverage = coverage
+
+    // At least two hits are needed to report the margin
+    limit := opts.K
+    if limit < 2 {
+        limit = 2
+    }
+    var accept func(label int) bool
+    if opts.Filter != nil {
+        accept = func(label int) bool {
+            return label < len(embeddings) && opts.Filter.Match(&embeddings[label])
         }
     }
+    depth := limit
+    if opts.Mode == searchHybrid && depth < minHybridDepth {
+        depth = minHybridDepth
+    }
+    if opts.diversifying() {
+        if depth < opts.K*diversityDepthFactor {
+            depth = opts.K * diversityDepthFactor
+        }
+        if depth < minDiversityDepth {
+            depth = minDiversityDepth
+        }
+    }
+    var hits []SearchHit
+    query := toFloat32(intentVector)
+    if opts.Exact {
+        hits = index.SearchExactFiltered(query, depth, accept)
+    } else {
+        hits = index.SearchFiltered(query, depth, opts.Ef, accept)
+    }
+    var fused []fusedHit
+    if opts.Mode == searchHybrid && len(intentVector) == index.Dimension() {
+        fused = fuseRankings(hits, lexical.Search(intent, depth, accept), opts.RRFK)
+        hits = hits[:0]
+        for _, hit := range fused {
+            hits = append(hits, SearchHit{Label: hit.Label})
+        }
+    }
+    if len(hits) == 0 && opts.Filter != nil && len(intentVector) == index.Dimension() {
+        result.NoMatch = true
+        result.Reason = fmt.Sprintf("no embeddings match filter %q", opts.Filter)
+        log.Printf("No match for intent '%s': %s", intent, result.Reason)
+        return result, nil
+    }
+    if len(hits) == 0 {
+        result.NoMatch = true
+        result.Reason = fmt.Sprintf("intent vector has dimension %d, embeddings have %d", len(intentVector), index.Dimension())
+        log.Printf("No match for intent '%s': %s", intent, result.Reason)
+        return result, nil
+    }
 
-    log.Printf("Best match for intent '%s': Project: %s, Similarity: %f", intent, bestMatch.Project, highestSimilarity)
-    return bestMatch, highestSimilarity
+    scored := make([]IntentCandidate, 0, len(hits))
+    vectors := make([][]float32, 0, len(hits))
+    for i, hit := range hits {
+        // Records added after the snapshot was taken can already be in the index
+        if hit.Label >= len(embeddings) {
+            continue
+        }
+        embedding := embeddings[hit.Label]
+        candidate := IntentCandidate{
+            ID:         embedding.ID,
+            Intent:     embedding.Intent,
+            Project:    embedding.Project,
+            Params:     embedding.Params,
+            Metadata:   embedding.Metadata,
+            Similarity: hit.Score,
+        }
+        if fused != nil {
+            f := fused[i]
+            if f.VectorRank == 0 {
+                // Found only lexically; score its vector for the minimum score and margin
+                score, ok := index.ScoreLabel(query, f.Label)
+                if !ok {
+                    continue
+                }
+                f.VectorScore = score
+            }
+            candidate.Similarity = f.VectorScore
+            candidate.VectorScore = &f.VectorScore
+            candidate.VectorRank = f.VectorRank
+            if f.LexicalRank > 0 {
+                candidate.LexicalScore = &f.LexicalScore
+                candidate.LexicalRank = f.LexicalRank
+            }
+            candidate.FusedScore = f.Fused
+        }
+        scored = append(scored, candidate)
+        vectors = append(vectors, embedding.Vector)
+    }
+
+    if len(scored) == 0 {
+        // Every hit was indexed after the snapshot was taken, or could no longer be scored
+        result.NoMatch = true
+        result.Reason = fmt.Sprintf("none of the %d embeddings found could be scored; the collection changed during the query", len(hits))
+        log.Printf("No match for intent '%s': %s", intent, result.Reason)
+        return result, nil
+    }
+
+    // The margin uses the two highest vector similarities so it is still reported when k
+    // is 1. Hybrid hits are in fused order, so the first two need not be the best.
+    bestSimilarity, runnerUp := topTwoSimilarities(scored)
+    if len(scored) > 1 {
+        result.Margin = bestSimilarity - runnerUp
+    }
+
+    var eligibleVectors [][]float32
+    for i, candidate := range scored {
+        if len(result.Candidates) >= opts.K && !opts.diversifying() {
+            break
+        }
+        if candidate.Similarity >= opts.MinScore {
+            result.Candidates = append(result.Candidates, candidate)
+            eligibleVectors = append(eligibleVectors, vectors[i])
+        }
+    }
+    if opts.diversifying() {
+        result.Candidates = diversify(result.Candidates, eligibleVectors, opts)
+    }
+
+    if len(result.Candidates) == 0 {
+        result.NoMatch = true
+        result.Reason = fmt.Sprintf("best similarity %.4f is below min score %.4f", bestSimilarity, opts.MinScore)
+        log.Printf("No match for intent '%s': %s", intent, result.Reason)
+        return result, nil
+    }
+
+    result.signals = matchSignals{
+        Score:    result.Candidates[0].Similarity,
+        Margin:   result.Margin,
+        RunnerUp: len(scored) > 1,
+        OOVRate:  coverage.OOVRate,
+        Coverage: coverage.Tokens > 0,
+    }
+    if opts.Abstain {
+        if reasons := opts.Thresholds.reasons(result.signals); len(reasons) > 0 {
+            result.Abstained = true
+            result.AbstainReasons = reasons
+            log.Printf("Abstaining for intent '%s': %s", intent, reasons[0].Message)
+            return result, nil
+        }
+    }
+
+    best := result.Candidates[0]
+    log.Printf("Best match for intent '%s': Project: %s, Similarity: %f, Margin: %f", intent, best.Project, best.Similarity, result.Margin)
+    return result, nil
+}
+
+// topTwoSimilarities returns the highest and second highest vector similarity of the
+// candidates, which must not be empty
+func topTwoSimilarities(candidates []IntentCandidate) (best, second float64) {
+    best, second = candidates[0].Similarity, math.Inf(-1)
+    for _, candidate := range candidates[1:] {
+        if candidate.Similarity > best {
+            best, second = candidate.Similarity, best
+        } else if candidate.Similarity > second {
+            second = candidate.Similarity
+        }
+    }
+    return best, second
+}
+
+// fusedHit is an embedding ranked by reciprocal rank fusion, with its place on each side
+type fusedHit struct {
+    Label        int
+    Fused        float64
+    VectorScore  float64
+    VectorRank   int
+    LexicalScore float64
+    LexicalRank  int
+}
+
+// fuseRankings combines the vector and lexical rankings by reciprocal rank fusion: an
+// embedding scores the sum of 1/(k + rank) over the rankings it appears in. Ties go to
+// the better vector rank.
+func fuseRankings(vector []SearchHit, lexical []LexicalHit, k int) []fusedHit {
+    if k <= 0 {
+        k = defaultRRFK
+    }
+    byLabel := make(map[int]*fusedHit, len(vector)+len(lexical))
+    fused := make([]*fusedHit, 0, len(vector)+len(lexical))
+    get := func(label int) *fusedHit {
+        hit, exists := byLabel[label]
+        if !exists {
+            hit = &fusedHit{Label: label}
+            byLabel[label] = hit
+            fused = append(fused, hit)
+        }
+        return hit
+    }
+    for i, hit := range vector {
+        f := get(hit.Label)
+        f.VectorScore, f.VectorRank = hit.Score, i+1
+        f.Fused += 1 / float64(k+i+1)
+    }
+    for i, hit := range lexical {
+        f := get(hit.Label)
+        f.LexicalScore, f.LexicalRank = hit.Score, i+1
+        f.Fused += 1 / float64(k+i+1)
+    }
+
+    sort.SliceStable(fused, func(i, j int) bool {
+        if fused[i].Fused != fused[j].Fused {
+            return fused[i].Fused > fused[j].Fused
+        }
+        return rankOrLast(fused[i].VectorRank) < rankOrLast(fused[j].VectorRank)
+    })
+    hits := make([]fusedHit, len(fused))
+    for i, hit := range fused {
+        hits[i] = *hit
+    }
+    return hits
+}
+
+// rankOrLast orders a missing rank (0) after every real one
+func rankOrLast(rank int) int {
+    if rank == 0 {
+        return math.MaxInt32
+    }
+    return rank
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// defaultEvalK is the ranking depth evaluated when none is given
+const defaultEvalK = 10
+
+// evalCutoffs are the depths recall is reported at, besides k itself
+var evalCutoffs = []int{1, 3, 5, 10}
+
+// EvalConfig is one way of mapping intents to compare. Params uses the query parameter
+// syntax of /map-intent, e.g. "mode=hybrid&rrf_k=30", plus embedder= to re-embed the
+// collection with another embedder for the evaluation. For the word-average embedder,
+// composition=, sif_a=, subwords= and min_token= set the sentence composition and
+// tokenisation, re-embedding the collection with them. k and max_per_project are set by
+// the evaluation.
+type EvalConfig struct {
+    Name   string `json:"name"`
+    Params string `json:"params,omitempty"`
+}
+
+// EvalResult holds the metrics of one configuration. Ranks are those of the labelled
+// project among the distinct projects returned; a project missing from the top k counts
+// as a miss. Improved and Regressed compare each query with the first configuration.
+type EvalResult struct {
+    Name      string          `json:"name"`
+    Params    string          `json:"params,omitempty"`
+    Embedder  string          `json:"embedder"`
+    Recall    map[int]float64 `json:"recall"`
+    MRR       float64         `json:"mrr"`
+    NDCG      float64         `json:"ndcg"`
+    NoMatch   int             `json:"noMatch"`
+    Improved  int             `json:"improved"`
+    Regressed int             `json:"regressed"`
+    Duration  string          `json:"duration"`
+}
+
+// EvalQuery is how each configuration ranked a labelled intent. Ranks and Top follow the
+// order of the report's configurations; a rank of 0 is a miss.
+type EvalQuery struct {
+    Intent  string   `json:"intent"`
+    Project string   `json:"project"`
+    Ranks   []int    `json:"ranks"`
+    Top     []string `json:"top"`
+}
+
+// EvalReport compares configurations on a labelled set. Examples without a project are
+// skipped, since there is no right answer to rank. Diff lists the queries ranked
+// differently by some configuration.
+type EvalReport struct {
+    Collection string       `json:"collection"`
+    K          int          `json:"k"`
+    Queries    int          `json:"queries"`
+    Skipped    int          `json:"skipped"`
+    Configs    []EvalResult `json:"configs"`
+    Diff       []EvalQuery  `json:"diff"`
+    PerQuery   []EvalQuery  `json:"perQuery"`
+}
+
+// Evaluate maps every labelled intent under each configuration and reports recall@k, MRR
+// and nDCG@k at the project level, with a per-query diff between the configurations.
+// Errors come with the HTTP status they map to: invalid examples and configurations are
+// the client's, failures to embed are the embedder's.
+func (r *CollectionRegistry) Evaluate(collection *Collection, examples []LabelledIntent, configs []EvalConfig, k int) (EvalReport, int, error) {
+    if k < 1 || k > maxTopK {
+        return EvalReport{}, http.StatusBadRequest, fmt.Errorf("k must be between 1 and %d", maxTopK)
+    }
+    if len(configs) == 0 {
+        configs = []EvalConfig{{Name: "default"}}
+    }
+    report := EvalReport{Collection: collection.Config.Name, K: k}
+    for i, example := range examples {
+        if example.Intent == "" {
+            return report, http.StatusBadRequest, fmt.Errorf("labelled example %d has no intent", i+1)
+        }
+        if example.Project == "" {
+            report.Skipped++
+            continue
+        }
+        report.PerQuery = append(report.PerQuery, EvalQuery{Intent: example.Intent, Project: example.Project})
+    }
+    report.Queries = len(report.PerQuery)
+    if report.Queries == 0 {
+        return report, http.StatusBadRequest, fmt.Errorf("no labelled example names a project")
+    }
+
+    names := make(map[string]bool)
+    for _, config := range configs {
+        if config.Name == "" || names[config.Name] {
+            return report, http.StatusBadRequest, fmt.Errorf("every configuration needs a distinct name")
+        }
+        names[config.Name] = true
+        result, status, err := r.evaluateConfig(collection, report.PerQuery, config, k)
+        if err != nil {
+            return report, status, fmt.Errorf("configuration %s: %v", config.Name, err)
+        }
+        report.Configs = append(report.Configs, result)
+    }
+    report.compare()
+    return report, http.StatusOK, nil
+}
+
+// evaluateConfig runs the labelled queries under one configuration, appending each rank
+// to the queries and returning the metrics
+func (r *CollectionRegistry) evaluateConfig(collection *Collection, queries []EvalQuery, config EvalConfig, k int) (EvalResult, int, error) {
+    result := EvalResult{Name: config.Name, Params: config.Params, Recall: make(map[int]float64)}
+    values, err := url.ParseQuery(config.Params)
+    if err != nil {
+        return result, http.StatusBadRequest, fmt.Errorf("invalid params: %v", err)
+    }
+    opts, err := parseSearchOptions(values)
+    if err != nil {
+        return result, http.StatusBadRequest, err
+    }
+    opts.K = k
+    opts.MaxPerProject = 1
+    opts.MinScore = math.Inf(-1)
+    opts.Abstain = false
+
+    target, status, err := r.evalTarget(collection, values)
+    if err != nil {
+        return result, status, err
+    }
+    result.Embedder = target.Embedder.Name()
+
+    start := time.Now()
+    embeddings, index, lexical := target.Store.Snapshot()
+    for i := range queries {
+        query := &queries[i]
+        match, err := MapIntentToProject(query.Intent, target.Embedder, embeddings, index, lexical, opts)
+        if err != nil {
+            return result, http.StatusBadGateway, err
+        }
+        query.rank(&result, match, k)
+    }
+    result.finish(len(queries), k)
+    result.Duration = time.Since(start).String()
+    log.Printf("Evaluated %s on %d queries: recall@%d %.3f, MRR %.3f, nDCG %.3f", config.Name, len(queries), k, result.Recall[k], result.MRR, result.NDCG)
+    return result, http.StatusOK, nil
+}
+
+// rank appends the rank of the labelled project among the matched candidates to the
+// query and adds it to the configuration's sums
+func (query *EvalQuery) rank(result *EvalResult, match IntentMatchResult, k int) {
+    rank, top := 0, ""
+    if match.NoMatch {
+        result.NoMatch++
+    } else {
+        top = match.Candidates[0].Project
+    }
+    for position, candidate := range match.Candidates {
+        if candidate.Project == query.Project {
+            rank = position + 1
+            break
+        }
+    }
+    query.Ranks = append(query.Ranks, rank)
+    query.Top = append(query.Top, top)
+
+    if rank == 0 {
+        return
+    }
+    for _, cutoff := range evalCutoffs {
+        if cutoff < k && rank <= cutoff {
+            result.Recall[cutoff]++
+        }
+    }
+    result.Recall[k]++
+    result.MRR += 1 / float64(rank)
+    // A single relevant project makes the ideal DCG 1
+    result.NDCG += 1 / math.Log2(float64(rank)+1)
+}
+
+// finish turns the sums of n ranked queries into means
+func (result *EvalResult) finish(n, k int) {
+    for _, cutoff := range evalCutoffs {
+        if cutoff < k {
+            result.Recall[cutoff] /= float64(n)
+        }
+    }
+    result.Recall[k] /= float64(n)
+    result.MRR /= float64(n)
+    result.NDCG /= float64(n)
+}
+
+// evalTarget returns the collection as the configuration's embedder would see it. Another
+// model's vectors are built in memory from the records' text, leaving the collection
+// untouched.
+func (r *CollectionRegistry) evalTarget(collection *Collection, values url.Values) (*Collection, int, error) {
+    embedderSpec := values.Get("embedder")
+    wordAverage, err := parseWordAverageOptions(values)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    var embedder Embedder
+    switch {
+    case wordAverage != nil:
+        if embedderSpec == "" {
+            embedderSpec = collection.Config.Embedder
+        }
+        base, err := NewEmbedder(embedderSpec)
+        if err != nil {
+            return nil, http.StatusBadRequest, err
+        }
+        if _, ok := base.(*WordAverageEmbedder); !ok {
+            return nil, http.StatusBadRequest, fmt.Errorf("composition, sif_a, subwords and min_token apply to the %s embedder, not %s", embedderWordAverage, base.Name())
+        }
+        // The weights come from this collection as the options tokenise it
+        wordAverage.corpus = wordAverage.buildCorpus(collection.Store.Embeddings(), readProjectReadmes())
+        embedder = wordAverage
+    case embedderSpec == "":
+        if err := collection.CheckEmbedder(); err != nil {
+            return nil, http.StatusConflict, err
+        }
+        return collection, http.StatusOK, nil
+    default:
+        if embedder, err = NewEmbedder(embedderSpec); err != nil {
+            return nil, http.StatusBadRequest, err
+        }
+        if model := collection.Store.Model(); model == embedder.Name() {
+            return &Collection{Config: collection.Config, Store: collection.Store, Embedder: embedder}, http.StatusOK, nil
+        }
+    }
+
+    indexConfig := r.indexConfig
+    indexConfig.Metric = collection.Config.Metric
+    staging := NewEmbeddingStore(memoryBackend{}, indexConfig, 0)
+    log.Printf("Re-embedding collection %s with %s for evaluation", collection.Config.Name, embedder.Name())
+    if err := reembedInto(staging, embedder, collection.Store.Embeddings(), 32, nil, nil); err != nil {
+        return nil, http.StatusBadGateway, err
+    }
+    return &Collection{Config: collection.Config, Store: staging, Embedder: embedder}, http.StatusOK, nil
+}
+
+// compare counts, for every configuration, the queries it ranks better or worse than the
+// first one and collects the queries the configurations disagree on
+func (report *EvalReport) compare() {
+    report.Diff = []EvalQuery{}
+    for i := range report.Configs {
+        report.Configs[i].Improved, report.Configs[i].Regressed = 0, 0
+    }
+    for _, query := range report.PerQuery {
+        differs := false
+        for i := 1; i < len(query.Ranks); i++ {
+            baseline, rank := rankOrLast(query.Ranks[0]), rankOrLast(query.Ranks[i])
+            switch {
+            case rank < baseline:
+                report.Configs[i].Improved++
+            case rank > baseline:
+                report.Configs[i].Regressed++
+            }
+            if query.Ranks[i] != query.Ranks[0] || query.Top[i] != query.Top[0] {
+                differs = true
+            }
+        }
+        if differs {
+            report.Diff = append(report.Diff, query)
+        }
+    }
+}
+
+// MergeBaseline puts the configurations of an earlier report on the same labelled set in
+// front of this one's, prefixed with "baseline:", so the diff shows what changed since.
+// Code changes, which no configuration can express, are compared this way.
+func (report *EvalReport) MergeBaseline(baseline EvalReport) error {
+    if baseline.K != report.K {
+        return fmt.Errorf("the baseline was evaluated at k=%d, not %d", baseline.K, report.K)
+    }
+    if len(baseline.PerQuery) != len(report.PerQuery) {
+        return fmt.Errorf("the baseline has %d queries, not %d", len(baseline.PerQuery), len(report.PerQuery))
+    }
+    for i, query := range baseline.PerQuery {
+        if query.Intent != report.PerQuery[i].Intent || query.Project != report.PerQuery[i].Project {
+            return fmt.Errorf("query %d of the baseline is %q -> %s, not %q -> %s", i+1, query.Intent, query.Project, report.PerQuery[i].Intent, report.PerQuery[i].Project)
+        }
+    }
+
+    configs := make([]EvalResult, 0, len(baseline.Configs)+len(report.Configs))
+    for _, config := range baseline.Configs {
+        if !strings.HasPrefix(config.Name, "baseline:") {
+            config.Name = "baseline:" + config.Name
+        }
+        configs = append(configs, config)
+    }
+    report.Configs = append(configs, report.Configs...)
+    for i := range report.PerQuery {
+        report.PerQuery[i].Ranks = append(append([]int(nil), baseline.PerQuery[i].Ranks...), report.PerQuery[i].Ranks...)
+        report.PerQuery[i].Top = append(append([]string(nil), baseline.PerQuery[i].Top...), report.PerQuery[i].Top...)
+    }
+    report.compare()
+    return nil
+}
+
+// parseWordAverageOptions reads the word-average composition and tokenisation of a
+// configuration, or returns nil when it sets none of them
+func parseWordAverageOptions(values url.Values) (*WordAverageEmbedder, error) {
+    embedder := &WordAverageEmbedder{}
+    set := false
+    if raw := values.Get("composition"); raw != "" {
+        if err := checkComposition(raw); err != nil {
+            return nil, err
+        }
+        embedder.Composition = raw
+        set = true
+    }
+    if raw := values.Get("sif_a"); raw != "" {
+        parsed, err := strconv.ParseFloat(raw, 64)
+        if err != nil || parsed <= 0 {
+            return nil, fmt.Errorf("Invalid 'sif_a' parameter: must be a positive number")
+        }
+        embedder.SIFWeightA = parsed
+        set = true
+    }
+    if raw := values.Get("subwords"); raw != "" {
+        parsed, err := strconv.ParseBool(raw)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid 'subwords' parameter: %v", err)
+        }
+        embedder.NoSubwords = !parsed
+        set = true
+    }
+    if raw := values.Get("min_token"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 {
+            return nil, fmt.Errorf("Invalid 'min_token' parameter: must be a positive integer")
+        }
+        embedder.MinTokenLength = parsed
+        set = true
+    }
+    if !set {
+        return nil, nil
+    }
+    return embedder, nil
+}
+
+// parseEvalConfig reads a configuration given as name:params on the command line
+func parseEvalConfig(raw string) (EvalConfig, error) {
+    name, params := raw, ""
+    if i := strings.Index(raw, ":"); i >= 0 {
+        name, params = raw[:i], raw[i+1:]
+    }
+    if name == "" {
+        return EvalConfig{}, fmt.Errorf("configuration %q has no name", raw)
+    }
+    return EvalConfig{Name: name, Params: params}, nil
+}
+
+// EvalCollectionHandler evaluates configurations on a labelled set sent as
+// {"k", "configs": [{"name", "params"}], "examples": [{"intent", "project"}]} and returns
+// the EvalReport
+func EvalCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    collection, err := collections.Get(name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    }
+    var req struct {
+        K        int              `json:"k"`
+        Configs  []EvalConfig     `json:"configs"`
+        Examples []LabelledIntent `json:"examples"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if req.K == 0 {
+        req.K = defaultEvalK
+    }
+    if len(req.Examples) == 0 {
+        http.Error(w, "'examples' must not be empty", http.StatusBadRequest)
+        return
+    }
+    log.Printf("Handling request to evaluate %d configurations on collection %s", len(req.Configs), name)
+
+    report, status, err := collections.Evaluate(collection, req.Examples, req.Configs, req.K)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error evaluating collection: %v", err), status)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "errors"
+    "math"
+    "net/http"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+// failingEmbedder stands in for an embedding server that is down
+type failingEmbedder struct{}
+
+func (failingEmbedder) Name() string { return "failing" }
+
+func (failingEmbedder) Embed(texts []string) ([][]float64, error) {
+    return nil, errors.New("connection refused")
+}
+
+// testMatch returns a match whose candidates are the given projects in rank order
+func testMatch(projects ...string) IntentMatchResult {
+    match := IntentMatchResult{NoMatch: len(projects) == 0}
+    for _, project := range projects {
+        match.Candidates = append(match.Candidates, IntentCandidate{Project: project})
+    }
+    return match
+}
+
+// useTestWordVectors installs a small word vector table for the duration of a test
+func useTestWordVectors(t *testing.T, vectors map[string][]float32) {
+    savedTable, savedDimension := wordEmbeddings, embeddingDimension
+    t.Cleanup(func() {
+        wordEmbeddings, embeddingDimension = savedTable, savedDimension
+    })
+    table := newWordVectorTable(2, len(vectors))
+    for word, vector := range vectors {
+        table.add(word, vector)
+    }
+    setWordVectors(table)
+    t.Setenv("PROJECT_PATHS", t.TempDir())
+}
+
+func TestWordAverageOptions(t *testing.T) {
+    defaults := &WordAverageEmbedder{}
+    if name := defaults.Name(); name != embedderWordAverage+":"+sentenceComposition {
+        t.Errorf("default name = %s, want the name recorded before the options existed", name)
+    }
+
+    values, _ := url.ParseQuery("composition=sif&sif_a=0.01&subwords=false&min_token=3&mode=hybrid")
+    embedder, err := parseWordAverageOptions(values)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if name := embedder.Name(); name != "word-average:sif:a=0.01:nosubwords:min3" {
+        t.Errorf("name = %s, want every option in it", name)
+    }
+    if tokens := embedder.tokens("go to the bank"); strings.Join(tokens, " ") != "the bank" {
+        t.Errorf("tokens = %q, want those of 3 characters or more", tokens)
+    }
+
+    if embedder, err := parseWordAverageOptions(url.Values{"mode": {"hybrid"}}); embedder != nil || err != nil {
+        t.Errorf("search params alone gave %+v, %v, want no word-average options", embedder, err)
+    }
+    for _, params := range []string{"composition=max", "sif_a=0", "subwords=maybe", "min_token=0"} {
+        values, _ := url.ParseQuery(params)
+        if _, err := parseWordAverageOptions(values); err == nil {
+            t.Errorf("%s was accepted", params)
+        }
+    }
+}
+
+func TestEvaluateBuildsWordAverageEmbedderPerConfig(t *testing.T) {
+    // "ab" is short and points at the scraper, so only dropping it ranks the bank first
+    useTestWordVectors(t, map[string][]float32{
+        "scrape": {1, 0}, "news": {1, 0}, "ab": {1, 0},
+        "check": {0, 1}, "rates": {0, 1}, "bank": {0, 1},
+    })
+    registry, collection := testMigrationRegistry(t.TempDir(), &WordAverageEmbedder{})
+    examples := []LabelledIntent{{Intent: "ab ab ab bank", Project: "bank"}}
+    configs := []EvalConfig{
+        {Name: "all-tokens", Params: "composition=mean"},
+        {Name: "long-tokens", Params: "composition=mean&min_token=3"},
+    }
+
+    report, _, err := registry.Evaluate(collection, examples, configs, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ranks := report.PerQuery[0].Ranks; ranks[0] != 2 || ranks[1] != 1 {
+        t.Errorf("ranks = %v, want the bank second with every token and first without the short ones", ranks)
+    }
+    if name := report.Configs[1].Embedder; !strings.HasSuffix(name, ":min3") {
+        t.Errorf("embedder = %s, want the configured one", name)
+    }
+    if collection.Store.Model() != (&WordAverageEmbedder{}).Name() {
+        t.Errorf("the evaluation changed the collection's vectors to %s", collection.Store.Model())
+    }
+
+    configs = []EvalConfig{{Name: "mixed", Params: "embedder=ollama:test&composition=sif"}}
+    if _, _, err := registry.Evaluate(collection, examples, configs, 2); err == nil {
+        t.Error("word-average options were accepted with the ollama embedder")
+    }
+}
+
+func TestEvalMetricsFromKnownRanks(t *testing.T) {
+    tests := []struct {
+        name    string
+        k       int
+        matches []IntentMatchResult
+        ranks   []int
+        recall  map[int]float64
+        mrr     float64
+        ndcg    float64
+        noMatch int
+    }{
+        {
+            name:    "ranks 1 and 3 and a miss",
+            k:       10,
+            matches: []IntentMatchResult{testMatch("bank", "scraper"), testMatch("scraper", "mail", "bank"), testMatch("scraper")},
+            ranks:   []int{1, 3, 0},
+            recall:  map[int]float64{1: 1.0 / 3, 3: 2.0 / 3, 5: 2.0 / 3, 10: 2.0 / 3},
+            mrr:     (1 + 1.0/3) / 3,
+            ndcg:    (1 + 0.5) / 3,
+        },
+        {
+            name:    "k below the larger cutoffs",
+            k:       2,
+            matches: []IntentMatchResult{testMatch("bank"), testMatch("scraper", "bank"), testMatch()},
+            ranks:   []int{1, 2, 0},
+            recall:  map[int]float64{1: 1.0 / 3, 2: 2.0 / 3},
+            mrr:     (1 + 0.5) / 3,
+            ndcg:    (1 + 1/math.Log2(3)) / 3,
+            noMatch: 1,
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            result := EvalResult{Recall: make(map[int]float64)}
+            queries := make([]EvalQuery, len(test.matches))
+            for i, match := range test.matches {
+                queries[i].Project = "bank"
+                queries[i].rank(&result, match, test.k)
+            }
+            result.finish(len(queries), test.k)
+
+            for i, query := range queries {
+                if len(query.Ranks) != 1 || query.Ranks[0] != test.ranks[i] {
+                    t.Errorf("query %d ranks = %v, want [%d]", i, query.Ranks, test.ranks[i])
+                }
+            }
+            if len(result.Recall) != len(test.recall) {
+                t.Errorf("recall = %v, want %v", result.Recall, test.recall)
+            }
+            for cutoff, want := range test.recall {
+                if got, ok := result.Recall[cutoff]; !ok || math.Abs(got-want) > 1e-9 {
+                    t.Errorf("recall@%d = %v, want %v", cutoff, got, want)
+                }
+            }
+            if math.Abs(result.MRR-test.mrr) > 1e-9 || math.Abs(result.NDCG-test.ndcg) > 1e-9 {
+                t.Errorf("MRR %v, nDCG %v, want %v, %v", result.MRR, result.NDCG, test.mrr, test.ndcg)
+            }
+            if result.NoMatch != test.noMatch {
+                t.Errorf("noMatch = %d, want %d", result.NoMatch, test.noMatch)
+            }
+        })
+    }
+}
+
+func TestEvalCompareCountsAgainstFirstConfig(t *testing.T) {
+    report := EvalReport{
+        Configs: []EvalResult{{Name: "baseline"}, {Name: "candidate"}},
+        PerQuery: []EvalQuery{
+            {Intent: "worse", Ranks: []int{1, 2}, Top: []string{"bank", "scraper"}},
+            {Intent: "better", Ranks: []int{3, 1}, Top: []string{"scraper", "bank"}},
+            {Intent: "found", Ranks: []int{0, 4}, Top: []string{"scraper", "scraper"}},
+            {Intent: "same", Ranks: []int{2, 2}, Top: []string{"scraper", "scraper"}},
+            {Intent: "both missed", Ranks: []int{0, 0}, Top: []string{"scraper", "mail"}},
+        },
+    }
+    report.compare()
+
+    if candidate := report.Configs[1]; candidate.Improved != 2 || candidate.Regressed != 1 {
+        t.Errorf("improved %d, regressed %d, want 2 and 1", candidate.Improved, candidate.Regressed)
+    }
+    if baseline := report.Configs[0]; baseline.Improved != 0 || baseline.Regressed != 0 {
+        t.Errorf("the baseline counts %d and %d against itself", baseline.Improved, baseline.Regressed)
+    }
+    var diff []string
+    for _, query := range report.Diff {
+        diff = append(diff, query.Intent)
+    }
+    if strings.Join(diff, ",") != "worse,better,found,both missed" {
+        t.Errorf("diff = %v, want every query ranked or topped differently", diff)
+    }
+}
+
+func TestEvaluateStatuses(t *testing.T) {
+    examples := []LabelledIntent{{Intent: "check rates", Project: "bank"}}
+    registry, collection := testMigrationRegistry(t.TempDir(), failingEmbedder{})
+    if _, status, err := registry.Evaluate(collection, examples, nil, 2); err == nil || status != http.StatusBadGateway {
+        t.Errorf("a failing embedder gave %d, %v, want %d", status, err, http.StatusBadGateway)
+    }
+
+    registry, collection = testMigrationRegistry(t.TempDir(), &recordingEmbedder{})
+    invalid := [][]EvalConfig{
+        {{Name: "bad", Params: "mode=fuzzy"}},
+        {{Name: "bad", Params: "embedder=unknown"}},
+        {{Name: "bad", Params: "min_token=x"}},
+        {{Name: "same"}, {Name: "same"}},
+    }
+    for _, configs := range invalid {
+        if _, status, err := registry.Evaluate(collection, examples, configs, 2); err == nil || status != http.StatusBadRequest {
+            t.Errorf("%+v gave %d, %v, want %d", configs, status, err, http.StatusBadRequest)
+        }
+    }
+    if _, status, _ := registry.Evaluate(collection, examples, nil, 0); status != http.StatusBadRequest {
+        t.Errorf("k=0 gave %d, want %d", status, http.StatusBadRequest)
+    }
+}
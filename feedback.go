@@ -0,0 +1,501 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// What a piece of feedback did to the collection
+const (
+    feedbackMovedToward  = "moved_toward"
+    feedbackMovedAway    = "moved_away"
+    feedbackAddedExample = "added_example"
+    feedbackRecorded     = "recorded"
+)
+
+// Rocchio weights of the query when moving a record toward an accepted query (beta) or
+// away from a rejected one (gamma), and the similarity below which an accepted query is
+// added as a new example instead
+const (
+    defaultFeedbackBeta              = 0.2
+    defaultFeedbackGamma             = 0.1
+    defaultFeedbackExampleSimilarity = 0.8
+)
+
+// maxFeedbackLineBytes bounds one line of the feedback log, which carries two vectors
+const maxFeedbackLineBytes = 16 << 20
+
+// feedbackMu serialises feedback, so concurrent updates of a record are not lost and
+// the log stays in the order they were applied
+var feedbackMu sync.Mutex
+
+// FeedbackRequest tells the service whether mapping an intent to a project was right. ID
+// names the embedding the mapping returned; without it the project's nearest one is used.
+type FeedbackRequest struct {
+    Intent   string `json:"intent"`
+    Project  string `json:"project"`
+    Accepted *bool  `json:"accepted"`
+    ID       string `json:"id,omitempty"`
+}
+
+// FeedbackEntry is one line of a collection's feedback log
+type FeedbackEntry struct {
+    Time       time.Time         `json:"time"`
+    Intent     string            `json:"intent"`
+    Project    string            `json:"project"`
+    Accepted   bool              `json:"accepted"`
+    Action     string            `json:"action"`
+    Note       string            `json:"note,omitempty"`
+    Adjustment *VectorAdjustment `json:"adjustment,omitempty"`
+}
+
+// VectorAdjustment records how feedback changed a stored vector. Similarity is the cosine
+// between the query and the record beforehand; Before is empty for an added example.
+type VectorAdjustment struct {
+    ID         string    `json:"id"`
+    Model      string    `json:"model"`
+    Similarity float64   `json:"similarity"`
+    Before     []float32 `json:"before,omitempty"`
+    After      []float32 `json:"after"`
+}
+
+// feedbackPath is the log of a collection under FEEDBACK_PATH
+func feedbackPath(collection string) string {
+    return filepath.Join(envString("FEEDBACK_PATH", "data/feedback"), collection+".jsonl")
+}
+
+// ApplyFeedback records feedback and adjusts the collection with a Rocchio-style update.
+// An accepted pair moves the record toward the query, or adds the query as a new example
+// of the project when no record of it is similar enough; a rejected pair moves the record
+// away from the query. The entry is logged once the record is written, and the write is
+// undone when the log cannot be appended, so every changed vector has an entry holding
+// its vector from before feedback. Errors come with the HTTP status they map to.
+func ApplyFeedback(collection *Collection, req FeedbackRequest) (FeedbackEntry, int, error) {
+    entry := FeedbackEntry{Time: time.Now(), Intent: req.Intent, Project: req.Project, Accepted: *req.Accepted}
+    vector, _, err := embedIntent(collection.Embedder, req.Intent)
+    if err != nil {
+        return entry, http.StatusBadGateway, err
+    }
+    query := normalizeFloat32(toFloat32(vector))
+    if dimension := collection.Store.Dimension(); dimension != 0 && len(query) != dimension {
+        return entry, http.StatusConflict, fmt.Errorf("intent vector has dimension %d, collection %s has %d", len(query), collection.Config.Name, dimension)
+    }
+
+    feedbackMu.Lock()
+    defer feedbackMu.Unlock()
+
+    target, found, status, err := feedbackTarget(collection, req, query)
+    if err != nil {
+        return entry, status, err
+    }
+    var updated *Embedding
+    switch {
+    case isZeroVector(query):
+        entry.Action = feedbackRecorded
+        entry.Note = "the intent has no vector to learn from"
+    case !found && !entry.Accepted:
+        entry.Action = feedbackRecorded
+        entry.Note = fmt.Sprintf("project %s has no embeddings to move", req.Project)
+    case entry.Accepted && (!found || (req.ID == "" && cosineFloat32(query, target.Vector) < envFloat("FEEDBACK_EXAMPLE_SIMILARITY", defaultFeedbackExampleSimilarity))):
+        example := Embedding{
+            ID:       newEmbeddingID(),
+            Intent:   req.Intent,
+            Project:  req.Project,
+            Metadata: Metadata{"source": "feedback"},
+            Model:    collection.Embedder.Name(),
+            Vector:   toFloat32(vector),
+        }
+        entry.Action = feedbackAddedExample
+        entry.Adjustment = &VectorAdjustment{ID: example.ID, Model: example.Model, After: example.Vector}
+        if found {
+            entry.Adjustment.Similarity = cosineFloat32(query, target.Vector)
+        }
+        updated = &example
+    default:
+        weight := envFloat("FEEDBACK_BETA", defaultFeedbackBeta)
+        entry.Action = feedbackMovedToward
+        if !entry.Accepted {
+            weight = -envFloat("FEEDBACK_GAMMA", defaultFeedbackGamma)
+            entry.Action = feedbackMovedAway
+        }
+        moved := target
+        moved.Vector = rocchio(target.Vector, query, weight)
+        entry.Adjustment = &VectorAdjustment{
+            ID:         target.ID,
+            Model:      target.Model,
+            Similarity: cosineFloat32(query, target.Vector),
+            Before:     target.Vector,
+            After:      moved.Vector,
+        }
+        updated = &moved
+    }
+
+    if updated != nil {
+        if _, _, err := collection.Store.Put(*updated); err != nil {
+            return entry, http.StatusInternalServerError, fmt.Errorf("failed to save the embedding: %v", err)
+        }
+    }
+    if err := appendFeedback(collection.Config.Name, entry); err != nil {
+        if updated != nil {
+            undoFeedback(collection, entry, target)
+        }
+        return entry, http.StatusInternalServerError, fmt.Errorf("failed to log feedback, the embedding was left unchanged: %v", err)
+    }
+    log.Printf("Feedback on '%s' -> %s (accepted %v): %s", req.Intent, req.Project, entry.Accepted, entry.Action)
+    return entry, 0, nil
+}
+
+// undoFeedback restores what ApplyFeedback wrote for an entry it could not log: it removes
+// an added example or puts the moved record back
+func undoFeedback(collection *Collection, entry FeedbackEntry, target Embedding) {
+    var err error
+    if entry.Action == feedbackAddedExample {
+        err = collection.Store.Delete(entry.Adjustment.ID)
+    } else {
+        _, _, err = collection.Store.Put(target)
+    }
+    if err != nil {
+        log.Printf("Failed to undo unlogged feedback on embedding %s: %v", entry.Adjustment.ID, err)
+    }
+}
+
+// feedbackTarget returns the record the feedback applies to: the one named by ID, or the
+// project's record nearest to the query
+func feedbackTarget(collection *Collection, req FeedbackRequest, query []float32) (Embedding, bool, int, error) {
+    if req.ID != "" {
+        embedding, exists := collection.Store.Get(req.ID)
+        if !exists {
+            return Embedding{}, false, http.StatusNotFound, fmt.Errorf("embedding %q not found", req.ID)
+        }
+        if embedding.Project != req.Project {
+            return Embedding{}, false, http.StatusBadRequest, fmt.Errorf("embedding %q belongs to project %s, not %s", req.ID, embedding.Project, req.Project)
+        }
+        return embedding, true, 0, nil
+    }
+    embeddings, index, _ := collection.Store.Snapshot()
+    hits := index.SearchExactFiltered(query, 1, func(label int) bool {
+        return label < len(embeddings) && embeddings[label].Project == req.Project
+    })
+    if len(hits) == 0 {
+        return Embedding{}, false, 0, nil
+    }
+    return embeddings[hits[0].Label], true, 0, nil
+}
+
+// rocchio adds weight times the unit query to the unit record vector and restores the
+// record's length, so only its direction changes
+func rocchio(vector, query []float32, weight float64) []float32 {
+    var norm float64
+    for _, value := range vector {
+        norm += float64(value) * float64(value)
+    }
+    norm = math.Sqrt(norm)
+    if norm == 0 {
+        return append([]float32(nil), vector...)
+    }
+    moved := make([]float32, len(vector))
+    for i := range vector {
+        moved[i] = float32(float64(vector[i])/norm + weight*float64(query[i]))
+    }
+    if isZeroVector(moved) {
+        return append([]float32(nil), vector...)
+    }
+    normalizeFloat32(moved)
+    for i := range moved {
+        moved[i] = float32(float64(moved[i]) * norm)
+    }
+    return moved
+}
+
+func isZeroVector(vector []float32) bool {
+    for _, value := range vector {
+        if value != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// appendFeedback appends an entry to the collection's feedback log and syncs it
+func appendFeedback(collection string, entry FeedbackEntry) error {
+    path := feedbackPath(collection)
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+    }
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return fmt.Errorf("failed to marshal feedback: %v", err)
+    }
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open feedback log: %v", err)
+    }
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        file.Close()
+        return fmt.Errorf("failed to write feedback log: %v", err)
+    }
+    if err := file.Sync(); err != nil {
+        file.Close()
+        return fmt.Errorf("failed to sync feedback log: %v", err)
+    }
+    return file.Close()
+}
+
+// ReadFeedback returns a collection's feedback log in the order it was applied
+func ReadFeedback(collection string) ([]FeedbackEntry, error) {
+    file, err := os.Open(feedbackPath(collection))
+    if os.IsNotExist(err) {
+        return []FeedbackEntry{}, nil
+    } else if err != nil {
+        return nil, fmt.Errorf("failed to open feedback log: %v", err)
+    }
+    defer file.Close()
+
+    entries := []FeedbackEntry{}
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), maxFeedbackLineBytes)
+    for line := 1; scanner.Scan(); line++ {
+        var entry FeedbackEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            return nil, fmt.Errorf("invalid feedback log line %d: %v", line, err)
+        }
+        entries = append(entries, entry)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read feedback log: %v", err)
+    }
+    return entries, nil
+}
+
+// ProjectDrift shows how feedback has moved a project's vectors. Drifts are cosine
+// distances: of each adjusted record from its vector before any feedback, and of the
+// project's centroid from the centroid of its records before feedback, without the
+// examples feedback added.
+type ProjectDrift struct {
+    Project         string        `json:"project"`
+    Accepted        int           `json:"accepted"`
+    Rejected        int           `json:"rejected"`
+    Records         int           `json:"records"`
+    AdjustedRecords int           `json:"adjustedRecords"`
+    AddedExamples   int           `json:"addedExamples"`
+    MeanDrift       float64       `json:"meanDrift"`
+    MaxDrift        float64       `json:"maxDrift"`
+    CentroidDrift   float64       `json:"centroidDrift"`
+    LastFeedback    *time.Time    `json:"lastFeedback,omitempty"`
+    Adjusted        []RecordDrift `json:"adjusted,omitempty"`
+}
+
+// RecordDrift is the drift of one adjusted record
+type RecordDrift struct {
+    ID      string  `json:"id"`
+    Intent  string  `json:"intent"`
+    Updates int     `json:"updates"`
+    Drift   float64 `json:"drift"`
+}
+
+// FeedbackDrift audits the feedback applied to a collection, per project, against the
+// current records. Adjustments made with another model than a record's current one were
+// undone by re-embedding and are left out. withRecords lists the adjusted records too.
+func FeedbackDrift(collection *Collection, entries []FeedbackEntry, withRecords bool) []ProjectDrift {
+    byProject := make(map[string]*ProjectDrift)
+    project := func(name string) *ProjectDrift {
+        drift, exists := byProject[name]
+        if !exists {
+            drift = &ProjectDrift{Project: name}
+            byProject[name] = drift
+        }
+        return drift
+    }
+
+    baselines := make(map[string][]float32)
+    updates := make(map[string]int)
+    added := make(map[string]bool)
+    live := make(map[string]Embedding)
+    for _, embedding := range collection.Store.Embeddings() {
+        live[embedding.ID] = embedding
+        project(embedding.Project).Records++
+    }
+    for _, entry := range entries {
+        drift := project(entry.Project)
+        if entry.Accepted {
+            drift.Accepted++
+        } else {
+            drift.Rejected++
+        }
+        feedbackTime := entry.Time
+        drift.LastFeedback = &feedbackTime
+        adjustment := entry.Adjustment
+        if adjustment == nil {
+            continue
+        }
+        if current, exists := live[adjustment.ID]; !exists || current.Model != adjustment.Model {
+            continue
+        }
+        if entry.Action == feedbackAddedExample {
+            added[adjustment.ID] = true
+            continue
+        }
+        if _, exists := baselines[adjustment.ID]; !exists {
+            baselines[adjustment.ID] = adjustment.Before
+        }
+        updates[adjustment.ID]++
+    }
+
+    before := make(map[string][]float64)
+    after := make(map[string][]float64)
+    for _, embedding := range live {
+        drift := project(embedding.Project)
+        addToCentroid(after, embedding.Project, embedding.Vector)
+        if added[embedding.ID] {
+            drift.AddedExamples++
+            continue
+        }
+        baseline, adjusted := baselines[embedding.ID]
+        if !adjusted || len(baseline) != len(embedding.Vector) {
+            addToCentroid(before, embedding.Project, embedding.Vector)
+            continue
+        }
+        addToCentroid(before, embedding.Project, baseline)
+        distance := 1 - cosineFloat32(baseline, embedding.Vector)
+        drift.AdjustedRecords++
+        drift.MeanDrift += distance
+        if distance > drift.MaxDrift {
+            drift.MaxDrift = distance
+        }
+        if withRecords {
+            drift.Adjusted = append(drift.Adjusted, RecordDrift{ID: embedding.ID, Intent: embedding.Intent, Updates: updates[embedding.ID], Drift: distance})
+        }
+    }
+
+    drifts := make([]ProjectDrift, 0, len(byProject))
+    for name, drift := range byProject {
+        if drift.AdjustedRecords > 0 {
+            drift.MeanDrift /= float64(drift.AdjustedRecords)
+        }
+        if b, a := before[name], after[name]; b != nil && a != nil && drift.AdjustedRecords+drift.AddedExamples > 0 {
+            drift.CentroidDrift = 1 - cosineFloat32(toFloat32(b), toFloat32(a))
+        }
+        sort.Slice(drift.Adjusted, func(i, j int) bool { return drift.Adjusted[i].Drift > drift.Adjusted[j].Drift })
+        drifts = append(drifts, *drift)
+    }
+    sort.Slice(drifts, func(i, j int) bool { return drifts[i].Project < drifts[j].Project })
+    return drifts
+}
+
+// addToCentroid adds a unit copy of the vector to the project's running sum; the sum
+// points the same way as the centroid, which is all the cosine distance needs
+func addToCentroid(sums map[string][]float64, project string, vector []float32) {
+    sum, exists := sums[project]
+    if !exists {
+        sum = make([]float64, len(vector))
+        sums[project] = sum
+    }
+    if len(sum) != len(vector) {
+        return
+    }
+    unit := normalizeFloat32(append([]float32(nil), vector...))
+    for i, value := range unit {
+        sum[i] += float64(value)
+    }
+}
+
+// FeedbackHandler records whether mapping an intent to a project was right, from
+// {"intent", "project", "accepted", "id"}, and adjusts the collection to learn from it
+func FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+    var req FeedbackRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if req.Intent == "" || req.Project == "" || req.Accepted == nil {
+        http.Error(w, "'intent', 'project' and 'accepted' are required", http.StatusBadRequest)
+        return
+    }
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    log.Printf("Handling feedback on mapping '%s' to %s in collection %s", req.Intent, req.Project, collection.Config.Name)
+    if err := collection.CheckEmbedder(); err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    if status := collections.Migration(collection.Config.Name); status != nil && status.State == migrationRunning {
+        http.Error(w, fmt.Sprintf("Collection %q is being re-embedded; send feedback once it is done", collection.Config.Name), http.StatusConflict)
+        return
+    }
+
+    entry, status, err := ApplyFeedback(collection, req)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error applying feedback: %v", err), status)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(entry)
+}
+
+// ListFeedbackHandler returns the latest entries of a collection's feedback log, oldest
+// first; limit defaults to 100
+func ListFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    limit := 100
+    if raw := r.URL.Query().Get("limit"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 {
+            http.Error(w, "Invalid 'limit' parameter: must be a positive integer", http.StatusBadRequest)
+            return
+        }
+        limit = parsed
+    }
+    entries, err := ReadFeedback(collection.Config.Name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error reading feedback: %v", err), http.StatusInternalServerError)
+        return
+    }
+    if len(entries) > limit {
+        entries = entries[len(entries)-limit:]
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entries)
+}
+
+// FeedbackDriftHandler audits how feedback has moved each project's vectors. project=
+// restricts the audit to one project and lists its adjusted records.
+func FeedbackDriftHandler(w http.ResponseWriter, r *http.Request) {
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    entries, err := ReadFeedback(collection.Config.Name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error reading feedback: %v", err), http.StatusInternalServerError)
+        return
+    }
+    project := r.URL.Query().Get("project")
+    drifts := FeedbackDrift(collection, entries, project != "")
+    if project != "" {
+        filtered := []ProjectDrift{}
+        for _, drift := range drifts {
+            if drift.Project == project {
+                filtered = append(filtered, drift)
+            }
+        }
+        drifts = filtered
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(drifts)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "io/ioutil"
+    "math"
+    "path/filepath"
+    "testing"
+)
+
+// staticEmbedder embeds each text to a fixed vector
+type staticEmbedder map[string][]float64
+
+func (e staticEmbedder) Name() string { return "static" }
+
+func (e staticEmbedder) Embed(texts []string) ([][]float64, error) {
+    vectors := make([][]float64, len(texts))
+    for i, text := range texts {
+        vectors[i] = e[text]
+    }
+    return vectors, nil
+}
+
+func vectorNorm(vector []float32) float64 {
+    var sum float64
+    for _, value := range vector {
+        sum += float64(value) * float64(value)
+    }
+    return math.Sqrt(sum)
+}
+
+func TestRocchioKeepsNormAndMovesDirection(t *testing.T) {
+    vector := []float32{2, 0, 0}
+    query := []float32{0, 1, 0}
+
+    toward := rocchio(vector, query, 0.2)
+    away := rocchio(vector, query, -0.1)
+    for _, moved := range [][]float32{toward, away} {
+        if norm := vectorNorm(moved); math.Abs(norm-2) > 1e-5 {
+            t.Errorf("rocchio changed the norm to %v, want 2", norm)
+        }
+    }
+    before := cosineFloat32(vector, query)
+    if after := cosineFloat32(toward, query); after <= before {
+        t.Errorf("moving toward the query left cosine %v, was %v", after, before)
+    }
+    if after := cosineFloat32(away, query); after >= before {
+        t.Errorf("moving away from the query left cosine %v, was %v", after, before)
+    }
+    if vector[1] != 0 {
+        t.Error("rocchio modified its input")
+    }
+    if moved := rocchio([]float32{0, 0, 0}, query, 0.2); !isZeroVector(moved) {
+        t.Errorf("a zero vector moved to %v", moved)
+    }
+}
+
+func TestApplyFeedbackAndDrift(t *testing.T) {
+    t.Setenv("FEEDBACK_PATH", t.TempDir())
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    store.Put(Embedding{ID: "a", Intent: "scrape news", Project: "scraper", Model: "static", Vector: []float32{1, 0, 0}})
+    store.Put(Embedding{ID: "b", Intent: "check rates", Project: "bank", Model: "static", Vector: []float32{0, 0, 1}})
+    collection := &Collection{
+        Config: CollectionConfig{Name: "feedback-test", Metric: metricCosine},
+        Store:  store,
+        Embedder: staticEmbedder{
+            "fetch headlines": {0.95, 0.3, 0},
+            "crawl forums":    {0, 1, 0},
+            "bank news":       {0.9, 0, 0.4},
+        },
+    }
+    accepted, rejected := true, false
+    apply := func(intent, project string, ok *bool) FeedbackEntry {
+        t.Helper()
+        entry, _, err := ApplyFeedback(collection, FeedbackRequest{Intent: intent, Project: project, Accepted: ok})
+        if err != nil {
+            t.Fatalf("feedback on %q: %v", intent, err)
+        }
+        return entry
+    }
+
+    if entry := apply("fetch headlines", "scraper", &accepted); entry.Action != feedbackMovedToward {
+        t.Errorf("a similar accepted query was %s, want %s", entry.Action, feedbackMovedToward)
+    }
+    if entry := apply("crawl forums", "scraper", &accepted); entry.Action != feedbackAddedExample {
+        t.Errorf("a dissimilar accepted query was %s, want %s", entry.Action, feedbackAddedExample)
+    }
+    if entry := apply("bank news", "scraper", &rejected); entry.Action != feedbackMovedAway {
+        t.Errorf("a rejected query was %s, want %s", entry.Action, feedbackMovedAway)
+    }
+    if got := len(store.Embeddings()); got != 3 {
+        t.Errorf("store holds %d records, want the added example too", got)
+    }
+
+    entries, err := ReadFeedback(collection.Config.Name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 3 {
+        t.Fatalf("read %d feedback entries, want 3", len(entries))
+    }
+    drifts := FeedbackDrift(collection, entries, true)
+    if len(drifts) != 2 || drifts[1].Project != "scraper" {
+        t.Fatalf("drift covers %v, want bank and scraper", drifts)
+    }
+    scraper := drifts[1]
+    if scraper.Accepted != 2 || scraper.Rejected != 1 || scraper.AdjustedRecords != 1 || scraper.AddedExamples != 1 {
+        t.Errorf("scraper drift = %+v", scraper)
+    }
+    if len(scraper.Adjusted) != 1 || scraper.Adjusted[0].ID != "a" || scraper.Adjusted[0].Updates != 2 || scraper.Adjusted[0].Drift <= 0 {
+        t.Errorf("scraper adjusted records = %+v", scraper.Adjusted)
+    }
+    if drifts[0].AdjustedRecords != 0 || drifts[0].CentroidDrift != 0 {
+        t.Errorf("bank drifted without feedback: %+v", drifts[0])
+    }
+}
+
+func TestApplyFeedbackUndoneWhenLogFails(t *testing.T) {
+    // A regular file where the log directory should be makes every append fail
+    blocked := filepath.Join(t.TempDir(), "feedback")
+    if err := ioutil.WriteFile(blocked, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("FEEDBACK_PATH", filepath.Join(blocked, "logs"))
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    store.Put(Embedding{ID: "a", Intent: "scrape news", Project: "scraper", Model: "static", Vector: []float32{1, 0, 0}})
+    collection := &Collection{
+        Config: CollectionConfig{Name: "feedback-test", Metric: metricCosine},
+        Store:  store,
+        Embedder: staticEmbedder{
+            "fetch headlines": {0.95, 0.3, 0},
+            "crawl forums":    {0, 1, 0},
+        },
+    }
+
+    accepted := true
+    for _, intent := range []string{"fetch headlines", "crawl forums"} {
+        if _, _, err := ApplyFeedback(collection, FeedbackRequest{Intent: intent, Project: "scraper", Accepted: &accepted}); err == nil {
+            t.Fatalf("feedback on %q succeeded without a log", intent)
+        }
+    }
+    records := store.Embeddings()
+    if len(records) != 1 || records[0].Vector[0] != 1 || records[0].Vector[1] != 0 {
+        t.Errorf("store holds %+v, want record a unchanged and no added example", records)
+    }
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// Metadata holds arbitrary key/value pairs on an embedding. Values are strings, numbers,
+// booleans or lists of those; a list matches a condition when any of its elements does.
+type Metadata map[string]interface{}
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateMetadata rejects keys the filter syntax cannot name and nested values
+func validateMetadata(metadata Metadata) error {
+    for key, value := range metadata {
+        if !metadataKeyPattern.MatchString(key) {
+            return fmt.Errorf("metadata key %q may only contain letters, digits, '_', '.' and '-'", key)
+        }
+        if list, ok := value.([]interface{}); ok {
+            for _, element := range list {
+                if !isScalar(element) {
+                    return fmt.Errorf("metadata %q: list elements must be strings, numbers or booleans", key)
+                }
+            }
+        } else if !isScalar(value) {
+            return fmt.Errorf("metadata %q must be a string, number, boolean or a list of those", key)
+        }
+    }
+    return nil
+}
+
+func isScalar(value interface{}) bool {
+    switch value.(type) {
+    case string, float64, bool:
+        return true
+    }
+    return false
+}
+
+// metadataValues returns the values of a field as strings. The built-in fields id, intent
+// and project are used when the metadata has no key of that name.
+func metadataValues(embedding *Embedding, key string) []string {
+    value, exists := embedding.Metadata[key]
+    if !exists {
+        switch key {
+        case "id":
+            return []string{embedding.ID}
+        case "intent":
+            return []string{embedding.Intent}
+        case "project":
+            return []string{embedding.Project}
+        }
+        return nil
+    }
+    if list, ok := value.([]interface{}); ok {
+        values := make([]string, 0, len(list))
+        for _, element := range list {
+            values = append(values, scalarString(element))
+        }
+        return values
+    }
+    return []string{scalarString(value)}
+}
+
+func scalarString(value interface{}) string {
+    switch v := value.(type) {
+    case string:
+        return v
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64)
+    case bool:
+        return strconv.FormatBool(v)
+    }
+    return fmt.Sprint(value)
+}
+
+// Filter is a parsed filter expression such as
+//
+//    language = go AND tag IN (scraper, crawler) AND NOT archived = true
+//
+// Conditions compare a field with =, !=, <, <=, > or >=, test membership with IN and
+// NOT IN, or test presence with EXISTS. They combine with AND, OR, NOT and parentheses.
+// Keywords are case-insensitive; values are bare words or quoted strings. Ordering
+// comparisons are numeric when both sides are numbers and lexical otherwise, which
+// orders RFC 3339 timestamps correctly.
+type Filter struct {
+    expr string
+    root filterNode
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+    return f.expr
+}
+
+// Match reports whether the embedding satisfies the filter; a nil filter matches everything
+func (f *Filter) Match(embedding *Embedding) bool {
+    return f == nil || f.root.match(embedding)
+}
+
+type filterNode interface {
+    match(embedding *Embedding) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ operand filterNode }
+
+func (n filterAnd) match(e *Embedding) bool { return n.left.match(e) && n.right.match(e) }
+func (n filterOr) match(e *Embedding) bool  { return n.left.match(e) || n.right.match(e) }
+func (n filterNot) match(e *Embedding) bool { return !n.operand.match(e) }
+
+// filterCondition tests one field. Negative operators (!= and NOT IN) hold when no value
+// of the field matches, so a missing field satisfies them.
+type filterCondition struct {
+    key    string
+    op     string
+    values []string
+}
+
+func (c filterCondition) match(e *Embedding) bool {
+    fieldValues := metadataValues(e, c.key)
+    switch c.op {
+    case "EXISTS":
+        return len(fieldValues) > 0
+    case "!=", "NOT IN":
+        for _, value := range fieldValues {
+            if containsString(c.values, value) {
+                return false
+            }
+        }
+        return true
+    }
+    for _, value := range fieldValues {
+        switch c.op {
+        case "=", "IN":
+            if containsString(c.values, value) {
+                return true
+            }
+        default:
+            if compareOrdered(value, c.values[0], c.op) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func containsString(values []string, value string) bool {
+    for _, candidate := range values {
+        if candidate == value {
+            return true
+        }
+    }
+    return false
+}
+
+// compareOrdered applies <, <=, > or >= numerically when both sides parse as numbers
+func compareOrdered(a, b, op string) bool {
+    cmp := strings.Compare(a, b)
+    if x, err := strconv.ParseFloat(a, 64); err == nil {
+        if y, err := strconv.ParseFloat(b, 64); err == nil {
+            switch {
+            case x < y:
+                cmp = -1
+            case x > y:
+                cmp = 1
+            default:
+                cmp = 0
+            }
+        }
+    }
+    switch op {
+    case "<":
+        return cmp < 0
+    case "<=":
+        return cmp <= 0
+    case ">":
+        return cmp > 0
+    case ">=":
+        return cmp >= 0
+    }
+    return false
+}
+
+// ParseFilter parses a filter expression; an empty expression yields a nil filter
+func ParseFilter(expr string) (*Filter, error) {
+    if strings.TrimSpace(expr) == "" {
+        return nil, nil
+    }
+    tokens, err := tokenizeFilter(expr)
+    if err != nil {
+        return nil, err
+    }
+    p := &filterParser{tokens: tokens}
+    root, err := p.parseOr()
+    if err != nil {
+        return nil, err
+    }
+    if p.pos < len(p.tokens) {
+        return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+    }
+    return &Filter{expr: expr, root: root}, nil
+}
+
+type filterToken struct {
+    text   string
+    quoted bool
+}
+
+// tokenizeFilter splits an expression into words, quoted strings, operators and punctuation
+func tokenizeFilter(expr string) ([]filterToken, error) {
+    var tokens []filterToken
+    runes := []rune(expr)
+    for i := 0; i < len(runes); {
+        r := runes[i]
+        switch {
+        case unicode.IsSpace(r):
+            i++
+        case r == '(' || r == ')' || r == ',':
+            tokens = append(tokens, filterToken{text: string(r)})
+            i++
+        case r == '=':
+            tokens = append(tokens, filterToken{text: "="})
+            i++
+        case r == '!' || r == '<' || r == '>':
+            if i+1 < len(runes) && runes[i+1] == '=' {
+                tokens = append(tokens, filterToken{text: string(runes[i : i+2])})
+                i += 2
+            } else if r == '!' {
+                return nil, fmt.Errorf("expected '=' after '!' in filter")
+            } else {
+                tokens = append(tokens, filterToken{text: string(r)})
+                i++
+            }
+        case r == '\'' || r == '"':
+            end := i + 1
+            for end < len(runes) && runes[end] != r {
+                end++
+            }
+            if end == len(runes) {
+                return nil, fmt.Errorf("unterminated string in filter")
+            }
+            tokens = append(tokens, filterToken{text: string(runes[i+1 : end]), quoted: true})
+            i = end + 1
+        default:
+            end := i
+            for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()=,!<>'\"", runes[end]) {
+                end++
+            }
+            tokens = append(tokens, filterToken{text: string(runes[i:end])})
+            i = end
+        }
+    }
+    return tokens, nil
+}
+
+type filterParser struct {
+    tokens []filterToken
+    pos    int
+}
+
+// peekKeyword reports whether the next token is the given unquoted keyword
+func (p *filterParser) peekKeyword(keyword string) bool {
+    return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *filterParser) next() (filterToken, error) {
+    if p.pos >= len(p.tokens) {
+        return filterToken{}, fmt.Errorf("unexpected end of filter")
+    }
+    p.pos++
+    return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) expect(text string) error {
+    token, err := p.next()
+    if err != nil {
+        return fmt.Errorf("expected %q at end of filter", text)
+    }
+    if token.quoted || token.text != text {
+        return fmt.Errorf("expected %q in filter, got %q", text, token.text)
+    }
+    return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+    left, err := p.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    for p.peekKeyword("OR") {
+        p.pos++
+        right, err := p.parseAnd()
+        if err != nil {
+            return nil, err
+        }
+        left = filterOr{left, right}
+    }
+    return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+    left, err := p.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    for p.peekKeyword("AND") {
+        p.pos++
+        right, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        left = filterAnd{left, right}
+    }
+    return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+    if p.peekKeyword("NOT") {
+        p.pos++
+        operand, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return filterNot{operand}, nil
+    }
+    if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == "(" {
+        p.pos++
+        node, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        if err := p.expect(")"); err != nil {
+            return nil, err
+        }
+        return node, nil
+    }
+    return p.parseCondition()
+}
+
+func (p *filterParser) parseCondition() (filterNode, error) {
+    key, err := p.next()
+    if err != nil {
+        return nil, err
+    }
+    if key.quoted || !metadataKeyPattern.MatchString(key.text) {
+        return nil, fmt.Errorf("expected a field name in filter, got %q", key.text)
+    }
+
+    switch {
+    case p.peekKeyword("EXISTS"):
+        p.pos++
+        return filterCondition{key: key.text, op: "EXISTS"}, nil
+    case p.peekKeyword("IN"):
+        p.pos++
+        values, err := p.parseList()
+        return filterCondition{key: key.text, op: "IN", values: values}, err
+    case p.peekKeyword("NOT"):
+        p.pos++
+        if !p.peekKeyword("IN") {
+            return nil, fmt.Errorf("expected IN after %s NOT in filter", key.text)
+        }
+        p.pos++
+        values, err := p.parseList()
+        return filterCondition{key: key.text, op: "NOT IN", values: values}, err
+    }
+
+    op, err := p.next()
+    if err != nil {
+        return nil, fmt.Errorf("expected an operator after %s in filter", key.text)
+    }
+    switch op.text {
+    case "=", "!=", "<", "<=", ">", ">=":
+    default:
+        return nil, fmt.Errorf("unknown operator %q in filter", op.text)
+    }
+    value, err := p.parseValue()
+    if err != nil {
+        return nil, err
+    }
+    return filterCondition{key: key.text, op: op.text, values: []string{value}}, nil
+}
+
+func (p *filterParser) parseList() ([]string, error) {
+    if err := p.expect("("); err != nil {
+        return nil, err
+    }
+    var values []string
+    for {
+        value, err := p.parseValue()
+        if err != nil {
+            return nil, err
+        }
+        values = append(values, value)
+        token, err := p.next()
+        if err != nil {
+            return nil, fmt.Errorf("expected ')' at end of filter")
+        }
+        if token.text == ")" && !token.quoted {
+            return values, nil
+        }
+        if token.text != "," || token.quoted {
+            return nil, fmt.Errorf("expected ',' or ')' in filter, got %q", token.text)
+        }
+    }
+}
+
+func (p *filterParser) parseValue() (string, error) {
+    token, err := p.next()
+    if err != nil {
+        return "", fmt.Errorf("expected a value at end of filter")
+    }
+    if !token.quoted && strings.ContainsAny(token.text, "(),=!<>") {
+        return "", fmt.Errorf("expected a value in filter, got %q", token.text)
+    }
+    return token.text, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+    embedding := &Embedding{
+        ID:      "abc",
+        Intent:  "scrape news",
+        Project: "scraper",
+        Metadata: Metadata{
+            "language": "go",
+            "tag":      []interface{}{"scraper", "crawler"},
+            "stars":    float64(120),
+            "archived": false,
+            "updated":  "2024-05-01T10:00:00Z",
+            "owner":    "Jane Doe",
+        },
+    }
+    tests := []struct {
+        expr string
+        want bool
+    }{
+        {"language = go", true},
+        {"language != go", false},
+        {"language = rust", false},
+        {"tag = crawler", true},
+        {"tag IN (parser, scraper)", true},
+        {"tag NOT IN (parser, scraper)", false},
+        {"tag NOT IN (parser)", true},
+        {"missing != x", true},
+        {"missing EXISTS", false},
+        {"stars EXISTS", true},
+        {"stars > 99", true},
+        {"stars >= 120 AND stars <= 120", true},
+        {"stars < 20", false},
+        {"updated > \"2024-01-01\"", true},
+        {"archived = true", false},
+        {"NOT archived = true", true},
+        {"owner = \"Jane Doe\"", true},
+        {"project = scraper AND id = abc", true},
+        {"intent = 'scrape news'", true},
+        {"language = rust OR tag = crawler", true},
+        {"language = rust OR tag = parser AND stars > 1", false},
+        {"(language = rust OR tag = crawler) AND stars > 1", true},
+        {"language = go and not (stars < 100 or archived = true)", true},
+    }
+    for _, test := range tests {
+        filter, err := ParseFilter(test.expr)
+        if err != nil {
+            t.Errorf("ParseFilter(%q): %v", test.expr, err)
+            continue
+        }
+        if got := filter.Match(embedding); got != test.want {
+            t.Errorf("%q matched %v, want %v", test.expr, got, test.want)
+        }
+    }
+}
+
+func TestParseFilterErrors(t *testing.T) {
+    for _, expr := range []string{
+        "language",
+        "language ~ go",
+        "language =",
+        "tag IN (a, b",
+        "tag IN a",
+        "tag NOT go",
+        "(language = go",
+        "language = go AND",
+        "language = go extra",
+        "\"quoted\" = go",
+        "owner = \"unterminated",
+    } {
+        if _, err := ParseFilter(expr); err == nil {
+            t.Errorf("ParseFilter(%q) succeeded, want an error", expr)
+        }
+    }
+    if filter, err := ParseFilter("   "); err != nil || filter != nil {
+        t.Errorf("ParseFilter of a blank expression = %v, %v; want nil, nil", filter, err)
+    }
+    var none *Filter
+    if !none.Match(&Embedding{}) {
+        t.Error("a nil filter should match everything")
+    }
+}
+
+func TestMapIntentToProjectNoMatchReasons(t *testing.T) {
+    embedder := staticEmbedder{"scrape news": {1, 0}}
+    embeddings := []Embedding{
+        {ID: "bank", Project: "bank", Metadata: Metadata{"team": "finance"}, Vector: []float32{0, 1}},
+        {ID: "scraper", Project: "scraper", Metadata: Metadata{"team": "data"}, Vector: []float32{1, 0}},
+        {ID: "crawler", Project: "crawler", Metadata: Metadata{"team": "data"}, Vector: []float32{0.9, 0.1}},
+    }
+    index := NewHNSWIndex(HNSWConfig{Metric: metricCosine})
+    for label, embedding := range embeddings {
+        if err := index.Add(label, embedding.Vector); err != nil {
+            t.Fatal(err)
+        }
+    }
+    filter, err := ParseFilter("team = legal")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name       string
+        embeddings []Embedding
+        opts       SearchOptions
+        reason     string
+    }{
+        {"filter", embeddings, SearchOptions{K: 1, Exact: true, Filter: filter}, "match filter"},
+        {"min score", embeddings, SearchOptions{K: 1, Exact: true, MinScore: 1.5}, "below min score"},
+        // Both nearest records were indexed after the snapshot was taken
+        {"stale snapshot", embeddings[:1], SearchOptions{K: 1, Exact: true}, "changed during the query"},
+    }
+    for _, test := range tests {
+        result, err := MapIntentToProject("scrape news", embedder, test.embeddings, index, nil, test.opts)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !result.NoMatch || !strings.Contains(result.Reason, test.reason) {
+            t.Errorf("%s: no match %v, reason %q, want it to say %q", test.name, result.NoMatch, result.Reason, test.reason)
+        }
+    }
+}
@@ -6,14 +6,18 @@ import (
     "io/ioutil"
     "log"
     "net/http"
+    "net/url"
     "os"
     "os/exec"
     "path/filepath"
     "sort"
+    "strconv"
     "strings"
     "html/template"
 
     "time"
+
+    "github.com/gorilla/mux"
 )
 func LLManalysisHandler(w http.ResponseWriter, r *http.Request) {
     ollamaPrompt := "Generate a brief analysis of the current state of services and active scrapers."
@@ -123,12 +127,14 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
         Services       []ServiceStatus
         Projects       []Repo
         Scrapers       []Scraper
+        WordVectors    WordVectorStats
         OllamaResponse string
     }{
         SystemInfo:     systemInfo,
         Services:       services,
         Projects:       projects,
         Scrapers:       scrapers,
+        WordVectors:    wordVectorStats,
         OllamaResponse: ollamaResponse,
     }
 
@@ -222,24 +228,30 @@ func LoadSystemInfo() SystemInfo {
 
 //     return repos, nil
 // }
+// projectBasePaths returns the directories that hold projects, from PROJECT_PATHS or the defaults
+func projectBasePaths() ([]string, error) {
+    if pathsEnv := os.Getenv("PROJECT_PATHS"); pathsEnv != "" {
+        return strings.Split(pathsEnv, ":"), nil
+    }
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return nil, fmt.Errorf("unable to get user home directory: %w", err)
+    }
+    return []string{
+        filepath.Join(homeDir, "Projects"),
+        filepath.Join(homeDir, "ClojureProjects"),
+        filepath.Join(homeDir, "tinystatus"),
+        filepath.Join(homeDir, "NovProjects"), // Additional paths if needed
+    }, nil
+}
+
 func GetRecentlyModifiedProjects() ([]Repo, error) {
     var repos []Repo
 
     // Determine the base paths for scanning
-    basePaths := []string{}
-    if pathsEnv := os.Getenv("PROJECT_PATHS"); pathsEnv != "" {
-        basePaths = strings.Split(pathsEnv, ":")
-    } else {
-        homeDir, err := os.UserHomeDir()
-        if err != nil {
-            return nil, fmt.Errorf("unable to get user home directory: %w", err)
-        }
-        basePaths = []string{
-            filepath.Join(homeDir, "Projects"),
-            filepath.Join(homeDir, "ClojureProjects"),
-            filepath.Join(homeDir, "tinystatus"),
-            filepath.Join(homeDir, "NovProjects"), // Additional paths if needed
-        }
+    basePaths, err := projectBasePaths()
+    if err != nil {
+        return nil, err
     }
 
     seen := make(map[string]bool)
@@ -341,33 +353,446 @@ func ListReposHandler(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(repos)
 }
 
-// MapIntentHandler maps user intents to the most relevant project using embeddings
+// MapIntentHandler maps user intents to the most relevant projects using embeddings.
+// Optional query parameters: collection (default intents), k (number of candidates,
+// default 5), min_score and extract (rules, auto, llm or none) for the matched project's
+// parameters.
 func MapIntentHandler(w http.ResponseWriter, r *http.Request) {
     log.Println("Handling request to map user intent")
-    intent := r.URL.Query().Get("intent")
+    query := r.URL.Query()
+    intent := query.Get("intent")
     if intent == "" {
         http.Error(w, "Missing 'intent' parameter", http.StatusBadRequest)
         return
     }
 
-    embeddingsData, err := LoadEmbeddings("data/embeddings.json")
+    opts, err := parseSearchOptions(query)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    rerankMode := query.Get("rerank")
+    if rerankMode != "" && rerankMode != rerankLLM && rerankMode != rerankAuto {
+        http.Error(w, fmt.Sprintf("Invalid 'rerank' parameter: must be %s or %s", rerankLLM, rerankAuto), http.StatusBadRequest)
+        return
+    }
+    extractMode, err := parseExtractMode(query.Get("extract"))
     if err != nil {
-        http.Error(w, fmt.Sprintf("Error loading embeddings: %v", err), http.StatusInternalServerError)
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if err := collection.CheckEmbedder(); err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
         return
     }
+    opts.Thresholds = collection.Config.Thresholds
 
-    bestMatch, similarity := MapIntentToProject(intent, embeddingsData)
+    embeddings, index, lexical := collection.Store.Snapshot()
+    match, err := MapIntentToProject(intent, collection.Embedder, embeddings, index, lexical, opts)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error embedding intent: %v", err), http.StatusBadGateway)
+        return
+    }
+    vectorCandidates := match.Candidates
+    var rerank *LLMRerank
+    if rerankMode != "" && !match.NoMatch {
+        if rerankMode == rerankAuto && !rerankNeeded(match, collection.Config.Thresholds) {
+            rerank = &LLMRerank{Reason: "top candidates are not ambiguous"}
+        } else {
+            candidates, outcome := RerankWithLLM(intent, match.Candidates)
+            match.Candidates = candidates
+            rerank = &outcome
+            if outcome.Applied {
+                resolveAmbiguity(&match)
+            }
+        }
+    }
     result := map[string]interface{}{
-        "Intent":        intent,
-        "MatchedProject": bestMatch.Project,
-        "Params":         bestMatch.Params,
-        "Similarity":     similarity,
+        "Intent":     intent,
+        "Collection": collection.Config.Name,
+        "Candidates": match.Candidates,
+        "Margin":     match.Margin,
+        "OOVRate":    match.Coverage.OOVRate,
+        "Coverage":   match.Coverage,
+        "NoMatch":    match.NoMatch,
+        "Abstained":  match.Abstained,
+    }
+    if stats := index.QuantizationStats(); stats.Mode != quantizationNone {
+        result["Quantization"] = stats
+    }
+    if rerank != nil {
+        result["Rerank"] = rerank
+        result["VectorCandidates"] = vectorCandidates
+    }
+    if match.NoMatch {
+        result["Reason"] = match.Reason
+    } else if match.Abstained {
+        result["AbstainReasons"] = match.AbstainReasons
+    } else {
+        result["MatchedProject"] = match.Candidates[0].Project
+        result["Params"] = match.Candidates[0].Params
+        result["Similarity"] = match.Candidates[0].Similarity
+        if extractMode != extractNone {
+            schema, err := LoadParamSchema(match.Candidates[0].Project)
+            if err == nil {
+                result["Arguments"] = ExtractParams(match.Candidates[0].Project, schema, intent, extractMode)
+            } else if err != errSchemaNotFound {
+                log.Printf("Skipping parameter extraction: %v", err)
+            }
+        }
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(result)
 }
 
+// collectionFromRequest looks up the collection named by the collection query parameter,
+// the intent catalog by default. It writes a 404 and returns false when there is none.
+func collectionFromRequest(w http.ResponseWriter, r *http.Request) (*Collection, bool) {
+    name := r.URL.Query().Get("collection")
+    collection, err := collections.Get(name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return nil, false
+    }
+    return collection, true
+}
+
+// EmbeddingStoreStatusHandler reports how many embeddings are loaded and the last load error, if any
+func EmbeddingStoreStatusHandler(w http.ResponseWriter, r *http.Request) {
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(collection.Store.Status())
+}
+
+// ReloadEmbeddingsHandler reloads a collection's embeddings from disk on demand
+func ReloadEmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+    log.Println("Handling request to reload embeddings")
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    err := collection.Store.Reload()
+    status := collection.Store.Status()
+
+    w.Header().Set("Content-Type", "application/json")
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    json.NewEncoder(w).Encode(status)
+}
+
+// parseSearchOptions reads the k, min_score, exact, ef, filter, mode, rrf_k, mmr,
+// mmr_lambda, max_per_project and abstain query parameters shared by the search endpoints
+func parseSearchOptions(query url.Values) (SearchOptions, error) {
+    opts := SearchOptions{K: defaultTopK, MinScore: -1, Mode: searchVector, Abstain: true}
+    if raw := query.Get("k"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 || parsed > maxTopK {
+            return opts, fmt.Errorf("Invalid 'k' parameter: must be an integer between 1 and %d", maxTopK)
+        }
+        opts.K = parsed
+    }
+
+    if raw := query.Get("min_score"); raw != "" {
+        parsed, err := strconv.ParseFloat(raw, 64)
+        if err != nil {
+            return opts, fmt.Errorf("Invalid 'min_score' parameter: %v", err)
+        }
+        opts.MinScore = parsed
+    }
+
+    if raw := query.Get("exact"); raw != "" {
+        parsed, err := strconv.ParseBool(raw)
+        if err != nil {
+            return opts, fmt.Errorf("Invalid 'exact' parameter: %v", err)
+        }
+        opts.Exact = parsed
+    }
+
+    if raw := query.Get("ef"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 {
+            return opts, fmt.Errorf("Invalid 'ef' parameter: must be a positive integer")
+        }
+        opts.Ef = parsed
+    }
+
+    if raw := query.Get("mode"); raw != "" {
+        if raw != searchVector && raw != searchHybrid {
+            return opts, fmt.Errorf("Invalid 'mode' parameter: must be %s or %s", searchVector, searchHybrid)
+        }
+        opts.Mode = raw
+    }
+
+    if raw := query.Get("rrf_k"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 {
+            return opts, fmt.Errorf("Invalid 'rrf_k' parameter: must be a positive integer")
+        }
+        opts.RRFK = parsed
+    }
+
+    opts.MMRLambda = defaultMMRLambda
+    if raw := query.Get("mmr"); raw != "" {
+        parsed, err := strconv.ParseBool(raw)
+        if err != nil {
+            return opts, fmt.Errorf("Invalid 'mmr' parameter: %v", err)
+        }
+        opts.MMR = parsed
+    }
+
+    if raw := query.Get("mmr_lambda"); raw != "" {
+        parsed, err := strconv.ParseFloat(raw, 64)
+        if err != nil || parsed < 0 || parsed > 1 {
+            return opts, fmt.Errorf("Invalid 'mmr_lambda' parameter: must be between 0 and 1")
+        }
+        opts.MMR = true
+        opts.MMRLambda = parsed
+    }
+
+    if raw := query.Get("max_per_project"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 {
+            return opts, fmt.Errorf("Invalid 'max_per_project' parameter: must be a positive integer")
+        }
+        opts.MaxPerProject = parsed
+    }
+
+    if raw := query.Get("abstain"); raw != "" {
+        parsed, err := strconv.ParseBool(raw)
+        if err != nil {
+            return opts, fmt.Errorf("Invalid 'abstain' parameter: %v", err)
+        }
+        opts.Abstain = parsed
+    }
+
+    filter, err := ParseFilter(query.Get("filter"))
+    if err != nil {
+        return opts, fmt.Errorf("Invalid 'filter' parameter: %v", err)
+    }
+    opts.Filter = filter
+    return opts, nil
+}
+
+// Recall queries measured by IndexStatsHandler. Each one is an exact search over the whole
+// collection, so larger samples are clamped.
+const (
+    defaultRecallSamples = 100
+    maxRecallSamples     = 1000
+)
+
+// IndexStatsHandler reports the HNSW parameters and the recall of the approximate search
+// against brute force, measured with queries sampled from the stored vectors
+func IndexStatsHandler(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    sample := defaultRecallSamples
+    if raw := query.Get("sample"); raw != "" {
+        parsed, err := strconv.Atoi(raw)
+        if err != nil || parsed < 1 {
+            http.Error(w, "Invalid 'sample' parameter: must be a positive integer", http.StatusBadRequest)
+            return
+        }
+        sample = parsed
+        if sample > maxRecallSamples {
+            sample = maxRecallSamples
+        }
+    }
+    opts, err := parseSearchOptions(query)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if query.Get("k") == "" {
+        opts.K = 10
+    }
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    _, index, _ := collection.Store.Snapshot()
+    queries := index.SampleQueries(sample)
+    start := time.Now()
+    recall := index.MeasureRecall(queries, opts.K, opts.Ef)
+
+    result := map[string]interface{}{
+        "collection":   collection.Config.Name,
+        "items":        index.Len(),
+        "dimension":    index.Dimension(),
+        "config":       index.Config(),
+        "k":            opts.K,
+        "ef":           opts.Ef,
+        "queries":      len(queries),
+        "recall":       recall,
+        "elapsed":      time.Since(start).String(),
+        "quantization": index.QuantizationStats(),
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// ListEmbeddingsHandler lists the stored embeddings, optionally for one project or those
+// matching a filter expression. Vectors are left out unless vectors=true.
+func ListEmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    project := r.URL.Query().Get("project")
+    withVectors, _ := strconv.ParseBool(r.URL.Query().Get("vectors"))
+    filter, err := ParseFilter(r.URL.Query().Get("filter"))
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Invalid 'filter' parameter: %v", err), http.StatusBadRequest)
+        return
+    }
+
+    embeddings := []Embedding{}
+    for _, embedding := range collection.Store.Embeddings() {
+        if (project != "" && embedding.Project != project) || !filter.Match(&embedding) {
+            continue
+        }
+        if !withVectors {
+            embedding.Vector = nil
+        }
+        embeddings = append(embeddings, embedding)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(embeddings)
+}
+
+// GetEmbeddingHandler returns one embedding by ID
+func GetEmbeddingHandler(w http.ResponseWriter, r *http.Request) {
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    id := mux.Vars(r)["id"]
+    embedding, exists := collection.Store.Get(id)
+    if !exists {
+        http.Error(w, fmt.Sprintf("Embedding %q not found", id), http.StatusNotFound)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(embedding)
+}
+
+// CreateEmbeddingHandler adds an embedding and persists it
+func CreateEmbeddingHandler(w http.ResponseWriter, r *http.Request) {
+    log.Println("Handling request to create an embedding")
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    embedding, status, err := embeddingFromRequest(r, collection, "")
+    if err != nil {
+        http.Error(w, err.Error(), status)
+        return
+    }
+    saveEmbedding(w, collection, embedding)
+}
+
+// UpdateEmbeddingHandler replaces an existing embedding and persists it
+func UpdateEmbeddingHandler(w http.ResponseWriter, r *http.Request) {
+    id := mux.Vars(r)["id"]
+    log.Printf("Handling request to update embedding %s", id)
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if _, exists := collection.Store.Get(id); !exists {
+        http.Error(w, fmt.Sprintf("Embedding %q not found", id), http.StatusNotFound)
+        return
+    }
+    embedding, status, err := embeddingFromRequest(r, collection, id)
+    if err != nil {
+        http.Error(w, err.Error(), status)
+        return
+    }
+    saveEmbedding(w, collection, embedding)
+}
+
+// DeleteEmbeddingHandler removes an embedding and persists the change
+func DeleteEmbeddingHandler(w http.ResponseWriter, r *http.Request) {
+    id := mux.Vars(r)["id"]
+    log.Printf("Handling request to delete embedding %s", id)
+    collection, ok := collectionFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := collection.Store.Delete(id); err == errEmbeddingNotFound {
+        http.Error(w, fmt.Sprintf("Embedding %q not found", id), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, fmt.Sprintf("Error deleting embedding: %v", err), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// embeddingFromRequest decodes an EmbeddingRequest and embeds its text with the collection's
+// embedder when no vector is given. It returns the HTTP status to use on error.
+func embeddingFromRequest(r *http.Request, collection *Collection, id string) (Embedding, int, error) {
+    var req EmbeddingRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        return Embedding{}, http.StatusBadRequest, fmt.Errorf("Invalid request body: %v", err)
+    }
+    if req.Intent == "" || req.Project == "" {
+        return Embedding{}, http.StatusBadRequest, fmt.Errorf("'intent' and 'project' are required")
+    }
+
+    if err := validateMetadata(req.Metadata); err != nil {
+        return Embedding{}, http.StatusBadRequest, fmt.Errorf("Invalid metadata: %v", err)
+    }
+
+    embedding := Embedding{ID: id, Intent: req.Intent, Project: req.Project, Params: req.Params, Metadata: req.Metadata, Model: req.Model, Text: req.Text, Vector: req.Vector}
+    if embedding.Text == embedding.Intent {
+        embedding.Text = ""
+    }
+    if len(embedding.Vector) == 0 || embedding.Model == "" {
+        embedding.Model = collection.Embedder.Name()
+    }
+    if len(embedding.Vector) == 0 {
+        vectors, err := collection.Embedder.Embed([]string{embedding.SourceText()})
+        if err != nil {
+            return Embedding{}, http.StatusBadGateway, fmt.Errorf("Error embedding text with %s: %v", collection.Embedder.Name(), err)
+        }
+        embedding.Vector = toFloat32(vectors[0])
+    }
+    if dimension := collection.Store.Dimension(); dimension != 0 && len(embedding.Vector) != dimension {
+        return Embedding{}, http.StatusBadRequest, fmt.Errorf("Vector has dimension %d, collection %s has %d", len(embedding.Vector), collection.Config.Name, dimension)
+    }
+    if model := collection.Store.Model(); model != "" && embedding.Model != model {
+        return Embedding{}, http.StatusConflict, fmt.Errorf("Vector comes from %s, collection %s holds vectors from %s", embedding.Model, collection.Config.Name, model)
+    }
+    return embedding, 0, nil
+}
+
+// saveEmbedding stores the embedding in the collection, 201 when created and 200 when replaced
+func saveEmbedding(w http.ResponseWriter, collection *Collection, embedding Embedding) {
+    saved, created, err := collection.Store.Put(embedding)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error saving embedding: %v", err), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if created {
+        w.WriteHeader(http.StatusCreated)
+    }
+    json.NewEncoder(w).Encode(saved)
+}
+
 // RepoDetailsHandler provides detailed information about a specific repository
 func RepoDetailsHandler(w http.ResponseWriter, r *http.Request) {
     log.Println("Handling request for repo details")
@@ -421,7 +846,6 @@ func ListWorkingDirs(basePaths []string) ([]Repo, error) {
     return repos, nil
 }
 
-
 // GetRepoDetails retrieves detailed information about a specific repository
 func GetRepoDetails(basePath, repoName string) (map[string]string, error) {
     repoPath := filepath.Join(basePath, repoName)
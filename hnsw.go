@@ -0,0 +1,612 @@
+package main
+
+import (
+    "container/heap"
+    "fmt"
+    "math"
+    "math/rand"
+    "sort"
+    "sync"
+    "time"
+)
+
+// HNSWConfig holds the recall/speed trade-offs of the index.
+// M is the number of links per node (twice that on the bottom layer), EfConstruction the
+// candidate list size while inserting, and EfSearch the default candidate list size per query.
+// With int8 Quantization the graph is traversed with quantised vectors and the best
+// k*Oversample candidates are rescored at full precision. Metric is cosine, dot or euclidean.
+type HNSWConfig struct {
+    Metric         string `json:"metric"`
+    M              int    `json:"m"`
+    EfConstruction int    `json:"efConstruction"`
+    EfSearch       int    `json:"efSearch"`
+    Quantization   string `json:"quantization"`
+    Oversample     int    `json:"oversample"`
+}
+
+// DefaultHNSWConfig returns the index parameters, overridable with HNSW_M, HNSW_EF_CONSTRUCTION,
+// HNSW_EF_SEARCH, VECTOR_QUANTIZATION and QUANTIZATION_OVERSAMPLE
+func DefaultHNSWConfig() HNSWConfig {
+    return HNSWConfig{
+        Metric:         metricCosine,
+        M:              envInt("HNSW_M", 16),
+        EfConstruction: envInt("HNSW_EF_CONSTRUCTION", 200),
+        EfSearch:       envInt("HNSW_EF_SEARCH", 64),
+        Quantization:   envString("VECTOR_QUANTIZATION", quantizationNone),
+        Oversample:     envInt("QUANTIZATION_OVERSAMPLE", 4),
+    }
+}
+
+// HNSWIndex is a hierarchical navigable small world graph over the configured metric.
+// Items are added incrementally and identified by a caller-supplied label. Deleted items
+// stay in the graph as waypoints but are never returned.
+type HNSWIndex struct {
+    mu        sync.RWMutex
+    config    HNSWConfig
+    levelMult float64
+    rng       *rand.Rand
+    dimension int
+    nodes     []hnswNode
+    byLabel   map[int]int32
+    deleted   int
+    entry     int
+    maxLevel  int
+    quantized bool
+
+    // recall measured by MeasureQuantizationRecall
+    quantStats QuantizationStats
+}
+
+type hnswNode struct {
+    label     int
+    vector    []float32 // unit length under the cosine metric
+    codes     int8Vector
+    sqNorm    float64 // squared length, for euclidean scores from int8 codes
+    neighbors [][]int32 // links per layer, from 0 up to the node's level
+    deleted   bool
+}
+
+// hnswQuery carries the query in the representation the traversal scores with
+type hnswQuery struct {
+    vector    []float32
+    codes     int8Vector
+    sqNorm    float64
+    quantized bool
+}
+
+// SearchHit is a labelled result of an index search
+type SearchHit struct {
+    Label int
+    Score float64
+}
+
+// NewHNSWIndex creates an empty index
+func NewHNSWIndex(config HNSWConfig) *HNSWIndex {
+    if config.M < 2 {
+        config.M = 2
+    }
+    if config.EfConstruction < config.M {
+        config.EfConstruction = config.M
+    }
+    if config.EfSearch < 1 {
+        config.EfSearch = 1
+    }
+    if config.Oversample < 1 {
+        config.Oversample = 1
+    }
+    if config.Quantization == "" {
+        config.Quantization = quantizationNone
+    }
+    if config.Metric == "" {
+        config.Metric = metricCosine
+    }
+    return &HNSWIndex{
+        config:    config,
+        levelMult: 1 / math.Log(float64(config.M)),
+        rng:       rand.New(rand.NewSource(1)),
+        byLabel:   make(map[int]int32),
+        entry:     -1,
+        quantized: config.Quantization == quantizationInt8,
+    }
+}
+
+// Len returns the number of searchable items
+func (h *HNSWIndex) Len() int {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    return len(h.nodes) - h.deleted
+}
+
+// Deleted returns the number of deleted items still held in the graph
+func (h *HNSWIndex) Deleted() int {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    return h.deleted
+}
+
+// Delete removes the item with the given label from search results
+func (h *HNSWIndex) Delete(label int) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    id, exists := h.byLabel[label]
+    if !exists || h.nodes[id].deleted {
+        return false
+    }
+    h.nodes[id].deleted = true
+    h.deleted++
+    delete(h.byLabel, label)
+    return true
+}
+
+// Dimension returns the vector dimension, or 0 while the index is empty
+func (h *HNSWIndex) Dimension() int {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    return h.dimension
+}
+
+// Config returns the index parameters
+func (h *HNSWIndex) Config() HNSWConfig {
+    return h.config
+}
+
+// Add inserts a vector under the given label; under the cosine metric it must be unit length.
+// The vector is kept without copying and must not be modified afterwards. All vectors must
+// share one dimension.
+func (h *HNSWIndex) Add(label int, vector []float32) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if _, exists := h.byLabel[label]; exists {
+        return fmt.Errorf("label %d is already indexed", label)
+    }
+    if h.dimension == 0 {
+        h.dimension = len(vector)
+    } else if len(vector) != h.dimension {
+        return fmt.Errorf("vector has dimension %d, index has %d", len(vector), h.dimension)
+    }
+
+    id := int32(len(h.nodes))
+    level := h.randomLevel()
+    node := hnswNode{
+        label:     label,
+        vector:    vector,
+        neighbors: make([][]int32, level+1),
+    }
+    if h.quantized {
+        node.codes = quantizeInt8(vector)
+        node.sqNorm = dotFloat32(vector, vector)
+    }
+    h.nodes = append(h.nodes, node)
+    h.byLabel[label] = id
+    if h.entry < 0 {
+        h.entry, h.maxLevel = 0, level
+        return nil
+    }
+
+    // The graph is always built at full precision
+    query := &hnswQuery{vector: vector}
+    entry := int32(h.entry)
+    for layer := h.maxLevel; layer > level; layer-- {
+        entry = h.greedyClosest(query, entry, layer)
+    }
+
+    top := level
+    if h.maxLevel < top {
+        top = h.maxLevel
+    }
+    for layer := top; layer >= 0; layer-- {
+        candidates := h.searchLayer(query, entry, h.config.EfConstruction, layer, nil)
+        neighbors := h.selectNeighbors(candidates, h.config.M)
+        h.nodes[id].neighbors[layer] = neighbors
+        for _, neighbor := range neighbors {
+            h.link(neighbor, id, layer)
+        }
+        entry = candidates[0].id
+    }
+
+    if level > h.maxLevel {
+        h.entry, h.maxLevel = int(id), level
+    }
+    return nil
+}
+
+// Search returns up to k approximate nearest neighbours of the query, best first.
+// ef sets the candidate list size; values below k, including 0, use max(k, EfSearch).
+func (h *HNSWIndex) Search(query []float32, k, ef int) []SearchHit {
+    return h.search(query, k, ef, h.quantized, nil)
+}
+
+// SearchFiltered is Search restricted to labels passing accept. The filter is applied while
+// traversing the graph rather than to the top k afterwards, so up to k matching items are
+// returned however selective it is; very selective filters visit most of the graph.
+func (h *HNSWIndex) SearchFiltered(query []float32, k, ef int, accept func(label int) bool) []SearchHit {
+    return h.search(query, k, ef, h.quantized, accept)
+}
+
+func (h *HNSWIndex) search(query []float32, k, ef int, quantized bool, accept func(label int) bool) []SearchHit {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    if h.entry < 0 || k < 1 || len(query) != h.dimension || h.deleted == len(h.nodes) {
+        return nil
+    }
+
+    // Quantised scores only pick the candidates; the best k*Oversample are rescored below
+    keep := k
+    if quantized {
+        keep = k * h.config.Oversample
+    }
+    if ef < keep {
+        ef = h.config.EfSearch
+        if ef < keep {
+            ef = keep
+        }
+    }
+
+    q := &hnswQuery{vector: h.prepareQuery(query), quantized: quantized}
+    if quantized {
+        q.codes = quantizeInt8(q.vector)
+        q.sqNorm = dotFloat32(q.vector, q.vector)
+    }
+    entry := int32(h.entry)
+    for layer := h.maxLevel; layer > 0; layer-- {
+        entry = h.greedyClosest(q, entry, layer)
+    }
+    live := h.isLive
+    if accept != nil {
+        live = func(id int32) bool {
+            return !h.nodes[id].deleted && accept(h.nodes[id].label)
+        }
+    }
+    candidates := h.searchLayer(q, entry, ef, 0, live)
+    if len(candidates) > keep {
+        candidates = candidates[:keep]
+    }
+    if quantized {
+        for i := range candidates {
+            candidates[i].score = h.score(q.vector, h.nodes[candidates[i].id].vector)
+        }
+        sort.Slice(candidates, func(i, j int) bool {
+            return candidates[i].score > candidates[j].score
+        })
+    }
+    if len(candidates) > k {
+        candidates = candidates[:k]
+    }
+
+    hits := make([]SearchHit, len(candidates))
+    for i, candidate := range candidates {
+        hits[i] = SearchHit{Label: h.nodes[candidate.id].label, Score: h.hitScore(candidate.score)}
+    }
+    return hits
+}
+
+// SearchExact scores every item by brute force; use it to verify approximate results
+func (h *HNSWIndex) SearchExact(query []float32, k int) []SearchHit {
+    return h.SearchExactFiltered(query, k, nil)
+}
+
+// SearchExactFiltered scores every item whose label passes accept, all when accept is nil
+func (h *HNSWIndex) SearchExactFiltered(query []float32, k int, accept func(label int) bool) []SearchHit {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    if len(query) != h.dimension || k < 1 {
+        return nil
+    }
+    query = h.prepareQuery(query)
+    top := &candidateHeap{}
+    for i := range h.nodes {
+        if h.nodes[i].deleted || (accept != nil && !accept(h.nodes[i].label)) {
+            continue
+        }
+        score := h.score(query, h.nodes[i].vector)
+        if top.Len() < k {
+            heap.Push(top, hnswCandidate{int32(i), score})
+        } else if score > top.items[0].score {
+            top.items[0] = hnswCandidate{int32(i), score}
+            heap.Fix(top, 0)
+        }
+    }
+
+    hits := make([]SearchHit, top.Len())
+    for i := len(hits) - 1; i >= 0; i-- {
+        best := heap.Pop(top).(hnswCandidate)
+        hits[i] = SearchHit{Label: h.nodes[best.id].label, Score: h.hitScore(best.score)}
+    }
+    return hits
+}
+
+// ScoreLabel scores one item against the query at full precision, as a search would report
+// it. It returns false for an unknown or deleted label or a query of the wrong dimension.
+func (h *HNSWIndex) ScoreLabel(query []float32, label int) (float64, bool) {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    id, exists := h.byLabel[label]
+    if !exists || len(query) != h.dimension {
+        return 0, false
+    }
+    return h.hitScore(h.score(h.prepareQuery(query), h.nodes[id].vector)), true
+}
+
+// MeasureRecall reports the mean fraction of the exact top k found by the approximate search
+func (h *HNSWIndex) MeasureRecall(queries [][]float32, k, ef int) float64 {
+    return h.measureRecall(queries, k, ef, h.quantized)
+}
+
+func (h *HNSWIndex) measureRecall(queries [][]float32, k, ef int, quantized bool) float64 {
+    if len(queries) == 0 {
+        return 0
+    }
+    var total float64
+    for _, query := range queries {
+        exact := h.SearchExact(query, k)
+        if len(exact) == 0 {
+            total++
+            continue
+        }
+        want := make(map[int]bool, len(exact))
+        for _, hit := range exact {
+            want[hit.Label] = true
+        }
+        found := 0
+        for _, hit := range h.search(query, k, ef, quantized, nil) {
+            if want[hit.Label] {
+                found++
+            }
+        }
+        total += float64(found) / float64(len(exact))
+    }
+    return total / float64(len(queries))
+}
+
+// MeasureQuantizationRecall compares the recall of float32 and int8 traversal on sampled
+// queries and keeps the result for QuantizationStats
+func (h *HNSWIndex) MeasureQuantizationRecall(samples, k int) {
+    if !h.quantized || h.Len() == 0 {
+        return
+    }
+    queries := h.SampleQueries(samples)
+    recallFloat32 := h.measureRecall(queries, k, 0, false)
+    recallInt8 := h.measureRecall(queries, k, 0, true)
+
+    h.mu.Lock()
+    h.quantStats.RecallFloat32 = recallFloat32
+    h.quantStats.RecallInt8 = recallInt8
+    h.quantStats.RecallLoss = recallFloat32 - recallInt8
+    h.quantStats.RecallK = k
+    h.quantStats.MeasuredAt = time.Now()
+    h.mu.Unlock()
+}
+
+// QuantizationStats reports the memory held by the float32 vectors, what the int8 codes
+// add to it and the last measured recall loss
+func (h *HNSWIndex) QuantizationStats() QuantizationStats {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    stats := h.quantStats
+    stats.Mode = h.config.Quantization
+    stats.Float32Bytes = int64(len(h.nodes)) * int64(h.dimension) * 4
+    if h.quantized {
+        stats.Oversample = h.config.Oversample
+        // int8 codes plus a float32 scale and a float64 squared norm per vector
+        stats.Int8Bytes = int64(len(h.nodes)) * (int64(h.dimension) + 4 + 8)
+        stats.MemoryOverheadBytes = stats.Int8Bytes
+        stats.RecallStatus = recallNotMeasured
+        if !stats.MeasuredAt.IsZero() {
+            stats.RecallStatus = recallMeasured
+        }
+    }
+    return stats
+}
+
+// SampleQueries returns up to n recall queries, each the midpoint of two stored vectors
+// spread evenly through the index, so queries do not coincide with indexed points
+func (h *HNSWIndex) SampleQueries(n int) [][]float32 {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    if n > len(h.nodes) {
+        n = len(h.nodes)
+    }
+    queries := make([][]float32, 0, n)
+    for i := 0; i < n; i++ {
+        a := h.nodes[i*len(h.nodes)/n].vector
+        b := h.nodes[(i*len(h.nodes)/n+len(h.nodes)/2)%len(h.nodes)].vector
+        query := make([]float32, len(a))
+        for j := range query {
+            query[j] = (a[j] + b[j]) / 2
+        }
+        queries = append(queries, query)
+    }
+    return queries
+}
+
+func (h *HNSWIndex) randomLevel() int {
+    r := h.rng.Float64()
+    for r == 0 {
+        r = h.rng.Float64()
+    }
+    return int(-math.Log(r) * h.levelMult)
+}
+
+// prepareQuery copies the query, normalising it under the cosine metric
+func (h *HNSWIndex) prepareQuery(query []float32) []float32 {
+    query = append([]float32(nil), query...)
+    if h.config.Metric == metricCosine {
+        normalizeFloat32(query)
+    }
+    return query
+}
+
+// score compares two full-precision vectors; higher is closer. Euclidean scores are
+// negated squared distances while searching, see hitScore.
+func (h *HNSWIndex) score(a, b []float32) float64 {
+    if h.config.Metric == metricEuclidean {
+        return -squaredDistanceFloat32(a, b)
+    }
+    return dotFloat32(a, b)
+}
+
+// hitScore turns an internal score into the reported one: the negated distance for euclidean
+func (h *HNSWIndex) hitScore(score float64) float64 {
+    if h.config.Metric == metricEuclidean {
+        return -math.Sqrt(-score)
+    }
+    return score
+}
+
+// similarity scores a node against the query in the query's representation
+func (h *HNSWIndex) similarity(query *hnswQuery, id int32) float64 {
+    if query.quantized {
+        dot := dotInt8(query.codes, h.nodes[id].codes)
+        if h.config.Metric == metricEuclidean {
+            return 2*dot - query.sqNorm - h.nodes[id].sqNorm
+        }
+        return dot
+    }
+    return h.score(query.vector, h.nodes[id].vector)
+}
+
+// greedyClosest walks a layer towards the query until no neighbour is closer
+func (h *HNSWIndex) greedyClosest(query *hnswQuery, entry int32, layer int) int32 {
+    best := h.similarity(query, entry)
+    for changed := true; changed; {
+        changed = false
+        for _, neighbor := range h.nodes[entry].neighbors[layer] {
+            if score := h.similarity(query, neighbor); score > best {
+                best, entry, changed = score, neighbor, true
+            }
+        }
+    }
+    return entry
+}
+
+type hnswCandidate struct {
+    id    int32
+    score float64
+}
+
+// isLive accepts nodes that have not been deleted
+func (h *HNSWIndex) isLive(id int32) bool {
+    return !h.nodes[id].deleted
+}
+
+// searchLayer is the beam search of the HNSW paper; it returns up to ef candidates, best first.
+// Every node is traversed, but only nodes passing accept (all when nil) enter the results.
+func (h *HNSWIndex) searchLayer(query *hnswQuery, entry int32, ef, layer int, accept func(int32) bool) []hnswCandidate {
+    visited := map[int32]bool{entry: true}
+    first := hnswCandidate{entry, h.similarity(query, entry)}
+    candidates := &candidateHeap{items: []hnswCandidate{first}, best: true}
+    results := &candidateHeap{}
+    if accept == nil || accept(entry) {
+        results.items = append(results.items, first)
+    }
+
+    for candidates.Len() > 0 {
+        current := heap.Pop(candidates).(hnswCandidate)
+        if results.Len() >= ef && current.score < results.items[0].score {
+            break
+        }
+        for _, neighbor := range h.nodes[current.id].neighbors[layer] {
+            if visited[neighbor] {
+                continue
+            }
+            visited[neighbor] = true
+            score := h.similarity(query, neighbor)
+            if results.Len() < ef || score > results.items[0].score {
+                heap.Push(candidates, hnswCandidate{neighbor, score})
+                if accept == nil || accept(neighbor) {
+                    heap.Push(results, hnswCandidate{neighbor, score})
+                    if results.Len() > ef {
+                        heap.Pop(results)
+                    }
+                }
+            }
+        }
+    }
+
+    sorted := results.items
+    sort.Slice(sorted, func(i, j int) bool {
+        return sorted[i].score > sorted[j].score
+    })
+    return sorted
+}
+
+// selectNeighbors applies the diversity heuristic of the HNSW paper: a candidate is kept only
+// if it is closer to the new node than to any neighbour already kept. Remaining slots are
+// filled with the best discarded candidates so sparse regions stay connected.
+func (h *HNSWIndex) selectNeighbors(candidates []hnswCandidate, m int) []int32 {
+    selected := make([]int32, 0, m)
+    var discarded []int32
+    for _, candidate := range candidates {
+        if len(selected) >= m {
+            break
+        }
+        keep := true
+        for _, chosen := range selected {
+            if h.score(h.nodes[candidate.id].vector, h.nodes[chosen].vector) > candidate.score {
+                keep = false
+                break
+            }
+        }
+        if keep {
+            selected = append(selected, candidate.id)
+        } else {
+            discarded = append(discarded, candidate.id)
+        }
+    }
+    for _, id := range discarded {
+        if len(selected) >= m {
+            break
+        }
+        selected = append(selected, id)
+    }
+    return selected
+}
+
+// link adds a back-link from node to newNode, pruning node's links when over capacity
+func (h *HNSWIndex) link(node, newNode int32, layer int) {
+    maxLinks := h.config.M
+    if layer == 0 {
+        maxLinks = 2 * h.config.M
+    }
+    neighbors := append(h.nodes[node].neighbors[layer], newNode)
+    if len(neighbors) > maxLinks {
+        base := h.nodes[node].vector
+        candidates := make([]hnswCandidate, len(neighbors))
+        for i, neighbor := range neighbors {
+            candidates[i] = hnswCandidate{neighbor, h.score(base, h.nodes[neighbor].vector)}
+        }
+        sort.Slice(candidates, func(i, j int) bool {
+            return candidates[i].score > candidates[j].score
+        })
+        neighbors = h.selectNeighbors(candidates, maxLinks)
+    }
+    h.nodes[node].neighbors[layer] = neighbors
+}
+
+// candidateHeap is a heap of candidates; best puts the highest score on top, otherwise the lowest
+type candidateHeap struct {
+    items []hnswCandidate
+    best  bool
+}
+
+func (c *candidateHeap) Len() int      { return len(c.items) }
+func (c *candidateHeap) Swap(i, j int) { c.items[i], c.items[j] = c.items[j], c.items[i] }
+func (c *candidateHeap) Less(i, j int) bool {
+    if c.best {
+        return c.items[i].score > c.items[j].score
+    }
+    return c.items[i].score < c.items[j].score
+}
+func (c *candidateHeap) Push(x interface{}) { c.items = append(c.items, x.(hnswCandidate)) }
+func (c *candidateHeap) Pop() interface{} {
+    last := c.items[len(c.items)-1]
+    c.items = c.items[:len(c.items)-1]
+    return last
+}
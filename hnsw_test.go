@@ -0,0 +1,189 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "testing"
+)
+
+const (
+    testIndexSize = 2000
+    testDimension = 32
+    testQueries   = 50
+    testK         = 10
+    minRecall     = 0.95
+)
+
+func randomVectors(rng *rand.Rand, n, dimension int, metric string) [][]float32 {
+    vectors := make([][]float32, n)
+    for i := range vectors {
+        vector := make([]float32, dimension)
+        for j := range vector {
+            vector[j] = float32(rng.NormFloat64())
+        }
+        if metric == metricCosine {
+            normalizeFloat32(vector)
+        }
+        vectors[i] = vector
+    }
+    return vectors
+}
+
+func buildTestIndex(t *testing.T, metric string) (*HNSWIndex, [][]float32) {
+    t.Helper()
+    return buildTestIndexWithConfig(t, HNSWConfig{Metric: metric, M: 16, EfConstruction: 100, EfSearch: 64})
+}
+
+func buildTestIndexWithConfig(t *testing.T, config HNSWConfig) (*HNSWIndex, [][]float32) {
+    t.Helper()
+    metric := config.Metric
+    rng := rand.New(rand.NewSource(42))
+    index := NewHNSWIndex(config)
+    for label, vector := range randomVectors(rng, testIndexSize, testDimension, metric) {
+        if err := index.Add(label, vector); err != nil {
+            t.Fatalf("Add(%d): %v", label, err)
+        }
+    }
+    return index, randomVectors(rng, testQueries, testDimension, metric)
+}
+
+// recall is the fraction of the exact hits found by the approximate search
+func recall(approximate, exact []SearchHit) float64 {
+    if len(exact) == 0 {
+        return 1
+    }
+    want := make(map[int]bool, len(exact))
+    for _, hit := range exact {
+        want[hit.Label] = true
+    }
+    found := 0
+    for _, hit := range approximate {
+        if want[hit.Label] {
+            found++
+        }
+    }
+    return float64(found) / float64(len(exact))
+}
+
+func TestHNSWRecallAgainstExactSearch(t *testing.T) {
+    for _, metric := range []string{metricCosine, metricDot, metricEuclidean} {
+        t.Run(metric, func(t *testing.T) {
+            index, queries := buildTestIndex(t, metric)
+            var total float64
+            for _, query := range queries {
+                exact := index.SearchExact(query, testK)
+                if len(exact) != testK {
+                    t.Fatalf("exact search returned %d hits, want %d", len(exact), testK)
+                }
+                for i := 1; i < len(exact); i++ {
+                    if exact[i].Score > exact[i-1].Score {
+                        t.Fatalf("exact hits are not ordered best first: %v", exact)
+                    }
+                }
+                total += recall(index.Search(query, testK, 0), exact)
+            }
+            if got := total / testQueries; got < minRecall {
+                t.Errorf("recall@%d = %.3f, want at least %.2f", testK, got, minRecall)
+            }
+        })
+    }
+}
+
+func TestHNSWFilteredRecallAgainstExactSearch(t *testing.T) {
+    accept := func(label int) bool { return label%7 == 0 }
+    for _, metric := range []string{metricCosine, metricDot, metricEuclidean} {
+        t.Run(metric, func(t *testing.T) {
+            index, queries := buildTestIndex(t, metric)
+            var total float64
+            for _, query := range queries {
+                approximate := index.SearchFiltered(query, testK, 0, accept)
+                for _, hit := range approximate {
+                    if !accept(hit.Label) {
+                        t.Fatalf("filtered search returned label %d", hit.Label)
+                    }
+                }
+                if len(approximate) != testK {
+                    t.Fatalf("filtered search returned %d hits, want %d", len(approximate), testK)
+                }
+                total += recall(approximate, index.SearchExactFiltered(query, testK, accept))
+            }
+            if got := total / testQueries; got < minRecall {
+                t.Errorf("filtered recall@%d = %.3f, want at least %.2f", testK, got, minRecall)
+            }
+        })
+    }
+}
+
+func TestHNSWDeletedItemsAreNotReturned(t *testing.T) {
+    index, queries := buildTestIndex(t, metricCosine)
+    for label := 0; label < testIndexSize; label += 2 {
+        index.Delete(label)
+    }
+    if got := index.Len(); got != testIndexSize/2 {
+        t.Fatalf("Len() = %d after deleting half, want %d", got, testIndexSize/2)
+    }
+    for _, query := range queries {
+        for _, hit := range index.Search(query, testK, 0) {
+            if hit.Label%2 == 0 {
+                t.Fatalf("search returned deleted label %d", hit.Label)
+            }
+        }
+    }
+    if got := index.MeasureRecall(queries, testK, 0); got < minRecall {
+        t.Errorf("recall@%d after deletes = %.3f, want at least %.2f", testK, got, minRecall)
+    }
+}
+
+func TestHNSWInt8RecallAgainstExactSearch(t *testing.T) {
+    for _, metric := range []string{metricCosine, metricDot, metricEuclidean} {
+        t.Run(metric, func(t *testing.T) {
+            config := HNSWConfig{Metric: metric, M: 16, EfConstruction: 100, EfSearch: 64, Quantization: quantizationInt8}
+            recallAt := make(map[int]float64)
+            for _, oversample := range []int{1, 4} {
+                config.Oversample = oversample
+                index, queries := buildTestIndexWithConfig(t, config)
+                for _, query := range queries {
+                    hits := index.Search(query, testK, 0)
+                    for _, hit := range hits {
+                        // Rescoring reports full precision scores, not the int8 estimates
+                        if score, _ := index.ScoreLabel(query, hit.Label); math.Abs(score-hit.Score) > 1e-9 {
+                            t.Fatalf("label %d scored %v, want its float32 score %v", hit.Label, hit.Score, score)
+                        }
+                    }
+                    recallAt[oversample] += recall(hits, index.SearchExact(query, testK)) / testQueries
+                }
+            }
+            if recallAt[4] < minRecall {
+                t.Errorf("int8 recall@%d = %.3f with oversampling, want at least %.2f", testK, recallAt[4], minRecall)
+            }
+            if recallAt[4] < recallAt[1] {
+                t.Errorf("rescoring 4k candidates gave recall %.3f, below %.3f without oversampling", recallAt[4], recallAt[1])
+            }
+        })
+    }
+}
+
+func TestHNSWMeasureQuantizationRecall(t *testing.T) {
+    index, _ := buildTestIndexWithConfig(t, HNSWConfig{Metric: metricCosine, M: 16, EfConstruction: 100, EfSearch: 64, Quantization: quantizationInt8, Oversample: 4})
+    if stats := index.QuantizationStats(); stats.RecallStatus != recallNotMeasured || stats.RecallLoss != 0 {
+        t.Fatalf("stats before measuring = %+v, want recall not yet measured", stats)
+    }
+
+    index.MeasureQuantizationRecall(testQueries, testK)
+    stats := index.QuantizationStats()
+    if stats.RecallStatus != recallMeasured || stats.RecallK != testK || stats.MeasuredAt.IsZero() {
+        t.Fatalf("stats after measuring = %+v, want a measurement at k=%d", stats, testK)
+    }
+    if math.Abs(stats.RecallLoss-(stats.RecallFloat32-stats.RecallInt8)) > 1e-12 {
+        t.Errorf("recall loss %v is not %v - %v", stats.RecallLoss, stats.RecallFloat32, stats.RecallInt8)
+    }
+    if stats.RecallInt8 < minRecall || stats.RecallLoss > 1-minRecall {
+        t.Errorf("int8 recall %.3f, loss %.3f, want at least %.2f and at most %.2f", stats.RecallInt8, stats.RecallLoss, minRecall, 1-minRecall)
+    }
+
+    unquantized, _ := buildTestIndex(t, metricCosine)
+    unquantized.MeasureQuantizationRecall(testQueries, testK)
+    if stats := unquantized.QuantizationStats(); stats.RecallStatus != "" || stats.Int8Bytes != 0 {
+        t.Errorf("stats without quantisation = %+v, want no recall or int8 fields", stats)
+    }
+}
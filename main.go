@@ -1,12 +1,71 @@
 package main
 
 import (
+    "fmt"
     "log"
     "net/http"
+    "os"
+    "time"
     "github.com/gorilla/mux"
 )
 
 func main() {
+    // Load the word vectors used to embed intents
+    if path := envString("WORD_VECTORS_PATH", ""); path != "" {
+        stats, err := LoadWordVectors(path, envString("WORD_VECTORS_FORMAT", "auto"), envInt("WORD_VECTORS_LIMIT", 0))
+        if err != nil {
+            log.Printf("Error loading word vectors: %v", err)
+        }
+        wordVectorStats = stats
+    } else {
+        log.Println("WORD_VECTORS_PATH is not set; intent vectors will all be zero")
+        wordVectorStats.Error = "WORD_VECTORS_PATH is not set"
+    }
+    if path := envString("SUBWORD_VECTORS_PATH", ""); path != "" {
+        table, err := LoadSubwordVectors(path, envInt("SUBWORD_MIN_N", defaultSubwordMinN), envInt("SUBWORD_MAX_N", defaultSubwordMaxN))
+        if err != nil {
+            log.Printf("Error loading subword vectors: %v", err)
+        } else if table.dimension != embeddingDimension {
+            log.Printf("Ignoring subword vectors: dimension %d does not match word vectors (%d)", table.dimension, embeddingDimension)
+        } else {
+            subwordVectors = table
+            wordVectorStats.SubwordBuckets = table.buckets
+        }
+    }
+
+    if err := SetSentenceComposition(envString("SENTENCE_COMPOSITION", compositionMean)); err != nil {
+        log.Fatal(err)
+    }
+    sifWeightA = envFloat("SIF_WEIGHT_A", sifWeightA)
+
+    embedderSpec := envString("EMBEDDER", embedderWordAverage)
+    embedder, err := NewEmbedder(embedderSpec)
+    if err != nil {
+        log.Fatal(err)
+    }
+    activeEmbedder = embedder
+    log.Printf("Embedding intents with %s", activeEmbedder.Name())
+
+    if len(os.Args) > 1 {
+        if err := runCommand(os.Args[1], os.Args[2:], embedderSpec); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    registry, err := openCollections(embedderSpec)
+    if err != nil {
+        log.Fatal(err)
+    }
+    collections = registry
+
+    // Keep the intent catalog fresh in the background. Only the JSON file is edited by
+    // hand; the segment log changes through the API.
+    if envString("EMBEDDINGS_STORE", storeJSON) == storeJSON {
+        intents, _ := collections.Get(defaultCollection)
+        go intents.Store.Watch(envDuration("EMBEDDINGS_WATCH_INTERVAL", 5*time.Second), nil)
+    }
+
     // Create a new router
     router := mux.NewRouter()
 
@@ -14,10 +73,67 @@ func main() {
     router.HandleFunc("/", HomeHandler).Methods("GET")
     router.HandleFunc("/list-repos", ListReposHandler).Methods("GET")
     router.HandleFunc("/map-intent", MapIntentHandler).Methods("GET")
+    router.HandleFunc("/map-intent/batch", MapIntentBatchHandler).Methods("POST")
+    router.HandleFunc("/v1/embeddings", OpenAIEmbeddingsHandler).Methods("POST")
     router.HandleFunc("/repo-details", RepoDetailsHandler).Methods("GET")
     router.HandleFunc("/api/llm-analysis", LLManalysisHandler)
+    router.HandleFunc("/admin/embeddings", EmbeddingStoreStatusHandler).Methods("GET")
+    router.HandleFunc("/admin/reload", ReloadEmbeddingsHandler).Methods("POST")
+    router.HandleFunc("/admin/index", IndexStatsHandler).Methods("GET")
+    router.HandleFunc("/embeddings", ListEmbeddingsHandler).Methods("GET")
+    router.HandleFunc("/embeddings", CreateEmbeddingHandler).Methods("POST")
+    router.HandleFunc("/embeddings/{id}", GetEmbeddingHandler).Methods("GET")
+    router.HandleFunc("/embeddings/{id}", UpdateEmbeddingHandler).Methods("PUT")
+    router.HandleFunc("/embeddings/{id}", DeleteEmbeddingHandler).Methods("DELETE")
+    router.HandleFunc("/extract-params", ExtractParamsHandler).Methods("GET")
+    router.HandleFunc("/schemas/{project}", GetParamSchemaHandler).Methods("GET")
+    router.HandleFunc("/schemas/{project}", PutParamSchemaHandler).Methods("PUT")
+    router.HandleFunc("/schemas/{project}", DeleteParamSchemaHandler).Methods("DELETE")
+    router.HandleFunc("/feedback", FeedbackHandler).Methods("POST")
+    router.HandleFunc("/feedback", ListFeedbackHandler).Methods("GET")
+    router.HandleFunc("/feedback/drift", FeedbackDriftHandler).Methods("GET")
+    router.HandleFunc("/collections", ListCollectionsHandler).Methods("GET")
+    router.HandleFunc("/collections", CreateCollectionHandler).Methods("POST")
+    router.HandleFunc("/collections/{name}", GetCollectionHandler).Methods("GET")
+    router.HandleFunc("/collections/{name}", DropCollectionHandler).Methods("DELETE")
+    router.HandleFunc("/collections/{name}/import", ImportCollectionHandler).Methods("POST")
+    router.HandleFunc("/collections/{name}/export", ExportCollectionHandler).Methods("GET")
+    router.HandleFunc("/collections/{name}/reembed", StartReembedHandler).Methods("POST")
+    router.HandleFunc("/collections/{name}/reembed", ReembedStatusHandler).Methods("GET")
+    router.HandleFunc("/collections/{name}/reembed", CancelReembedHandler).Methods("DELETE")
+    router.HandleFunc("/collections/{name}/thresholds", SetThresholdsHandler).Methods("PUT")
+    router.HandleFunc("/collections/{name}/calibrate", CalibrateCollectionHandler).Methods("POST")
+    router.HandleFunc("/collections/{name}/eval", EvalCollectionHandler).Methods("POST")
 
     // Start the server
     log.Println("Server running on port 8085")
     log.Fatal(http.ListenAndServe(":8085", router))
 }
+
+// openCollections loads the intent catalog and reopens the collections created through the
+// API. Word statistics for weighted composition follow the intent catalog.
+func openCollections(embedderSpec string) (*CollectionRegistry, error) {
+    indexConfig := DefaultHNSWConfig()
+    if indexConfig.Quantization != quantizationNone && indexConfig.Quantization != quantizationInt8 {
+        return nil, fmt.Errorf("unknown VECTOR_QUANTIZATION %q (expected %s or %s)", indexConfig.Quantization, quantizationNone, quantizationInt8)
+    }
+    storeBackend := envString("EMBEDDINGS_STORE", storeJSON)
+    backend, err := NewEmbeddingBackend(storeBackend, envString("EMBEDDINGS_PATH", "data/embeddings.json"), envString("SEGMENTS_PATH", "data/segments"))
+    if err != nil {
+        return nil, err
+    }
+    intents := NewEmbeddingStore(backend, indexConfig, 0)
+    if sentenceComposition != compositionMean {
+        intents.OnReload(RefreshCorpusStats)
+        intents.OnWrite(newCorpusRefresher(intents.Embeddings).Changed)
+    }
+    if err := intents.Reload(); err != nil {
+        log.Printf("Starting with no intent embeddings: %v", err)
+    }
+
+    registry := NewCollectionRegistry(envString("COLLECTIONS_PATH", "data/collections"), storeBackend, indexConfig, intents, activeEmbedder, embedderSpec)
+    if err := registry.Load(); err != nil {
+        log.Printf("Error loading collections: %v", err)
+    }
+    return registry, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "reflect"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// States of a re-embedding job
+const (
+    migrationRunning   = "running"
+    migrationDone      = "done"
+    migrationFailed    = "failed"
+    migrationCancelled = "cancelled"
+)
+
+// maxMigrationPasses bounds the passes over the collection before switching over. Each
+// pass after the first only re-embeds records written while the previous one ran; what is
+// still missing after the last pass is re-embedded during the switchover, with writes held.
+const maxMigrationPasses = 3
+
+var (
+    errMigrationRunning   = errors.New("a re-embedding job is already running")
+    errMigrationCancelled = errors.New("re-embedding cancelled")
+)
+
+// MigrationStatus reports the progress of a job that re-embeds a collection with a new model
+type MigrationStatus struct {
+    Collection string `json:"collection"`
+    // Embedder is the spec the collection switches to, From and To the model names
+    Embedder   string     `json:"embedder"`
+    From       string     `json:"from"`
+    To         string     `json:"to"`
+    State      string     `json:"state"`
+    Total      int        `json:"total"`
+    Embedded   int        `json:"embedded"`
+    Passes     int        `json:"passes"`
+    Error      string     `json:"error,omitempty"`
+    StartedAt  time.Time  `json:"startedAt"`
+    FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// migration is a running or finished re-embedding job
+type migration struct {
+    mu     sync.Mutex
+    status MigrationStatus
+    stop   chan struct{}
+}
+
+func (m *migration) snapshot() MigrationStatus {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.status
+}
+
+func (m *migration) update(fn func(status *MigrationStatus)) {
+    m.mu.Lock()
+    fn(&m.status)
+    m.mu.Unlock()
+}
+
+// StartMigration re-embeds a collection in the background with the given embedder spec.
+// The new vectors are built in a separate index while the collection keeps serving; once
+// complete they replace the stored ones in one durable step and the collection switches
+// to the new embedder.
+func (r *CollectionRegistry) StartMigration(name, embedderSpec string, batchSize int) (MigrationStatus, error) {
+    collection, err := r.Get(name)
+    if err != nil {
+        return MigrationStatus{}, err
+    }
+    embedder, err := NewEmbedder(embedderSpec)
+    if err != nil {
+        return MigrationStatus{}, err
+    }
+    if batchSize < 1 {
+        batchSize = 32
+    }
+    from := collection.Store.Model()
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if previous, exists := r.migrations[collection.Config.Name]; exists && previous.snapshot().State == migrationRunning {
+        return MigrationStatus{}, errMigrationRunning
+    }
+    m := &migration{
+        status: MigrationStatus{
+            Collection: collection.Config.Name,
+            Embedder:   embedderSpec,
+            From:       from,
+            To:         embedder.Name(),
+            State:      migrationRunning,
+            StartedAt:  time.Now(),
+        },
+        stop: make(chan struct{}),
+    }
+    r.migrations[collection.Config.Name] = m
+    go r.runMigration(m, collection, embedder, batchSize)
+    log.Printf("Re-embedding collection %s with %s", collection.Config.Name, embedder.Name())
+    return m.snapshot(), nil
+}
+
+// Migration returns the status of the latest re-embedding job of a collection, or nil
+func (r *CollectionRegistry) Migration(name string) *MigrationStatus {
+    r.mu.RLock()
+    m, exists := r.migrations[name]
+    r.mu.RUnlock()
+    if !exists {
+        return nil
+    }
+    status := m.snapshot()
+    return &status
+}
+
+// CancelMigration stops a running re-embedding job; the collection is left unchanged
+func (r *CollectionRegistry) CancelMigration(name string) error {
+    r.mu.RLock()
+    m, exists := r.migrations[name]
+    r.mu.RUnlock()
+    if !exists || m.snapshot().State != migrationRunning {
+        return fmt.Errorf("no re-embedding job is running for %s", name)
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    select {
+    case <-m.stop:
+    default:
+        close(m.stop)
+    }
+    return nil
+}
+
+// Info describes a collection together with its latest re-embedding job
+func (r *CollectionRegistry) Info(collection *Collection) CollectionInfo {
+    info := collection.Info()
+    info.Migration = r.Migration(collection.Config.Name)
+    return info
+}
+
+func (r *CollectionRegistry) runMigration(m *migration, collection *Collection, embedder Embedder, batchSize int) {
+    indexConfig := r.indexConfig
+    indexConfig.Metric = collection.Config.Metric
+    staging := NewEmbeddingStore(memoryBackend{}, indexConfig, 0)
+
+    err := func() error {
+        for pass := 0; pass < maxMigrationPasses; pass++ {
+            live := collection.Store.Embeddings()
+            pending := stageDiff(live, staging)
+            if pass == 0 {
+                m.update(func(status *MigrationStatus) { status.Total = len(live) })
+            } else if len(pending) == 0 {
+                break
+            }
+            m.update(func(status *MigrationStatus) { status.Passes++ })
+            if err := m.reembed(staging, embedder, pending, batchSize); err != nil {
+                return err
+            }
+        }
+        switched, err := r.recordEmbedder(collection, m.snapshot().Embedder, embedder, staging.Dimension())
+        if err != nil {
+            return err
+        }
+        err = collection.Store.Replace(staging, func(live []Embedding) error {
+            return m.reembed(staging, embedder, stageDiff(live, staging), batchSize)
+        }, func() {
+            r.install(collection, switched)
+        })
+        if err != nil {
+            r.restoreManifest(collection.Config.Name)
+        }
+        return err
+    }()
+
+    now := time.Now()
+    m.update(func(status *MigrationStatus) {
+        status.FinishedAt = &now
+        switch {
+        case err == errMigrationCancelled:
+            status.State = migrationCancelled
+        case err != nil:
+            status.State = migrationFailed
+            status.Error = err.Error()
+        default:
+            status.State = migrationDone
+        }
+    })
+    if err != nil {
+        log.Printf("Re-embedding collection %s stopped: %v", collection.Config.Name, err)
+        return
+    }
+    log.Printf("Collection %s now holds vectors from %s", collection.Config.Name, embedder.Name())
+}
+
+// stageDiff removes records from staging that are no longer live and returns the live
+// records that staging lacks or holds an outdated copy of
+func stageDiff(live []Embedding, staging *EmbeddingStore) []Embedding {
+    liveIDs := make(map[string]bool, len(live))
+    var pending []Embedding
+    for _, embedding := range live {
+        liveIDs[embedding.ID] = true
+        staged, exists := staging.Get(embedding.ID)
+        if !exists || staged.Intent != embedding.Intent || staged.Project != embedding.Project ||
+            staged.Text != embedding.Text || staged.Params != embedding.Params || !reflect.DeepEqual(staged.Metadata, embedding.Metadata) {
+            pending = append(pending, embedding)
+        }
+    }
+    for _, staged := range staging.Embeddings() {
+        if !liveIDs[staged.ID] {
+            staging.Delete(staged.ID)
+        }
+    }
+    return pending
+}
+
+// reembed embeds the source texts of the records in batches and stores them in staging. Any
+// failure stops the job, since switching over would lose the record.
+func (m *migration) reembed(staging *EmbeddingStore, embedder Embedder, records []Embedding, batchSize int) error {
+    return reembedInto(staging, embedder, records, batchSize, m.stop, func(n int) {
+        m.update(func(status *MigrationStatus) { status.Embedded += n })
+    })
+}
+
+// reembedInto embeds the source texts of the records in batches with the embedder and stores
+// them in the target store, reporting each stored batch to progress. Closing stop returns
+// errMigrationCancelled before the next batch.
+func reembedInto(target *EmbeddingStore, embedder Embedder, records []Embedding, batchSize int, stop <-chan struct{}, progress func(n int)) error {
+    for start := 0; start < len(records); start += batchSize {
+        select {
+        case <-stop:
+            return errMigrationCancelled
+        default:
+        }
+        end := start + batchSize
+        if end > len(records) {
+            end = len(records)
+        }
+        batch := append([]Embedding(nil), records[start:end]...)
+        texts := make([]string, len(batch))
+        for i, embedding := range batch {
+            texts[i] = embedding.SourceText()
+            if texts[i] == "" {
+                return fmt.Errorf("embedding %s has no text or intent to re-embed", embedding.ID)
+            }
+        }
+        vectors, err := embedder.Embed(texts)
+        if err != nil {
+            return fmt.Errorf("failed to embed texts with %s: %v", embedder.Name(), err)
+        }
+        for i := range batch {
+            batch[i].Vector = toFloat32(vectors[i])
+            batch[i].Model = embedder.Name()
+        }
+        for i, result := range target.PutBatch(batch) {
+            if result.Err != nil {
+                return fmt.Errorf("embedding %s: %v", batch[i].ID, result.Err)
+            }
+        }
+        if progress != nil {
+            progress(len(batch))
+        }
+    }
+    return nil
+}
+
+// recordEmbedder writes the manifest as it will be once the collection holds vectors from
+// the new embedder, before they replace the stored ones, and returns the collection's
+// config with the new embedder. The old spec is kept as PreviousEmbedder, so after a crash
+// between the two steps Load picks whichever embedder the stored vectors came from.
+func (r *CollectionRegistry) recordEmbedder(collection *Collection, embedderSpec string, embedder Embedder, dimension int) (*Collection, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    name := collection.Config.Name
+    current, exists := r.collections[name]
+    if !exists || current.Store != collection.Store {
+        return nil, errCollectionNotFound
+    }
+    config := current.Config
+    config.PreviousEmbedder = config.Embedder
+    config.Embedder = embedderSpec
+    if config.Dimension != 0 {
+        config.Dimension = dimension
+    }
+    switched := &Collection{Config: config, Store: current.Store, Embedder: embedder}
+    r.switching[name] = switched
+    if err := r.saveManifest(); err != nil {
+        delete(r.switching, name)
+        return nil, fmt.Errorf("failed to record the new embedder: %v", err)
+    }
+    return switched, nil
+}
+
+// install moves the collection to the embedder recorded by recordEmbedder, keeping any
+// other change made to its config meanwhile. It runs inside the store's swap, which holds
+// the store's locks, so nothing holding mu may wait on a store.
+func (r *CollectionRegistry) install(collection, switched *Collection) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    name := collection.Config.Name
+    delete(r.switching, name)
+    if current, exists := r.collections[name]; exists && current.Store == collection.Store {
+        config := current.Config
+        config.Embedder = switched.Config.Embedder
+        config.PreviousEmbedder = switched.Config.PreviousEmbedder
+        config.Dimension = switched.Config.Dimension
+        r.collections[name] = &Collection{Config: config, Store: current.Store, Embedder: switched.Embedder}
+    }
+}
+
+// restoreManifest records the collection's current embedder again after a switchover that
+// failed once recordEmbedder had run
+func (r *CollectionRegistry) restoreManifest(name string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    delete(r.switching, name)
+    if err := r.saveManifest(); err != nil {
+        log.Printf("Failed to restore the manifest after re-embedding %s failed: %v", name, err)
+    }
+}
+
+// StartReembedHandler starts re-embedding a collection with the embedder named in
+// {"embedder", "batch"} and returns the job's status
+func StartReembedHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    var req struct {
+        Embedder string `json:"embedder"`
+        Batch    int    `json:"batch"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if req.Embedder == "" {
+        http.Error(w, "'embedder' is required", http.StatusBadRequest)
+        return
+    }
+    log.Printf("Handling request to re-embed collection %s with %s", name, req.Embedder)
+
+    status, err := collections.StartMigration(name, req.Embedder, req.Batch)
+    switch {
+    case err == errCollectionNotFound:
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    case err == errMigrationRunning:
+        http.Error(w, fmt.Sprintf("Collection %q is already being re-embedded", name), http.StatusConflict)
+        return
+    case err != nil:
+        http.Error(w, fmt.Sprintf("Error starting re-embedding: %v", err), http.StatusBadRequest)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(status)
+}
+
+// ReembedStatusHandler reports the latest re-embedding job of a collection
+func ReembedStatusHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    status := collections.Migration(name)
+    if status == nil {
+        http.Error(w, fmt.Sprintf("Collection %q has not been re-embedded", name), http.StatusNotFound)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
+
+// CancelReembedHandler stops a running re-embedding job, leaving the collection unchanged
+func CancelReembedHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    log.Printf("Handling request to cancel re-embedding collection %s", name)
+    if err := collections.CancelMigration(name); err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "path/filepath"
+    "testing"
+)
+
+// recordingEmbedder returns a one-dimensional vector per text and remembers the texts
+type recordingEmbedder struct {
+    texts []string
+}
+
+func (e *recordingEmbedder) Name() string { return "recording" }
+
+func (e *recordingEmbedder) Embed(texts []string) ([][]float64, error) {
+    e.texts = append(e.texts, texts...)
+    vectors := make([][]float64, len(texts))
+    for i, text := range texts {
+        vectors[i] = []float64{float64(len(text)), 1}
+    }
+    return vectors, nil
+}
+
+func TestReembedUsesSourceText(t *testing.T) {
+    records := []Embedding{
+        {ID: "a", Intent: "scrape news", Project: "scraper", Vector: []float32{1, 0}},
+        {ID: "b", Intent: "rates", Project: "bank", Text: "check the bank's interest rates", Vector: []float32{0, 1}},
+    }
+    embedder := &recordingEmbedder{}
+    target := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    if err := reembedInto(target, embedder, records, 1, nil, nil); err != nil {
+        t.Fatal(err)
+    }
+    if len(embedder.texts) != 2 || embedder.texts[0] != "scrape news" || embedder.texts[1] != records[1].Text {
+        t.Fatalf("embedded %q, want the intent of a and the text of b", embedder.texts)
+    }
+    reembedded, ok := target.Get("b")
+    if !ok || reembedded.Text != records[1].Text || reembedded.Model != embedder.Name() {
+        t.Errorf("re-embedded record b = %+v, want its text kept and model %s", reembedded, embedder.Name())
+    }
+}
+
+func testMigrationRegistry(dir string, embedder Embedder) (*CollectionRegistry, *Collection) {
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    store.PutBatch([]Embedding{
+        {ID: "a", Intent: "scrape news", Project: "scraper", Model: embedder.Name(), Vector: []float32{1, 0}},
+        {ID: "b", Intent: "check rates", Project: "bank", Model: embedder.Name(), Vector: []float32{0, 1}},
+    })
+    registry := NewCollectionRegistry(dir, storeJSON, HNSWConfig{Metric: metricCosine}, store, embedder, embedderWordAverage)
+    collection, _ := registry.Get(defaultCollection)
+    return registry, collection
+}
+
+func runTestMigration(registry *CollectionRegistry, collection *Collection, embedder Embedder) MigrationStatus {
+    m := &migration{status: MigrationStatus{Collection: collection.Config.Name, Embedder: "ollama:test", State: migrationRunning}, stop: make(chan struct{})}
+    registry.runMigration(m, collection, embedder, 1)
+    return m.snapshot()
+}
+
+func TestMigrationFailedManifestWriteKeepsCollection(t *testing.T) {
+    // The manifest cannot be written beneath a regular file
+    dir := filepath.Join(t.TempDir(), "file")
+    if err := ioutil.WriteFile(dir, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    old := staticEmbedder{}
+    registry, collection := testMigrationRegistry(dir, old)
+
+    status := runTestMigration(registry, collection, &recordingEmbedder{})
+    if status.State != migrationFailed {
+        t.Fatalf("migration ended %s, want %s", status.State, migrationFailed)
+    }
+    current, _ := registry.Get(defaultCollection)
+    if current.Store.Model() != old.Name() || current.Embedder.Name() != old.Name() {
+        t.Errorf("after a failed manifest write the collection holds %s vectors queried with %s, want %s for both", current.Store.Model(), current.Embedder.Name(), old.Name())
+    }
+    if err := current.CheckEmbedder(); err != nil {
+        t.Errorf("the collection refuses queries after a failed switchover: %v", err)
+    }
+}
+
+func TestMigrationSwitchesVectorsAndEmbedderTogether(t *testing.T) {
+    dir := t.TempDir()
+    registry, collection := testMigrationRegistry(dir, staticEmbedder{})
+    embedder := &recordingEmbedder{}
+
+    status := runTestMigration(registry, collection, embedder)
+    if status.State != migrationDone {
+        t.Fatalf("migration ended %s (%s), want %s", status.State, status.Error, migrationDone)
+    }
+    current, _ := registry.Get(defaultCollection)
+    if current.Store.Model() != embedder.Name() || current.Embedder != Embedder(embedder) {
+        t.Errorf("the collection holds %s vectors queried with %s, want %s for both", current.Store.Model(), current.Embedder.Name(), embedder.Name())
+    }
+    if current.Config.Embedder != "ollama:test" || current.Config.PreviousEmbedder != embedderWordAverage {
+        t.Errorf("config records embedder %q after %q", current.Config.Embedder, current.Config.PreviousEmbedder)
+    }
+
+    // The default collection's new embedder is in the manifest
+    data, err := ioutil.ReadFile(filepath.Join(dir, collectionManifest))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var configs []CollectionConfig
+    if err := json.Unmarshal(data, &configs); err != nil {
+        t.Fatal(err)
+    }
+    if len(configs) != 1 || configs[0].Name != defaultCollection || configs[0].Embedder != "ollama:test" {
+        t.Errorf("manifest holds %+v, want the default collection with its new embedder", configs)
+    }
+}
+
+func TestReconcileEmbedderFollowsStoredVectors(t *testing.T) {
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    if spec, _, err := reconcileEmbedder(store, "ollama:new", "ollama:old"); err != nil || spec != "ollama:new" {
+        t.Errorf("an empty store reconciled to %q, %v; want the first spec", spec, err)
+    }
+    old, _ := NewEmbedder("ollama:old")
+    store.Put(Embedding{ID: "a", Intent: "scrape news", Model: old.Name(), Vector: []float32{1, 0}})
+    // A crash after recording ollama:new but before its vectors were swapped in
+    if spec, embedder, err := reconcileEmbedder(store, "ollama:new", "ollama:old"); err != nil || spec != "ollama:old" || embedder.Name() != old.Name() {
+        t.Errorf("reconciled to %q, %v; want the embedder of the stored vectors", spec, err)
+    }
+    if spec, _, _ := reconcileEmbedder(store, "ollama:other", ""); spec != "ollama:other" {
+        t.Errorf("reconciled to %q with no matching spec, want the first", spec)
+    }
+}
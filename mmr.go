@@ -0,0 +1,87 @@
+package main
+
+import "math"
+
+// diversify re-ranks candidates, best first, into at most opts.K results. With MMR each
+// pick maximises
+//
+//    lambda * relevance - (1 - lambda) * max similarity to the candidates already picked
+//
+// where relevance is the ranking score scaled to [0, 1] over the candidates, and the
+// similarity is the cosine of the stored vectors. Candidates from a project that already
+// has opts.MaxPerProject results are skipped. The first pick is always the best candidate.
+func diversify(candidates []IntentCandidate, vectors [][]float32, opts SearchOptions) []IntentCandidate {
+    relevance := make([]float64, len(candidates))
+    low, high := math.Inf(1), math.Inf(-1)
+    for i, candidate := range candidates {
+        relevance[i] = candidate.Similarity
+        if candidate.FusedScore != 0 {
+            relevance[i] = candidate.FusedScore
+        }
+        low = math.Min(low, relevance[i])
+        high = math.Max(high, relevance[i])
+    }
+    for i := range relevance {
+        if high > low {
+            relevance[i] = (relevance[i] - low) / (high - low)
+        } else {
+            relevance[i] = 1
+        }
+    }
+
+    picked := make([]IntentCandidate, 0, opts.K)
+    perProject := make(map[string]int)
+    used := make([]bool, len(candidates))
+    // redundancy[i] is the highest similarity of candidate i to any pick so far
+    redundancy := make([]float64, len(candidates))
+    for i := range redundancy {
+        redundancy[i] = -1
+    }
+    for len(picked) < opts.K {
+        best, bestScore := -1, math.Inf(-1)
+        for i := range candidates {
+            if used[i] || (opts.MaxPerProject > 0 && perProject[candidates[i].Project] >= opts.MaxPerProject) {
+                continue
+            }
+            score := relevance[i]
+            if opts.MMR && len(picked) > 0 {
+                score = opts.MMRLambda*relevance[i] - (1-opts.MMRLambda)*redundancy[i]
+            }
+            if score > bestScore {
+                best, bestScore = i, score
+            }
+        }
+        if best < 0 {
+            break
+        }
+        used[best] = true
+        perProject[candidates[best].Project]++
+        picked = append(picked, candidates[best])
+        if opts.MMR {
+            for i := range candidates {
+                if !used[i] {
+                    redundancy[i] = math.Max(redundancy[i], cosineFloat32(vectors[i], vectors[best]))
+                }
+            }
+        }
+    }
+    return picked
+}
+
+// cosineFloat32 returns the cosine similarity of two vectors, 0 if either is zero or their
+// lengths differ
+func cosineFloat32(a, b []float32) float64 {
+    if len(a) != len(b) {
+        return 0
+    }
+    var dot, normA, normB float64
+    for i := range a {
+        dot += float64(a[i]) * float64(b[i])
+        normA += float64(a[i]) * float64(a[i])
+        normB += float64(b[i]) * float64(b[i])
+    }
+    if normA == 0 || normB == 0 {
+        return 0
+    }
+    return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
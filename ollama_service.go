@@ -7,6 +7,13 @@ import (
     "fmt"
     "log"
     "net/http"
+    "time"
+)
+
+// Defaults for the generation model used by CallOllamaLLM
+const (
+    defaultOllamaLLMModel   = "llama3.2"
+    defaultOllamaLLMTimeout = 60 * time.Second
 )
 
 // Updated OllamaResponse struct
@@ -15,14 +22,21 @@ type OllamaResponse struct {
     CreatedAt string `json:"created_at"`
     Response  string `json:"response"`
     Done      bool   `json:"done"`
+    Error     string `json:"error,omitempty"`
     // Include other fields if needed
 }
 
-// CallOllamaLLM sends a prompt to the Ollama LLM API and handles streaming response
+// ollamaLLMModel is the model CallOllamaLLM generates with
+func ollamaLLMModel() string {
+    return envString("OLLAMA_LLM_MODEL", defaultOllamaLLMModel)
+}
+
+// CallOllamaLLM sends a prompt to the Ollama LLM API and handles streaming response.
+// OLLAMA_URL, OLLAMA_LLM_MODEL and OLLAMA_LLM_TIMEOUT configure the call.
 func CallOllamaLLM(prompt string) (string, error) {
-    url := "http://localhost:11434/api/generate"
+    url := envString("OLLAMA_URL", defaultOllamaURL) + "/api/generate"
     payload := map[string]interface{}{
-        "model":  "llama3.2",
+        "model":  ollamaLLMModel(),
         "prompt": prompt,
     }
 
@@ -37,12 +51,17 @@ func CallOllamaLLM(prompt string) (string, error) {
     }
     req.Header.Set("Content-Type", "application/json")
 
-    client := &http.Client{}
+    client := &http.Client{Timeout: envDuration("OLLAMA_LLM_TIMEOUT", defaultOllamaLLMTimeout)}
     resp, err := client.Do(req)
     if err != nil {
         return "", fmt.Errorf("error sending request: %w", err)
     }
     defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        var failure OllamaResponse
+        json.NewDecoder(resp.Body).Decode(&failure)
+        return "", fmt.Errorf("ollama returned %s: %s", resp.Status, failure.Error)
+    }
 
     // Read the response line by line
     scanner := bufio.NewScanner(resp.Body)
@@ -59,6 +78,9 @@ func CallOllamaLLM(prompt string) (string, error) {
             log.Println("Error unmarshalling line:", err)
             continue
         }
+        if ollamaResponse.Error != "" {
+            return "", fmt.Errorf("ollama error: %s", ollamaResponse.Error)
+        }
 
         fullResponse += ollamaResponse.Response
         if ollamaResponse.Done {
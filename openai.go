@@ -0,0 +1,176 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+)
+
+// maxOpenAIInputs matches the OpenAI limit on inputs per embeddings request
+const maxOpenAIInputs = 2048
+
+// Encodings accepted in encoding_format
+const (
+    encodingFloat  = "float"
+    encodingBase64 = "base64"
+)
+
+// OpenAIEmbeddingRequest is the body of POST /v1/embeddings. Input is a string or a list
+// of strings; token arrays are not supported since the service cannot decode them.
+type OpenAIEmbeddingRequest struct {
+    Input          json.RawMessage `json:"input"`
+    Model          string          `json:"model"`
+    Dimensions     int             `json:"dimensions,omitempty"`
+    EncodingFormat string          `json:"encoding_format,omitempty"`
+    User           string          `json:"user,omitempty"`
+}
+
+// OpenAIEmbedding is one vector of the response. Embedding holds a []float32, or a base64
+// string of little-endian float32 values.
+type OpenAIEmbedding struct {
+    Object    string      `json:"object"`
+    Index     int         `json:"index"`
+    Embedding interface{} `json:"embedding"`
+}
+
+// OpenAIEmbeddingResponse mirrors the OpenAI embeddings response
+type OpenAIEmbeddingResponse struct {
+    Object string            `json:"object"`
+    Data   []OpenAIEmbedding `json:"data"`
+    Model  string            `json:"model"`
+    Usage  OpenAIUsage       `json:"usage"`
+}
+
+// OpenAIUsage counts input tokens as the service's tokenizer splits them
+type OpenAIUsage struct {
+    PromptTokens int `json:"prompt_tokens"`
+    TotalTokens  int `json:"total_tokens"`
+}
+
+// openAIError writes an error in the OpenAI format, which client libraries parse
+func openAIError(w http.ResponseWriter, status int, param, format string, args ...interface{}) {
+    var body struct {
+        Error struct {
+            Message string      `json:"message"`
+            Type    string      `json:"type"`
+            Param   interface{} `json:"param"`
+            Code    interface{} `json:"code"`
+        } `json:"error"`
+    }
+    body.Error.Message = fmt.Sprintf(format, args...)
+    body.Error.Type = "invalid_request_error"
+    if status >= 500 {
+        body.Error.Type = "server_error"
+    }
+    if param != "" {
+        body.Error.Param = param
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
+
+// parseOpenAIInput accepts a string or a non-empty list of non-empty strings
+func parseOpenAIInput(raw json.RawMessage) ([]string, error) {
+    var single string
+    if err := json.Unmarshal(raw, &single); err == nil {
+        if single == "" {
+            return nil, fmt.Errorf("'input' must not be empty")
+        }
+        return []string{single}, nil
+    }
+    var list []string
+    if err := json.Unmarshal(raw, &list); err != nil {
+        return nil, fmt.Errorf("'input' must be a string or a list of strings; token arrays are not supported")
+    }
+    if len(list) == 0 {
+        return nil, fmt.Errorf("'input' must not be empty")
+    }
+    if len(list) > maxOpenAIInputs {
+        return nil, fmt.Errorf("'input' has %d items, at most %d are allowed", len(list), maxOpenAIInputs)
+    }
+    for i, text := range list {
+        if text == "" {
+            return nil, fmt.Errorf("'input[%d]' must not be empty", i)
+        }
+    }
+    return list, nil
+}
+
+// OpenAIEmbeddingsHandler serves POST /v1/embeddings like the OpenAI API, so OpenAI clients
+// can use the service unchanged. A model naming a collection embeds with that collection's
+// embedder; any other model uses the configured embedder. Vectors are returned with unit
+// length, as OpenAI's are; dimensions keeps the leading components and renormalises.
+func OpenAIEmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+    var req OpenAIEmbeddingRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        openAIError(w, http.StatusBadRequest, "", "Invalid request body: %v", err)
+        return
+    }
+    if len(req.Input) == 0 {
+        openAIError(w, http.StatusBadRequest, "input", "'input' is required")
+        return
+    }
+    texts, err := parseOpenAIInput(req.Input)
+    if err != nil {
+        openAIError(w, http.StatusBadRequest, "input", "%v", err)
+        return
+    }
+    if req.EncodingFormat == "" {
+        req.EncodingFormat = encodingFloat
+    }
+    if req.EncodingFormat != encodingFloat && req.EncodingFormat != encodingBase64 {
+        openAIError(w, http.StatusBadRequest, "encoding_format", "'encoding_format' must be %s or %s", encodingFloat, encodingBase64)
+        return
+    }
+    if req.Dimensions < 0 {
+        openAIError(w, http.StatusBadRequest, "dimensions", "'dimensions' must be positive")
+        return
+    }
+    log.Printf("Handling OpenAI embeddings request for %d inputs (model %q)", len(texts), req.Model)
+
+    collection, err := collections.Get(req.Model)
+    if err != nil {
+        collection, _ = collections.Get(defaultCollection)
+    }
+    embedder := collection.Embedder
+    vectors, err := embedder.Embed(texts)
+    if err != nil {
+        openAIError(w, http.StatusBadGateway, "", "Error embedding input with %s: %v", embedder.Name(), err)
+        return
+    }
+
+    response := OpenAIEmbeddingResponse{Object: "list", Data: make([]OpenAIEmbedding, len(vectors)), Model: embedder.Name()}
+    for i, vector := range vectors {
+        if req.Dimensions > len(vector) {
+            openAIError(w, http.StatusBadRequest, "dimensions", "'dimensions' is %d but %s produces %d", req.Dimensions, embedder.Name(), len(vector))
+            return
+        }
+        if req.Dimensions > 0 {
+            vector = vector[:req.Dimensions]
+        }
+        embedding := normalizeFloat32(toFloat32(vector))
+        response.Data[i] = OpenAIEmbedding{Object: "embedding", Index: i, Embedding: embedding}
+        if req.EncodingFormat == encodingBase64 {
+            response.Data[i].Embedding = encodeFloat32Base64(embedding)
+        }
+        response.Usage.PromptTokens += len(tokenize(texts[i]))
+    }
+    response.Usage.TotalTokens = response.Usage.PromptTokens
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// encodeFloat32Base64 encodes the vector as little-endian float32 values in base64
+func encodeFloat32Base64(vector []float32) string {
+    buf := make([]byte, 4*len(vector))
+    for i, value := range vector {
+        binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(value))
+    }
+    return base64.StdEncoding.EncodeToString(buf)
+}
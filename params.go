@@ -0,0 +1,809 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Parameter extraction modes of /map-intent: rules, the default, never calls Ollama, auto
+// asks it for required parameters the rules miss, llm for every parameter they miss, and
+// none skips extraction
+const (
+    extractRules = "rules"
+    extractAuto  = "auto"
+    extractLLM   = "llm"
+    extractNone  = "none"
+)
+
+// Where an extracted parameter came from
+const (
+    paramFromRule    = "rule"
+    paramFromLLM     = "llm"
+    paramFromDefault = "default"
+)
+
+// Formats understood by the rules and checked by validation
+const (
+    formatDate   = "date"
+    formatTicker = "ticker"
+    formatRepo   = "repo"
+)
+
+// projectSchemaFile is the schema a project can ship in its own directory
+const projectSchemaFile = "params.schema.json"
+
+var (
+    errSchemaNotFound = errors.New("no parameter schema for project")
+
+    isoDatePattern   = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+    daysAgoPattern   = regexp.MustCompile(`(?i)\b(?:(\d+) days? ago|(?:past|last) (\d+) days)\b`)
+    relativePattern  = regexp.MustCompile(`(?i)\b(today|yesterday|tomorrow|last week|last month|last year)\b`)
+    dollarTicker     = regexp.MustCompile(`\$([A-Za-z]{1,5})\b`)
+    capsTicker       = regexp.MustCompile(`\b[A-Z]{2,5}\b`)
+    repoPattern      = regexp.MustCompile(`\b[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+\b`)
+    // A minus sign only counts at the start of a word, so "top-5" reads as 5
+    numberPattern    = regexp.MustCompile(`(?:^|\s)(-\d+(?:\.\d+)?%?)|\b(\d+(?:\.\d+)?%?)`)
+    tickerValue      = regexp.MustCompile(`^[A-Z]{1,5}(?:\.[A-Z]{1,2})?$`)
+    repoValue        = regexp.MustCompile(`^[A-Za-z0-9_.-]+(?:/[A-Za-z0-9_.-]+)?$`)
+    projectWord      = regexp.MustCompile(`[A-Za-z0-9_.-]+`)
+    tickerStopwords  = map[string]bool{"AND": true, "OR": true, "THE": true, "FOR": true, "TO": true, "OF": true, "IN": true, "ON": true, "API": true, "LLM": true, "JSON": true, "CSV": true, "URL": true, "HTTP": true}
+    negationPrefixes = []string{"no ", "not ", "without ", "skip "}
+)
+
+// ParamSchema is the subset of JSON Schema used to describe a project's parameters: an
+// object whose properties are strings, numbers, integers, booleans or arrays of those.
+// Strings may have a format of date (YYYY-MM-DD), ticker or repo, a pattern or an enum.
+type ParamSchema struct {
+    Type        string                  `json:"type"`
+    Description string                  `json:"description,omitempty"`
+    Properties  map[string]*ParamSchema `json:"properties,omitempty"`
+    Required    []string                `json:"required,omitempty"`
+    Items       *ParamSchema            `json:"items,omitempty"`
+    Enum        []interface{}           `json:"enum,omitempty"`
+    Format      string                  `json:"format,omitempty"`
+    Pattern     string                  `json:"pattern,omitempty"`
+    Minimum     *float64                `json:"minimum,omitempty"`
+    Maximum     *float64                `json:"maximum,omitempty"`
+    Default     interface{}             `json:"default,omitempty"`
+
+    // Compiled by check: Pattern, and a whole-word match of each Enum value
+    pattern      *regexp.Regexp
+    enumPatterns []*regexp.Regexp
+}
+
+// ParamExtraction is the outcome of filling a project's schema from an intent. Sources
+// says where each value came from. Valid is set when every required parameter has a value
+// and every value passed validation; LLM reports a failed or used fallback.
+type ParamExtraction struct {
+    Project string                 `json:"project"`
+    Params  map[string]interface{} `json:"params"`
+    Sources map[string]string      `json:"sources"`
+    Valid   bool                   `json:"valid"`
+    Missing []string               `json:"missing,omitempty"`
+    Errors  []string               `json:"errors,omitempty"`
+    LLM     string                 `json:"llm,omitempty"`
+}
+
+// schemaDir holds the schemas stored through the API
+func schemaDir() string {
+    return envString("PARAM_SCHEMAS_PATH", "data/schemas")
+}
+
+// validProjectName keeps project names usable as file names
+func validProjectName(project string) bool {
+    return project != "" && project != "." && project != ".." && filepath.Base(project) == project
+}
+
+// LoadParamSchema returns a project's schema from the schema directory, or else from
+// params.schema.json in the project's directory under PROJECT_PATHS
+func LoadParamSchema(project string) (*ParamSchema, error) {
+    if !validProjectName(project) {
+        return nil, errSchemaNotFound
+    }
+    paths := []string{filepath.Join(schemaDir(), project+".json")}
+    if basePaths, err := projectBasePaths(); err == nil {
+        for _, basePath := range basePaths {
+            paths = append(paths, filepath.Join(basePath, project, projectSchemaFile))
+        }
+    }
+    for _, path := range paths {
+        data, err := ioutil.ReadFile(path)
+        if os.IsNotExist(err) {
+            continue
+        } else if err != nil {
+            return nil, fmt.Errorf("failed to read %s: %v", path, err)
+        }
+        var schema ParamSchema
+        if err := json.Unmarshal(data, &schema); err != nil {
+            return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+        }
+        if err := schema.check(); err != nil {
+            return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+        }
+        return &schema, nil
+    }
+    return nil, errSchemaNotFound
+}
+
+// SaveParamSchema validates a schema and stores it in the schema directory
+func SaveParamSchema(project string, schema *ParamSchema) error {
+    if !validProjectName(project) {
+        return fmt.Errorf("invalid project name %q", project)
+    }
+    if err := schema.check(); err != nil {
+        return err
+    }
+    return writeJSONFileAtomic(filepath.Join(schemaDir(), project+".json"), schema)
+}
+
+// DeleteParamSchema removes a project's schema from the schema directory
+func DeleteParamSchema(project string) error {
+    if !validProjectName(project) {
+        return errSchemaNotFound
+    }
+    err := os.Remove(filepath.Join(schemaDir(), project+".json"))
+    if os.IsNotExist(err) {
+        return errSchemaNotFound
+    }
+    return err
+}
+
+// check rejects schemas using what extraction and validation do not support and compiles
+// their regular expressions, so every schema is checked before it is used
+func (s *ParamSchema) check() error {
+    if s.Type != "object" {
+        return fmt.Errorf("the schema must have type object")
+    }
+    if len(s.Properties) == 0 {
+        return fmt.Errorf("the schema has no properties")
+    }
+    for name, property := range s.Properties {
+        if property == nil {
+            return fmt.Errorf("property %s is empty", name)
+        }
+        switch property.Type {
+        case "array":
+            if property.Items == nil {
+                return fmt.Errorf("array property %s needs items", name)
+            }
+            if err := property.Items.checkScalar(); err != nil {
+                return fmt.Errorf("items of %s: %v", name, err)
+            }
+        default:
+            if err := property.checkScalar(); err != nil {
+                return fmt.Errorf("property %s: %v", name, err)
+            }
+        }
+        if property.Default != nil {
+            if err := validateParam(property, property.Default); err != nil {
+                return fmt.Errorf("default of %s: %v", name, err)
+            }
+        }
+    }
+    for _, name := range s.Required {
+        if _, exists := s.Properties[name]; !exists {
+            return fmt.Errorf("required property %s is not defined", name)
+        }
+    }
+    return nil
+}
+
+func (s *ParamSchema) checkScalar() error {
+    switch s.Type {
+    case "string", "number", "integer", "boolean":
+    default:
+        return fmt.Errorf("unsupported type %q (expected string, number, integer, boolean or array)", s.Type)
+    }
+    switch s.Format {
+    case "", formatDate, formatTicker, formatRepo:
+    default:
+        return fmt.Errorf("unsupported format %q (expected %s, %s or %s)", s.Format, formatDate, formatTicker, formatRepo)
+    }
+    if s.Pattern != "" {
+        pattern, err := regexp.Compile(s.Pattern)
+        if err != nil {
+            return fmt.Errorf("invalid pattern: %v", err)
+        }
+        s.pattern = pattern
+    }
+    s.enumPatterns = make([]*regexp.Regexp, len(s.Enum))
+    for i, allowed := range s.Enum {
+        word := strings.ToLower(fmt.Sprint(allowed))
+        s.enumPatterns[i] = regexp.MustCompile(`\b` + regexp.QuoteMeta(word) + `\b`)
+    }
+    return nil
+}
+
+// validateParam checks a value against its property schema. Numbers are float64, as
+// decoded from JSON.
+func validateParam(schema *ParamSchema, value interface{}) error {
+    if schema.Type == "array" {
+        list, ok := value.([]interface{})
+        if !ok {
+            return fmt.Errorf("expected an array")
+        }
+        for i, item := range list {
+            if err := validateParam(schema.Items, item); err != nil {
+                return fmt.Errorf("item %d: %v", i, err)
+            }
+        }
+        return nil
+    }
+
+    switch schema.Type {
+    case "string":
+        s, ok := value.(string)
+        if !ok {
+            return fmt.Errorf("expected a string")
+        }
+        switch schema.Format {
+        case formatDate:
+            if _, err := time.Parse("2006-01-02", s); err != nil {
+                return fmt.Errorf("%q is not a YYYY-MM-DD date", s)
+            }
+        case formatTicker:
+            if !tickerValue.MatchString(s) {
+                return fmt.Errorf("%q is not a ticker", s)
+            }
+        case formatRepo:
+            if !repoValue.MatchString(s) {
+                return fmt.Errorf("%q is not a repository name", s)
+            }
+        }
+        if schema.pattern != nil && !schema.pattern.MatchString(s) {
+            return fmt.Errorf("%q does not match %s", s, schema.Pattern)
+        }
+    case "number", "integer":
+        n, ok := value.(float64)
+        if !ok {
+            return fmt.Errorf("expected a number")
+        }
+        if schema.Type == "integer" && n != math.Trunc(n) {
+            return fmt.Errorf("%v is not an integer", n)
+        }
+        if schema.Minimum != nil && n < *schema.Minimum {
+            return fmt.Errorf("%v is below the minimum %v", n, *schema.Minimum)
+        }
+        if schema.Maximum != nil && n > *schema.Maximum {
+            return fmt.Errorf("%v is above the maximum %v", n, *schema.Maximum)
+        }
+    case "boolean":
+        if _, ok := value.(bool); !ok {
+            return fmt.Errorf("expected a boolean")
+        }
+    }
+    if len(schema.Enum) > 0 {
+        for _, allowed := range schema.Enum {
+            if fmt.Sprint(allowed) == fmt.Sprint(value) {
+                return nil
+            }
+        }
+        return fmt.Errorf("%v is not one of %v", value, schema.Enum)
+    }
+    return nil
+}
+
+// ExtractParams fills a project's schema from the intent: rules first, then Ollama for
+// what the rules missed, the required parameters in auto mode and all of them in llm
+// mode, then the schema defaults. Every value is validated; an invalid rule or LLM value
+// is dropped and reported.
+func ExtractParams(project string, schema *ParamSchema, intent, mode string) ParamExtraction {
+    extraction := ParamExtraction{Project: project, Params: make(map[string]interface{}), Sources: make(map[string]string)}
+    accept := func(name string, value interface{}, source string) {
+        if err := validateParam(schema.Properties[name], value); err != nil {
+            extraction.Errors = append(extraction.Errors, fmt.Sprintf("%s from %s: %v", name, source, err))
+            return
+        }
+        extraction.Params[name] = value
+        extraction.Sources[name] = source
+    }
+
+    ruleValues := extractByRules(schema, intent)
+    for _, name := range sortedPropertyNames(schema) {
+        if value, found := ruleValues[name]; found {
+            accept(name, value, paramFromRule)
+        }
+    }
+
+    askLLM := false
+    switch mode {
+    case extractAuto:
+        askLLM = len(missingParams(schema, extraction.Params)) > 0
+    case extractLLM:
+        askLLM = len(extraction.Params) < len(schema.Properties)
+    }
+    if askLLM {
+        llmValues, err := extractWithLLM(project, schema, intent, extraction.Params)
+        if err != nil {
+            log.Printf("LLM parameter extraction failed for intent '%s': %v", intent, err)
+            extraction.LLM = fmt.Sprintf("fallback failed: %v", err)
+        } else {
+            extraction.LLM = "used"
+            for _, name := range sortedPropertyNames(schema) {
+                if _, have := extraction.Params[name]; have {
+                    continue
+                }
+                if value, found := llmValues[name]; found && value != nil {
+                    accept(name, value, paramFromLLM)
+                }
+            }
+        }
+    }
+
+    for name, property := range schema.Properties {
+        if _, have := extraction.Params[name]; !have && property.Default != nil {
+            extraction.Params[name] = property.Default
+            extraction.Sources[name] = paramFromDefault
+        }
+    }
+    extraction.Missing = missingParams(schema, extraction.Params)
+    extraction.Valid = len(extraction.Missing) == 0 && len(extraction.Errors) == 0
+    return extraction
+}
+
+// parseExtractMode reads the extract query parameter, rules when empty, so Ollama is only
+// called when asked for
+func parseExtractMode(raw string) (string, error) {
+    switch raw {
+    case "":
+        return extractRules, nil
+    case extractRules, extractAuto, extractLLM, extractNone:
+        return raw, nil
+    }
+    return "", fmt.Errorf("Invalid 'extract' parameter: must be %s, %s, %s or %s", extractRules, extractAuto, extractLLM, extractNone)
+}
+
+func sortedPropertyNames(schema *ParamSchema) []string {
+    names := make([]string, 0, len(schema.Properties))
+    for name := range schema.Properties {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func (s *ParamSchema) isRequired(name string) bool {
+    for _, required := range s.Required {
+        if required == name {
+            return true
+        }
+    }
+    return false
+}
+
+func missingParams(schema *ParamSchema, params map[string]interface{}) []string {
+    var missing []string
+    for _, name := range schema.Required {
+        if _, have := params[name]; !have {
+            missing = append(missing, name)
+        }
+    }
+    return missing
+}
+
+// paramCandidate is a value found in the intent text, with its byte span
+type paramCandidate struct {
+    value      interface{}
+    start, end int
+}
+
+// Kinds of value the rules look for
+const (
+    kindDate    = "date"
+    kindTicker  = "ticker"
+    kindRepo    = "repo"
+    kindNumber  = "number"
+    kindEnum    = "enum"
+    kindBoolean = "boolean"
+    kindPattern = "pattern"
+)
+
+// valueKind is what the rules look for to fill a property, or its array items
+func valueKind(schema *ParamSchema) string {
+    if schema.Type == "array" {
+        return valueKind(schema.Items)
+    }
+    switch {
+    case len(schema.Enum) > 0:
+        return kindEnum
+    case schema.Format == formatDate:
+        return kindDate
+    case schema.Format == formatTicker:
+        return kindTicker
+    case schema.Format == formatRepo:
+        return kindRepo
+    case schema.Type == "number" || schema.Type == "integer":
+        return kindNumber
+    case schema.Type == "boolean":
+        return kindBoolean
+    case schema.Pattern != "":
+        return kindPattern
+    }
+    return ""
+}
+
+// extractByRules fills what it can of the schema from the intent text. A candidate value
+// goes to the property named just before it, as in "since 2024-05-01" or "threshold 0.8";
+// otherwise to the only property, or only required property, still wanting that kind of
+// value. ISO dates are set aside first, with or without a date property, so "2024-05-01"
+// never becomes the numbers 2024, -5 and -1.
+func extractByRules(schema *ParamSchema, intent string) map[string]interface{} {
+    values := make(map[string]interface{})
+    names := sortedPropertyNames(schema)
+    lower := strings.ToLower(intent)
+    var consumed, dates [][2]int
+    for _, span := range isoDatePattern.FindAllStringIndex(intent, -1) {
+        dates = append(dates, [2]int{span[0], span[1]})
+    }
+    overlaps := func(c paramCandidate, spans [][2]int) bool {
+        for _, span := range spans {
+            if c.start < span[1] && span[0] < c.end {
+                return true
+            }
+        }
+        return false
+    }
+
+    for _, kind := range []string{kindDate, kindTicker, kindRepo, kindNumber} {
+        var wanting []string
+        for _, name := range names {
+            if valueKind(schema.Properties[name]) == kind {
+                wanting = append(wanting, name)
+            }
+        }
+        if len(wanting) == 0 {
+            continue
+        }
+        var candidates []paramCandidate
+        for _, c := range findCandidates(kind, intent, schema, wanting) {
+            if !overlaps(c, consumed) && (kind == kindDate || !overlaps(c, dates)) {
+                candidates = append(candidates, c)
+            }
+        }
+        taken := make([]bool, len(candidates))
+        take := func(name string, i int) {
+            taken[i] = true
+            consumed = append(consumed, [2]int{candidates[i].start, candidates[i].end})
+            property := schema.Properties[name]
+            if property.Type == "array" {
+                list, _ := values[name].([]interface{})
+                values[name] = append(list, candidates[i].value)
+            } else {
+                values[name] = candidates[i].value
+            }
+        }
+
+        // Named just before the value
+        for _, name := range wanting {
+            for i, c := range candidates {
+                if !taken[i] && namedBefore(lower, c.start, name) {
+                    take(name, i)
+                    if schema.Properties[name].Type != "array" {
+                        break
+                    }
+                }
+            }
+        }
+        // The only property left wanting this kind, or else the only required one, takes the
+        // first value left, or all of them for an array
+        var left, required []string
+        for _, name := range wanting {
+            if _, have := values[name]; !have {
+                left = append(left, name)
+                if schema.isRequired(name) {
+                    required = append(required, name)
+                }
+            }
+        }
+        if len(left) > 1 {
+            left = required
+        }
+        if len(left) == 1 {
+            for i := range candidates {
+                if !taken[i] {
+                    take(left[0], i)
+                    if schema.Properties[left[0]].Type != "array" {
+                        break
+                    }
+                }
+            }
+        }
+    }
+
+    for _, name := range names {
+        property := schema.Properties[name]
+        scalar := property
+        if property.Type == "array" {
+            scalar = property.Items
+        }
+        var value interface{}
+        found := false
+        switch valueKind(property) {
+        case kindEnum:
+            value, found = findEnum(scalar, lower)
+        case kindBoolean:
+            value, found = findBoolean(name, lower)
+        case kindPattern:
+            if match := scalar.pattern.FindString(intent); match != "" {
+                value, found = match, true
+            }
+        }
+        if !found {
+            continue
+        }
+        if property.Type == "array" {
+            value = []interface{}{value}
+        }
+        values[name] = value
+    }
+    return values
+}
+
+// findCandidates returns the values of a kind in the intent, in order of appearance
+func findCandidates(kind, intent string, schema *ParamSchema, wanting []string) []paramCandidate {
+    var candidates []paramCandidate
+    add := func(value interface{}, span []int) {
+        candidates = append(candidates, paramCandidate{value: value, start: span[0], end: span[1]})
+    }
+    switch kind {
+    case kindDate:
+        for _, span := range isoDatePattern.FindAllStringIndex(intent, -1) {
+            add(intent[span[0]:span[1]], span)
+        }
+        now := time.Now()
+        for _, match := range daysAgoPattern.FindAllStringSubmatchIndex(intent, -1) {
+            digits := match[2:4]
+            if digits[0] < 0 {
+                digits = match[4:6]
+            }
+            days, _ := strconv.Atoi(intent[digits[0]:digits[1]])
+            add(now.AddDate(0, 0, -days).Format("2006-01-02"), match[:2])
+        }
+        for _, span := range relativePattern.FindAllStringIndex(intent, -1) {
+            date := now
+            switch strings.ToLower(intent[span[0]:span[1]]) {
+            case "yesterday":
+                date = now.AddDate(0, 0, -1)
+            case "tomorrow":
+                date = now.AddDate(0, 0, 1)
+            case "last week":
+                date = now.AddDate(0, 0, -7)
+            case "last month":
+                date = now.AddDate(0, -1, 0)
+            case "last year":
+                date = now.AddDate(-1, 0, 0)
+            }
+            add(date.Format("2006-01-02"), span)
+        }
+    case kindTicker:
+        for _, match := range dollarTicker.FindAllStringSubmatchIndex(intent, -1) {
+            add(strings.ToUpper(intent[match[2]:match[3]]), match[:2])
+        }
+        for _, span := range capsTicker.FindAllStringIndex(intent, -1) {
+            if word := intent[span[0]:span[1]]; !tickerStopwords[word] && (span[0] == 0 || intent[span[0]-1] != '$') {
+                add(word, span)
+            }
+        }
+    case kindRepo:
+        for _, span := range repoPattern.FindAllStringIndex(intent, -1) {
+            if word := intent[span[0]:span[1]]; strings.IndexFunc(word, func(r rune) bool { return (r < '0' || r > '9') && r != '/' }) >= 0 {
+                add(word, span)
+            }
+        }
+        projects := knownProjectNames()
+        for _, span := range projectWord.FindAllStringIndex(intent, -1) {
+            if projects[strings.ToLower(intent[span[0]:span[1]])] {
+                add(intent[span[0]:span[1]], span)
+            }
+        }
+    case kindNumber:
+        percentScale := false
+        for _, name := range wanting {
+            property := schema.Properties[name]
+            if property.Type == "array" {
+                property = property.Items
+            }
+            if property.Maximum != nil && *property.Maximum <= 1 {
+                percentScale = true
+            }
+        }
+        for _, match := range numberPattern.FindAllStringSubmatchIndex(intent, -1) {
+            span := match[2:4]
+            if span[0] < 0 {
+                span = match[4:6]
+            }
+            text := intent[span[0]:span[1]]
+            percent := strings.HasSuffix(text, "%")
+            value, err := strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64)
+            if err != nil {
+                continue
+            }
+            if percent && percentScale {
+                value /= 100
+            }
+            add(value, span)
+        }
+    }
+    sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].start < candidates[j].start })
+    return candidates
+}
+
+// namedBefore reports whether the property's name, with underscores and dashes read as
+// spaces, ends within a few characters before the candidate
+func namedBefore(lower string, start int, name string) bool {
+    words := strings.ToLower(strings.NewReplacer("_", " ", "-", " ").Replace(name))
+    window := lower[:start]
+    if len(window) > len(words)+12 {
+        window = window[len(window)-len(words)-12:]
+    }
+    return strings.Contains(window, words)
+}
+
+// findEnum returns the first allowed value mentioned in the intent
+func findEnum(property *ParamSchema, lower string) (interface{}, bool) {
+    best, bestAt := interface{}(nil), -1
+    for i, allowed := range property.Enum {
+        if span := property.enumPatterns[i].FindStringIndex(lower); span != nil && (bestAt < 0 || span[0] < bestAt) {
+            best, bestAt = allowed, span[0]
+        }
+    }
+    return best, bestAt >= 0
+}
+
+// findBoolean sets a flag the intent mentions by name, to false when it is negated
+func findBoolean(name, lower string) (bool, bool) {
+    words := strings.ToLower(strings.NewReplacer("_", " ", "-", " ").Replace(name))
+    at := strings.Index(lower, words)
+    if at < 0 {
+        return false, false
+    }
+    for _, prefix := range negationPrefixes {
+        if strings.HasSuffix(lower[:at], prefix) {
+            return false, true
+        }
+    }
+    return true, true
+}
+
+// knownProjectNames lists the project directories under PROJECT_PATHS, lowercased
+func knownProjectNames() map[string]bool {
+    names := make(map[string]bool)
+    basePaths, err := projectBasePaths()
+    if err != nil {
+        return names
+    }
+    for _, basePath := range basePaths {
+        entries, err := ioutil.ReadDir(basePath)
+        if err != nil {
+            continue
+        }
+        for _, entry := range entries {
+            if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+                names[strings.ToLower(entry.Name())] = true
+            }
+        }
+    }
+    return names
+}
+
+// extractWithLLM asks Ollama for the parameters the rules have not found
+func extractWithLLM(project string, schema *ParamSchema, intent string, found map[string]interface{}) (map[string]interface{}, error) {
+    schemaJSON, err := json.Marshal(schema)
+    if err != nil {
+        return nil, err
+    }
+    foundJSON, err := json.Marshal(found)
+    if err != nil {
+        return nil, err
+    }
+    prompt := fmt.Sprintf("Extract the parameters for project %s from this request: %q\n\n"+
+        "The parameters follow this JSON schema:\n%s\n\n"+
+        "Already extracted: %s\n\n"+
+        "Today is %s. Write dates as YYYY-MM-DD and tickers in upper case. "+
+        "Reply with JSON only: an object holding the schema's properties, leaving out any the request does not state.\n",
+        project, intent, schemaJSON, foundJSON, time.Now().Format("2006-01-02"))
+    reply, err := CallOllamaLLM(prompt)
+    if err != nil {
+        return nil, err
+    }
+    start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+    if start < 0 || end < start {
+        return nil, fmt.Errorf("no JSON object in reply")
+    }
+    var values map[string]interface{}
+    if err := json.Unmarshal([]byte(reply[start:end+1]), &values); err != nil {
+        return nil, fmt.Errorf("invalid JSON in reply: %v", err)
+    }
+    for name := range values {
+        if _, defined := schema.Properties[name]; !defined {
+            delete(values, name)
+        }
+    }
+    return values, nil
+}
+
+// GetParamSchemaHandler returns the parameter schema used for a project
+func GetParamSchemaHandler(w http.ResponseWriter, r *http.Request) {
+    project := mux.Vars(r)["project"]
+    schema, err := LoadParamSchema(project)
+    if err == errSchemaNotFound {
+        http.Error(w, fmt.Sprintf("No parameter schema for project %q", project), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(schema)
+}
+
+// PutParamSchemaHandler stores a project's parameter schema, replacing any stored before
+func PutParamSchemaHandler(w http.ResponseWriter, r *http.Request) {
+    project := mux.Vars(r)["project"]
+    log.Printf("Handling request to set the parameter schema of project %s", project)
+    var schema ParamSchema
+    if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if err := SaveParamSchema(project, &schema); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid schema: %v", err), http.StatusBadRequest)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(schema)
+}
+
+// DeleteParamSchemaHandler removes a project's stored parameter schema
+func DeleteParamSchemaHandler(w http.ResponseWriter, r *http.Request) {
+    project := mux.Vars(r)["project"]
+    log.Printf("Handling request to delete the parameter schema of project %s", project)
+    if err := DeleteParamSchema(project); err == errSchemaNotFound {
+        http.Error(w, fmt.Sprintf("No stored parameter schema for project %q", project), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ExtractParamsHandler fills a project's parameter schema from an intent without mapping
+// it. Query parameters: project, intent and extract (rules, auto or llm).
+func ExtractParamsHandler(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    project, intent := query.Get("project"), query.Get("intent")
+    if project == "" || intent == "" {
+        http.Error(w, "'project' and 'intent' are required", http.StatusBadRequest)
+        return
+    }
+    mode, err := parseExtractMode(query.Get("extract"))
+    if err != nil || mode == extractNone {
+        http.Error(w, fmt.Sprintf("Invalid 'extract' parameter: must be %s, %s or %s", extractRules, extractAuto, extractLLM), http.StatusBadRequest)
+        return
+    }
+    schema, err := LoadParamSchema(project)
+    if err == errSchemaNotFound {
+        http.Error(w, fmt.Sprintf("No parameter schema for project %q", project), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(ExtractParams(project, schema, intent, mode))
+}
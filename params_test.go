@@ -0,0 +1,175 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+)
+
+func testSchema(t *testing.T, raw string) *ParamSchema {
+    t.Helper()
+    var schema ParamSchema
+    if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+        t.Fatal(err)
+    }
+    if err := schema.check(); err != nil {
+        t.Fatalf("check(%s): %v", raw, err)
+    }
+    return &schema
+}
+
+func TestExtractByRules(t *testing.T) {
+    // No project directories, so repo values come from the owner/name pattern only
+    t.Setenv("PROJECT_PATHS", t.TempDir())
+    tests := []struct {
+        schema string
+        intent string
+        want   string
+    }{
+        {
+            `{"type": "object", "properties": {"since": {"type": "string", "format": "date"}, "until": {"type": "string", "format": "date"}}}`,
+            "prices since 2024-05-01 until 2024-06-30",
+            "map[since:2024-05-01 until:2024-06-30]",
+        },
+        {
+            // Without a date property the date's digits are still not numbers
+            `{"type": "object", "properties": {"limit": {"type": "integer"}}}`,
+            "news from 2024-05-01",
+            "map[]",
+        },
+        {
+            `{"type": "object", "properties": {"limit": {"type": "integer"}, "threshold": {"type": "number", "maximum": 1}}}`,
+            "news from 2024-05-01 threshold 80% limit 20",
+            "map[limit:20 threshold:0.8]",
+        },
+        {
+            // A dash inside a word is not a minus sign
+            `{"type": "object", "properties": {"limit": {"type": "integer"}, "offset": {"type": "integer"}}}`,
+            "top-5 stories with offset -3",
+            "map[limit:5 offset:-3]",
+        },
+        {
+            `{"type": "object", "properties": {"tickers": {"type": "array", "items": {"type": "string", "format": "ticker"}}}}`,
+            "compare $aapl with MSFT and the S&P",
+            "map[tickers:[AAPL MSFT]]",
+        },
+        {
+            `{"type": "object", "properties": {"repo": {"type": "string", "format": "repo"}}}`,
+            "scan gorilla/mux for TODOs",
+            "map[repo:gorilla/mux]",
+        },
+        {
+            `{"type": "object", "properties": {"interval": {"type": "string", "enum": ["daily", "weekly"]}, "sources": {"type": "array", "items": {"type": "string", "enum": ["reuters", "bloomberg"]}}}}`,
+            "weekly digest from Bloomberg, not daily",
+            "map[interval:weekly sources:[bloomberg]]",
+        },
+        {
+            `{"type": "object", "properties": {"dry_run": {"type": "boolean"}, "verbose": {"type": "boolean"}}}`,
+            "deploy without dry run, verbose",
+            "map[dry_run:false verbose:true]",
+        },
+        {
+            `{"type": "object", "properties": {"issue": {"type": "string", "pattern": "#[0-9]+"}, "labels": {"type": "array", "items": {"type": "string", "pattern": "bug|feature"}}}}`,
+            "triage #42 as a bug",
+            "map[issue:#42 labels:[bug]]",
+        },
+    }
+    for _, test := range tests {
+        schema := testSchema(t, test.schema)
+        if got := fmt.Sprint(extractByRules(schema, test.intent)); got != test.want {
+            t.Errorf("extractByRules(%q) = %s, want %s", test.intent, got, test.want)
+        }
+    }
+}
+
+func TestValidateParam(t *testing.T) {
+    schema := testSchema(t, `{"type": "object", "properties": {
+        "since": {"type": "string", "format": "date"},
+        "ticker": {"type": "string", "format": "ticker"},
+        "code": {"type": "string", "pattern": "^[a-z]{3}$"},
+        "limit": {"type": "integer", "minimum": 1, "maximum": 100},
+        "mode": {"type": "string", "enum": ["fast", "full"]},
+        "tags": {"type": "array", "items": {"type": "string"}}
+    }}`)
+    tests := []struct {
+        name  string
+        value interface{}
+        valid bool
+    }{
+        {"since", "2024-05-01", true},
+        {"since", "2024-13-01", false},
+        {"ticker", "BRK.B", true},
+        {"ticker", "brk", false},
+        {"code", "abc", true},
+        {"code", "abcd", false},
+        {"limit", float64(10), true},
+        {"limit", 2.5, false},
+        {"limit", float64(0), false},
+        {"limit", float64(101), false},
+        {"limit", "10", false},
+        {"mode", "full", true},
+        {"mode", "slow", false},
+        {"tags", []interface{}{"a", "b"}, true},
+        {"tags", []interface{}{"a", 1.0}, false},
+        {"tags", "a", false},
+    }
+    for _, test := range tests {
+        err := validateParam(schema.Properties[test.name], test.value)
+        if (err == nil) != test.valid {
+            t.Errorf("validateParam(%s, %v) = %v, want valid %v", test.name, test.value, err, test.valid)
+        }
+    }
+}
+
+func TestParamSchemaCheck(t *testing.T) {
+    for _, raw := range []string{
+        `{"type": "array", "items": {"type": "string"}}`,
+        `{"type": "object"}`,
+        `{"type": "object", "properties": {"a": {"type": "object"}}}`,
+        `{"type": "object", "properties": {"a": {"type": "array"}}}`,
+        `{"type": "object", "properties": {"a": {"type": "string", "format": "email"}}}`,
+        `{"type": "object", "properties": {"a": {"type": "string", "pattern": "("}}}`,
+        `{"type": "object", "properties": {"a": {"type": "integer", "minimum": 5, "default": 1}}}`,
+        `{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["b"]}`,
+    } {
+        var schema ParamSchema
+        if err := json.Unmarshal([]byte(raw), &schema); err != nil {
+            t.Fatal(err)
+        }
+        if err := schema.check(); err == nil {
+            t.Errorf("check(%s) succeeded, want an error", raw)
+        }
+    }
+}
+
+func TestExtractParamsWithRules(t *testing.T) {
+    t.Setenv("PROJECT_PATHS", t.TempDir())
+    schema := testSchema(t, `{"type": "object", "properties": {
+        "ticker": {"type": "string", "format": "ticker"},
+        "days": {"type": "integer", "maximum": 30, "default": 7},
+        "since": {"type": "string", "format": "date"}
+    }, "required": ["ticker", "since"]}`)
+
+    extraction := ExtractParams("stocks", schema, "forecast $TSLA days 90", extractRules)
+    if extraction.Params["ticker"] != "TSLA" || extraction.Sources["ticker"] != paramFromRule {
+        t.Errorf("ticker = %v from %s", extraction.Params["ticker"], extraction.Sources["ticker"])
+    }
+    // 90 breaks the maximum, so it is reported and the default is used
+    if extraction.Params["days"] != float64(7) || extraction.Sources["days"] != paramFromDefault || len(extraction.Errors) != 1 {
+        t.Errorf("days = %v from %s with errors %v", extraction.Params["days"], extraction.Sources["days"], extraction.Errors)
+    }
+    if fmt.Sprint(extraction.Missing) != "[since]" || extraction.Valid || extraction.LLM != "" {
+        t.Errorf("extraction = %+v, want since missing, invalid and no LLM call", extraction)
+    }
+}
+
+func TestParseExtractMode(t *testing.T) {
+    for raw, want := range map[string]string{"": extractRules, "rules": extractRules, "auto": extractAuto, "llm": extractLLM, "none": extractNone} {
+        if got, err := parseExtractMode(raw); err != nil || got != want {
+            t.Errorf("parseExtractMode(%q) = %q, %v, want %q", raw, got, err, want)
+        }
+    }
+    if _, err := parseExtractMode("ollama"); err == nil {
+        t.Error("an unknown mode was accepted")
+    }
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "math"
+    "time"
+)
+
+// Vector quantisation modes selectable with VECTOR_QUANTIZATION
+const (
+    quantizationNone = "none"
+    quantizationInt8 = "int8"
+)
+
+// Recall states of QuantizationStats. Indexes are measured in the background after they are
+// built, so the recall fields stay empty until the first measurement finishes.
+const (
+    recallNotMeasured = "not yet measured"
+    recallMeasured    = "measured"
+)
+
+// int8Vector is a symmetric scalar quantisation of a vector: component i is codes[i] * scale
+type int8Vector struct {
+    codes []int8
+    scale float32
+}
+
+// quantizeInt8 maps the largest component magnitude to 127
+func quantizeInt8(vector []float32) int8Vector {
+    var maxAbs float32
+    for _, value := range vector {
+        if value > maxAbs {
+            maxAbs = value
+        } else if -value > maxAbs {
+            maxAbs = -value
+        }
+    }
+    quantized := int8Vector{codes: make([]int8, len(vector))}
+    if maxAbs == 0 {
+        return quantized
+    }
+    quantized.scale = maxAbs / 127
+    for i, value := range vector {
+        quantized.codes[i] = int8(math.Round(float64(value / quantized.scale)))
+    }
+    return quantized
+}
+
+// dotInt8 approximates the dot product of the original vectors from their codes
+func dotInt8(a, b int8Vector) float64 {
+    var sum int32
+    for i := range a.codes {
+        sum += int32(a.codes[i]) * int32(b.codes[i])
+    }
+    return float64(sum) * float64(a.scale) * float64(b.scale)
+}
+
+// QuantizationStats reports what int8 quantisation costs in memory and recall. The float32
+// vectors stay in memory, shared between the store and the index, for rescoring the top
+// candidates, so the int8 codes come on top of them: MemoryOverheadBytes is what they add.
+// Traversal scans the smaller codes, which is where quantisation saves time. RecallStatus
+// tells a loss of zero from one that has not been measured yet.
+type QuantizationStats struct {
+    Mode                string    `json:"mode"`
+    RecallStatus        string    `json:"recallStatus,omitempty"`
+    Oversample          int       `json:"oversample,omitempty"`
+    Float32Bytes        int64     `json:"float32Bytes"`
+    Int8Bytes           int64     `json:"int8Bytes,omitempty"`
+    MemoryOverheadBytes int64     `json:"memoryOverheadBytes,omitempty"`
+    RecallFloat32       float64   `json:"recallFloat32,omitempty"`
+    RecallInt8          float64   `json:"recallInt8,omitempty"`
+    RecallLoss          float64   `json:"recallLoss,omitempty"`
+    RecallK             int       `json:"recallK,omitempty"`
+    MeasuredAt          time.Time `json:"measuredAt,omitempty"`
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Re-ranking modes of /map-intent: llm always asks the model, auto only when the top two
+// candidates are too close to call
+const (
+    rerankLLM  = "llm"
+    rerankAuto = "auto"
+)
+
+const (
+    // defaultRerankMargin is the margin below which auto re-ranking asks the model, for
+    // collections without a minimum margin of their own
+    defaultRerankMargin = 0.05
+    // maxSummaryChars bounds the README summary given to the model for each project
+    maxSummaryChars = 600
+    // maxPromptEntryPoints bounds the entry points listed for each project
+    maxPromptEntryPoints = 10
+)
+
+// LLMRerank reports the re-ranking step. When the model could not be asked or its reply
+// could not be used, Fallback is set, Reason says why and the vector order is kept.
+type LLMRerank struct {
+    Applied  bool   `json:"applied"`
+    Fallback bool   `json:"fallback,omitempty"`
+    Reason   string `json:"reason,omitempty"`
+    Model    string `json:"model,omitempty"`
+    // Choice is the ID of the candidate the model picked
+    Choice    string `json:"choice,omitempty"`
+    Rationale string `json:"rationale,omitempty"`
+    Duration  string `json:"duration,omitempty"`
+}
+
+// ProjectContext is what the model is told about a candidate's project
+type ProjectContext struct {
+    Summary     string
+    EntryPoints []string
+}
+
+// rerankReply is the JSON the model is asked to answer with; candidates are numbered from 1
+type rerankReply struct {
+    Ranking   []int  `json:"ranking"`
+    Best      int    `json:"best"`
+    Rationale string `json:"rationale"`
+}
+
+// RerankWithLLM asks the Ollama model which candidate best serves the intent, giving it
+// each project's README summary and entry points, and returns the candidates in the
+// model's order. Any failure returns the candidates unchanged with Fallback set.
+func RerankWithLLM(intent string, candidates []IntentCandidate) ([]IntentCandidate, LLMRerank) {
+    rerank := LLMRerank{Model: ollamaLLMModel()}
+    if len(candidates) < 2 {
+        rerank.Reason = "fewer than two candidates to re-rank"
+        return candidates, rerank
+    }
+
+    start := time.Now()
+    reply, err := CallOllamaLLM(rerankPrompt(intent, candidates, loadProjectContexts(candidates)))
+    rerank.Duration = time.Since(start).String()
+    if err != nil {
+        log.Printf("LLM re-ranking failed for intent '%s', keeping the vector order: %v", intent, err)
+        rerank.Fallback = true
+        rerank.Reason = fmt.Sprintf("error calling Ollama: %v", err)
+        return candidates, rerank
+    }
+    order, rationale, err := parseRerankReply(reply, len(candidates))
+    if err != nil {
+        log.Printf("Unusable LLM re-ranking reply for intent '%s', keeping the vector order: %v", intent, err)
+        rerank.Fallback = true
+        rerank.Reason = fmt.Sprintf("unusable reply: %v", err)
+        return candidates, rerank
+    }
+
+    reranked := make([]IntentCandidate, len(order))
+    for i, n := range order {
+        reranked[i] = candidates[n]
+    }
+    rerank.Applied = true
+    rerank.Choice = reranked[0].ID
+    rerank.Rationale = rationale
+    log.Printf("LLM re-ranking picked project %s for intent '%s'", reranked[0].Project, intent)
+    return reranked, rerank
+}
+
+// rerankPrompt lists the numbered candidates with their projects' context once each
+func rerankPrompt(intent string, candidates []IntentCandidate, contexts map[string]ProjectContext) string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "A user asked: %q\n\n", intent)
+    b.WriteString("Which of these candidates best serves the request? Each matched a stored intent of a project.\n\n")
+    for i, candidate := range candidates {
+        fmt.Fprintf(&b, "%d. project %s, matched intent %q (similarity %.3f)\n", i+1, candidate.Project, candidate.Intent, candidate.Similarity)
+    }
+
+    b.WriteString("\nProjects:\n")
+    described := make(map[string]bool)
+    for _, candidate := range candidates {
+        if described[candidate.Project] {
+            continue
+        }
+        described[candidate.Project] = true
+        context := contexts[candidate.Project]
+        fmt.Fprintf(&b, "\n%s\n", candidate.Project)
+        if context.Summary != "" {
+            fmt.Fprintf(&b, "  Summary: %s\n", context.Summary)
+        } else {
+            b.WriteString("  Summary: none available\n")
+        }
+        if len(context.EntryPoints) > 0 {
+            fmt.Fprintf(&b, "  Entry points: %s\n", strings.Join(context.EntryPoints, ", "))
+        }
+    }
+
+    b.WriteString("\nReply with JSON only, in the form ")
+    b.WriteString(`{"ranking": [candidate numbers, best first], "best": <candidate number>, "rationale": "<one or two sentences>"}`)
+    b.WriteString("\n")
+    return b.String()
+}
+
+// parseRerankReply extracts the JSON object from the model's reply and returns the
+// candidate positions, best first. Candidates the model left out follow in vector order.
+func parseRerankReply(reply string, n int) ([]int, string, error) {
+    start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+    if start < 0 || end < start {
+        return nil, "", fmt.Errorf("no JSON object in reply")
+    }
+    var parsed rerankReply
+    if err := json.Unmarshal([]byte(reply[start:end+1]), &parsed); err != nil {
+        return nil, "", fmt.Errorf("invalid JSON in reply: %v", err)
+    }
+    if parsed.Best == 0 && len(parsed.Ranking) > 0 {
+        parsed.Best = parsed.Ranking[0]
+    }
+    if parsed.Best < 1 || parsed.Best > n {
+        return nil, "", fmt.Errorf("best candidate %d is not between 1 and %d", parsed.Best, n)
+    }
+
+    seen := make([]bool, n)
+    order := make([]int, 0, n)
+    for _, number := range append([]int{parsed.Best}, parsed.Ranking...) {
+        if number >= 1 && number <= n && !seen[number-1] {
+            seen[number-1] = true
+            order = append(order, number-1)
+        }
+    }
+    for i := range seen {
+        if !seen[i] {
+            order = append(order, i)
+        }
+    }
+    return order, strings.TrimSpace(parsed.Rationale), nil
+}
+
+// loadProjectContexts finds each candidate project's directory under the project base
+// paths and reads its README summary and entry points. Projects without a directory get
+// an empty context.
+func loadProjectContexts(candidates []IntentCandidate) map[string]ProjectContext {
+    contexts := make(map[string]ProjectContext)
+    basePaths, err := projectBasePaths()
+    if err != nil {
+        log.Printf("Re-ranking without project context: %v", err)
+        return contexts
+    }
+    for _, candidate := range candidates {
+        if _, done := contexts[candidate.Project]; done || candidate.Project == "" {
+            continue
+        }
+        var context ProjectContext
+        for _, basePath := range basePaths {
+            dir := filepath.Join(basePath, filepath.Base(candidate.Project))
+            if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+                continue
+            }
+            context.Summary = readmeSummary(filepath.Join(dir, "README.md"), maxSummaryChars)
+            context.EntryPoints = findEntryPoints(dir)
+            if len(context.EntryPoints) > maxPromptEntryPoints {
+                context.EntryPoints = context.EntryPoints[:maxPromptEntryPoints]
+            }
+            break
+        }
+        contexts[candidate.Project] = context
+    }
+    return contexts
+}
+
+// readmeSummary returns the opening prose of a README, skipping headings, badges, HTML and
+// code blocks, cut at a word boundary after at most max characters
+func readmeSummary(path string, max int) string {
+    file, err := os.Open(path)
+    if err != nil {
+        return ""
+    }
+    defer file.Close()
+
+    var words []string
+    length := 0
+    inCode := false
+    scanner := bufio.NewScanner(io.LimitReader(file, maxReadmeBytes))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if strings.HasPrefix(line, "```") {
+            inCode = !inCode
+            continue
+        }
+        if inCode || line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "<") ||
+            strings.HasPrefix(line, "![") || strings.HasPrefix(line, "[![") {
+            continue
+        }
+        for _, word := range strings.Fields(line) {
+            if length+len(word)+1 > max {
+                return strings.Join(words, " ") + " ..."
+            }
+            words = append(words, word)
+            length += len(word) + 1
+        }
+    }
+    return strings.Join(words, " ")
+}
+
+// rerankNeeded reports whether auto re-ranking should ask the model: the top two
+// candidates are closer than the collection's minimum margin, or LLM_RERANK_MARGIN
+func rerankNeeded(match IntentMatchResult, t Thresholds) bool {
+    margin := envFloat("LLM_RERANK_MARGIN", defaultRerankMargin)
+    if t.MinMargin != nil {
+        margin = *t.MinMargin
+    }
+    return match.signals.RunnerUp && match.Margin < margin
+}
+
+// resolveAmbiguity withdraws an abstention that was only due to the top two candidates
+// being too close, once the model has chosen between them
+func resolveAmbiguity(match *IntentMatchResult) {
+    var reasons []AbstainReason
+    for _, reason := range match.AbstainReasons {
+        if reason.Code != abstainAmbiguous {
+            reasons = append(reasons, reason)
+        }
+    }
+    match.AbstainReasons = reasons
+    match.Abstained = len(reasons) > 0
+}
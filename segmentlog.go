@@ -0,0 +1,607 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// SegmentLog persists embeddings as an append-only sequence of segment files. Every change
+// is one checksummed record: a put carries the whole embedding, a delete a tombstone with
+// its ID. Replaying the segments in order rebuilds the collection. Sealed segments are
+// compacted in the background into a single segment holding only live records.
+//
+// Record layout, little endian:
+//
+//    uint32 payload length | uint32 CRC-32 of type and payload | byte type | payload
+//
+// A put payload is a uvarint-prefixed JSON document with the embedding's fields except
+// the vector, then a uvarint dimension and the float32 components. A delete payload is the ID.
+// A batch payload is a sequence of uvarint-prefixed put payloads, so a batch is replayed
+// whole or not at all. A compacted segment starts with an empty compacted record, which
+// tells replay to skip every older segment.
+type SegmentLog struct {
+    dir          string
+    maxSegment   int64
+    syncWrites   bool
+    compactRatio float64
+    compactMin   int
+
+    mu         sync.Mutex
+    active     *os.File
+    activeSeq  int
+    activeSize int64
+    // records counts the puts and deletes across all segments, used to decide on compaction
+    records       int
+    sealedRecords int
+    compacting    bool
+}
+
+const (
+    recordPut       byte = 1
+    recordDelete    byte = 2
+    recordBatch     byte = 3
+    recordCompacted byte = 4 // opens a compacted segment, superseding all older ones
+
+    recordHeaderSize = 9
+    maxRecordSize    = 64 << 20
+    segmentSuffix    = ".seg"
+)
+
+// errTornRecord marks a record cut short or failing its checksum
+var errTornRecord = errors.New("torn or corrupt record")
+
+// SegmentLogOptions tunes segment size, durability and compaction
+type SegmentLogOptions struct {
+    MaxSegmentBytes int64
+    SyncWrites      bool
+    // Compaction runs once the log holds CompactRatio times as many records as are live,
+    // and at least CompactMinRecords of them
+    CompactRatio      float64
+    CompactMinRecords int
+}
+
+// DefaultSegmentLogOptions reads SEGMENT_MAX_BYTES, SEGMENT_SYNC_WRITES, SEGMENT_COMPACT_RATIO
+// and SEGMENT_COMPACT_MIN_RECORDS
+func DefaultSegmentLogOptions() SegmentLogOptions {
+    return SegmentLogOptions{
+        MaxSegmentBytes:   int64(envInt("SEGMENT_MAX_BYTES", 64<<20)),
+        SyncWrites:        envString("SEGMENT_SYNC_WRITES", "true") == "true",
+        CompactRatio:      envFloat("SEGMENT_COMPACT_RATIO", 2),
+        CompactMinRecords: envInt("SEGMENT_COMPACT_MIN_RECORDS", 1000),
+    }
+}
+
+// OpenSegmentLog replays the segments in dir and returns the live embeddings in the order
+// they were first written. A torn record at the end of the newest segment, left by a crash
+// mid-write, is truncated away; damage anywhere else is an error.
+func OpenSegmentLog(dir string, opts SegmentLogOptions) (*SegmentLog, []Embedding, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, nil, fmt.Errorf("failed to create segment directory: %v", err)
+    }
+    sequences, err := listSegments(dir)
+    if err != nil {
+        return nil, nil, err
+    }
+    // Leftovers from a compaction interrupted before it was installed
+    leftovers, _ := filepath.Glob(filepath.Join(dir, "compact-*.tmp"))
+    for _, leftover := range leftovers {
+        os.Remove(leftover)
+    }
+
+    l := &SegmentLog{
+        dir:          dir,
+        maxSegment:   opts.MaxSegmentBytes,
+        syncWrites:   opts.SyncWrites,
+        compactRatio: opts.CompactRatio,
+        compactMin:   opts.CompactMinRecords,
+    }
+    // The compacted segment holds no tombstones, so segments a crash left behind from
+    // before it would bring deleted records back. Skip them and finish removing them.
+    for i := len(sequences) - 1; i > 0; i-- {
+        if compactedSegment(l.segmentPath(sequences[i])) {
+            for _, seq := range sequences[:i] {
+                if err := os.Remove(l.segmentPath(seq)); err != nil {
+                    log.Printf("Failed to remove segment %d superseded by compaction: %v", seq, err)
+                }
+            }
+            syncDir(dir)
+            sequences = sequences[i:]
+            break
+        }
+    }
+    state := newReplayState()
+    for i, seq := range sequences {
+        last := i == len(sequences)-1
+        records, err := replaySegment(l.segmentPath(seq), last, state)
+        if err != nil {
+            return nil, nil, err
+        }
+        l.records += records
+    }
+
+    seq := 1
+    if len(sequences) > 0 {
+        seq = sequences[len(sequences)-1]
+    }
+    if err := l.openActive(seq); err != nil {
+        return nil, nil, err
+    }
+    return l, state.live(), nil
+}
+
+// Path returns the segment directory
+func (l *SegmentLog) Path() string {
+    return l.dir
+}
+
+// AppendPut records a new or replaced embedding
+func (l *SegmentLog) AppendPut(embedding Embedding) error {
+    return l.AppendPuts([]Embedding{embedding})
+}
+
+// AppendPuts records several embeddings as one batch record, so a failed or torn write
+// leaves none of them behind
+func (l *SegmentLog) AppendPuts(embeddings []Embedding) error {
+    if len(embeddings) == 0 {
+        return nil
+    }
+    payloads := make([][]byte, len(embeddings))
+    for i, embedding := range embeddings {
+        payload, err := encodePut(embedding)
+        if err != nil {
+            return err
+        }
+        payloads[i] = payload
+    }
+    if len(payloads) == 1 {
+        return l.append(encodeRecord(recordPut, payloads[0]), 1)
+    }
+    batch, err := encodeBatch(payloads)
+    if err != nil {
+        return err
+    }
+    return l.append(encodeRecord(recordBatch, batch), len(payloads))
+}
+
+// AppendDelete records a tombstone for the embedding ID
+func (l *SegmentLog) AppendDelete(id string) error {
+    return l.append(encodeRecord(recordDelete, []byte(id)), 1)
+}
+
+// Close closes the active segment
+func (l *SegmentLog) Close() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.active.Close()
+}
+
+// NeedsCompaction reports whether enough records have been superseded to compact
+func (l *SegmentLog) NeedsCompaction(live int) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return !l.compacting && l.records >= l.compactMin && float64(l.records) >= l.compactRatio*float64(live)
+}
+
+// StartCompaction seals the active segment so new writes go to a fresh one, and returns
+// the last sealed sequence number. live must be exactly the state the sealed segments
+// replay to, so callers hold their write lock across taking it and calling this.
+// Finish with CompactSealed, usually in the background.
+func (l *SegmentLog) StartCompaction() (int, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.compacting {
+        return 0, fmt.Errorf("compaction already running")
+    }
+    sealed := l.activeSeq
+    if err := l.active.Close(); err != nil {
+        return 0, fmt.Errorf("failed to seal segment %d: %v", sealed, err)
+    }
+    if err := l.openActive(sealed + 1); err != nil {
+        return 0, err
+    }
+    l.compacting = true
+    l.sealedRecords = l.records
+    return sealed, nil
+}
+
+// CompactSealed rewrites every segment up to sealed as one segment holding only the live
+// records. The compacted file replaces segment sealed atomically before the older segments
+// are removed; it starts with a compacted record, so replay skips any older segment a
+// crash left behind and every point of a crash replays to the same state.
+func (l *SegmentLog) CompactSealed(sealed int, live []Embedding) error {
+    defer func() {
+        l.mu.Lock()
+        l.compacting = false
+        l.mu.Unlock()
+    }()
+
+    tmp, err := ioutil.TempFile(l.dir, "compact-*.tmp")
+    if err != nil {
+        return fmt.Errorf("failed to create compaction file: %v", err)
+    }
+    defer os.Remove(tmp.Name())
+
+    writer := bufio.NewWriterSize(tmp, 1<<20)
+    if _, err := writer.Write(encodeRecord(recordCompacted, nil)); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to write compaction file: %v", err)
+    }
+    for _, embedding := range live {
+        payload, err := encodePut(embedding)
+        if err == nil {
+            _, err = writer.Write(encodeRecord(recordPut, payload))
+        }
+        if err != nil {
+            tmp.Close()
+            return fmt.Errorf("failed to write compacted record %s: %v", embedding.ID, err)
+        }
+    }
+    if err := writer.Flush(); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to write compaction file: %v", err)
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to sync compaction file: %v", err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("failed to close compaction file: %v", err)
+    }
+
+    if err := os.Rename(tmp.Name(), l.segmentPath(sealed)); err != nil {
+        return fmt.Errorf("failed to install compacted segment: %v", err)
+    }
+    syncDir(l.dir)
+
+    sequences, err := listSegments(l.dir)
+    if err != nil {
+        return err
+    }
+    removed := 0
+    for _, seq := range sequences {
+        if seq < sealed {
+            if err := os.Remove(l.segmentPath(seq)); err != nil {
+                return fmt.Errorf("failed to remove compacted segment %d: %v", seq, err)
+            }
+            removed++
+        }
+    }
+    syncDir(l.dir)
+
+    l.mu.Lock()
+    l.records += len(live) - l.sealedRecords
+    l.mu.Unlock()
+    log.Printf("Compacted %d segments into segment %d with %d live records", removed+1, sealed, len(live))
+    return nil
+}
+
+// append writes an encoded record holding count changes to the active segment, starting a
+// new segment when it is full, and syncs it
+func (l *SegmentLog) append(record []byte, count int) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.activeSize > 0 && l.activeSize+int64(len(record)) > l.maxSegment {
+        if err := l.sync(); err != nil {
+            return err
+        }
+        if err := l.active.Close(); err != nil {
+            return fmt.Errorf("failed to close segment %d: %v", l.activeSeq, err)
+        }
+        if err := l.openActive(l.activeSeq + 1); err != nil {
+            return err
+        }
+    }
+
+    if _, err := l.active.Write(record); err != nil {
+        // Cut off whatever part of the record made it out so the next append starts clean
+        l.active.Truncate(l.activeSize)
+        return fmt.Errorf("failed to append to segment %d: %v", l.activeSeq, err)
+    }
+    if err := l.sync(); err != nil {
+        // The caller is told the write failed, so it must not be replayed either
+        l.active.Truncate(l.activeSize)
+        return err
+    }
+    l.activeSize += int64(len(record))
+    l.records += count
+    return nil
+}
+
+// sync flushes the active segment when writes are synchronous. Callers hold mu.
+func (l *SegmentLog) sync() error {
+    if !l.syncWrites {
+        return nil
+    }
+    if err := l.active.Sync(); err != nil {
+        return fmt.Errorf("failed to sync segment %d: %v", l.activeSeq, err)
+    }
+    return nil
+}
+
+// openActive opens segment seq for appending. Callers hold mu or own the log exclusively.
+func (l *SegmentLog) openActive(seq int) error {
+    file, err := os.OpenFile(l.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open segment %d: %v", seq, err)
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return fmt.Errorf("failed to stat segment %d: %v", seq, err)
+    }
+    syncDir(l.dir)
+    l.active, l.activeSeq, l.activeSize = file, seq, info.Size()
+    return nil
+}
+
+func (l *SegmentLog) segmentPath(seq int) string {
+    return filepath.Join(l.dir, fmt.Sprintf("%08d%s", seq, segmentSuffix))
+}
+
+// listSegments returns the segment sequence numbers in dir, in ascending order
+func listSegments(dir string) ([]int, error) {
+    entries, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list segments: %v", err)
+    }
+    var sequences []int
+    for _, entry := range entries {
+        name := entry.Name()
+        if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+            continue
+        }
+        seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+        if err != nil {
+            continue
+        }
+        sequences = append(sequences, seq)
+    }
+    sort.Ints(sequences)
+    return sequences, nil
+}
+
+// syncDir flushes directory entries so created and renamed files survive a crash
+func syncDir(dir string) {
+    if d, err := os.Open(dir); err == nil {
+        d.Sync()
+        d.Close()
+    }
+}
+
+// replayState applies records in order, remembering when each ID was first seen
+type replayState struct {
+    records map[string]Embedding
+    order   map[string]int
+    next    int
+}
+
+func newReplayState() *replayState {
+    return &replayState{records: make(map[string]Embedding), order: make(map[string]int)}
+}
+
+func (r *replayState) put(embedding Embedding) {
+    if _, exists := r.records[embedding.ID]; !exists {
+        r.order[embedding.ID] = r.next
+        r.next++
+    }
+    r.records[embedding.ID] = embedding
+}
+
+func (r *replayState) delete(id string) {
+    delete(r.records, id)
+    delete(r.order, id)
+}
+
+func (r *replayState) live() []Embedding {
+    live := make([]Embedding, 0, len(r.records))
+    for _, embedding := range r.records {
+        live = append(live, embedding)
+    }
+    sort.Slice(live, func(i, j int) bool {
+        return r.order[live[i].ID] < r.order[live[j].ID]
+    })
+    return live
+}
+
+// replaySegment applies the records of one segment to state and returns how many it read.
+// In the newest segment a torn tail is truncated; elsewhere it is reported as an error.
+func replaySegment(path string, truncateTail bool, state *replayState) (int, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, fmt.Errorf("failed to open segment: %v", err)
+    }
+    defer file.Close()
+
+    reader := bufio.NewReaderSize(file, 1<<20)
+    var offset int64
+    records := 0
+    for {
+        recordType, payload, size, err := readRecord(reader)
+        if err == io.EOF {
+            return records, nil
+        }
+        if err == errTornRecord && truncateTail {
+            log.Printf("Truncating torn record at offset %d of %s", offset, path)
+            if err := os.Truncate(path, offset); err != nil {
+                return records, fmt.Errorf("failed to truncate torn tail of %s: %v", path, err)
+            }
+            return records, nil
+        }
+        if err != nil {
+            return records, fmt.Errorf("segment %s is damaged at offset %d: %v", path, offset, err)
+        }
+
+        switch recordType {
+        case recordPut:
+            embedding, err := decodePut(payload)
+            if err != nil {
+                return records, fmt.Errorf("segment %s has a bad record at offset %d: %v", path, offset, err)
+            }
+            state.put(embedding)
+        case recordDelete:
+            state.delete(string(payload))
+        case recordCompacted:
+            // Marks the start of a compacted segment; it changes nothing itself
+            offset += size
+            continue
+        case recordBatch:
+            embeddings, err := decodeBatch(payload)
+            if err != nil {
+                return records, fmt.Errorf("segment %s has a bad batch at offset %d: %v", path, offset, err)
+            }
+            for _, embedding := range embeddings {
+                state.put(embedding)
+            }
+            records += len(embeddings) - 1
+        default:
+            return records, fmt.Errorf("segment %s has unknown record type %d at offset %d", path, recordType, offset)
+        }
+        offset += size
+        records++
+    }
+}
+
+// compactedSegment reports whether the segment at path was written by a compaction
+func compactedSegment(path string) bool {
+    file, err := os.Open(path)
+    if err != nil {
+        return false
+    }
+    defer file.Close()
+    recordType, _, _, err := readRecord(bufio.NewReader(file))
+    return err == nil && recordType == recordCompacted
+}
+
+// readRecord reads one record, returning io.EOF at a clean end of file
+func readRecord(reader *bufio.Reader) (byte, []byte, int64, error) {
+    header := make([]byte, recordHeaderSize)
+    n, err := io.ReadFull(reader, header)
+    if err == io.EOF {
+        return 0, nil, 0, io.EOF
+    }
+    if err != nil || n < recordHeaderSize {
+        return 0, nil, 0, errTornRecord
+    }
+
+    length := binary.LittleEndian.Uint32(header[0:4])
+    checksum := binary.LittleEndian.Uint32(header[4:8])
+    if length > maxRecordSize {
+        return 0, nil, 0, errTornRecord
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(reader, payload); err != nil {
+        return 0, nil, 0, errTornRecord
+    }
+
+    crc := crc32.NewIEEE()
+    crc.Write(header[8:9])
+    crc.Write(payload)
+    if crc.Sum32() != checksum {
+        return 0, nil, 0, errTornRecord
+    }
+    return header[8], payload, int64(recordHeaderSize) + int64(length), nil
+}
+
+func encodeRecord(recordType byte, payload []byte) []byte {
+    record := make([]byte, recordHeaderSize+len(payload))
+    binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+    record[8] = recordType
+    copy(record[recordHeaderSize:], payload)
+    binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+    return record
+}
+
+// encodeBatch frames put payloads as one batch payload
+func encodeBatch(payloads [][]byte) ([]byte, error) {
+    size := 0
+    for _, payload := range payloads {
+        size += binary.MaxVarintLen64 + len(payload)
+    }
+    if size > maxRecordSize {
+        return nil, fmt.Errorf("batch of %d embeddings exceeds the %d byte record limit", len(payloads), maxRecordSize)
+    }
+    batch := make([]byte, 0, size)
+    buf := make([]byte, binary.MaxVarintLen64)
+    for _, payload := range payloads {
+        batch = append(batch, buf[:binary.PutUvarint(buf, uint64(len(payload)))]...)
+        batch = append(batch, payload...)
+    }
+    return batch, nil
+}
+
+// decodeBatch splits a batch payload and decodes its puts
+func decodeBatch(batch []byte) ([]Embedding, error) {
+    var embeddings []Embedding
+    for len(batch) > 0 {
+        length, n := binary.Uvarint(batch)
+        if n <= 0 || uint64(len(batch)-n) < length {
+            return nil, fmt.Errorf("bad put length")
+        }
+        embedding, err := decodePut(batch[n : n+int(length)])
+        if err != nil {
+            return nil, err
+        }
+        embeddings = append(embeddings, embedding)
+        batch = batch[n+int(length):]
+    }
+    return embeddings, nil
+}
+
+func encodePut(embedding Embedding) ([]byte, error) {
+    vector := embedding.Vector
+    embedding.Vector = nil
+    fields, err := json.Marshal(embedding)
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode embedding %s: %v", embedding.ID, err)
+    }
+
+    payload := make([]byte, 2*binary.MaxVarintLen64+len(fields)+4*len(vector))
+    n := binary.PutUvarint(payload, uint64(len(fields)))
+    n += copy(payload[n:], fields)
+    n += binary.PutUvarint(payload[n:], uint64(len(vector)))
+    for _, value := range vector {
+        binary.LittleEndian.PutUint32(payload[n:], math.Float32bits(value))
+        n += 4
+    }
+    payload = payload[:n]
+    return payload, nil
+}
+
+func decodePut(payload []byte) (Embedding, error) {
+    var embedding Embedding
+    length, n := binary.Uvarint(payload)
+    if n <= 0 || uint64(len(payload)-n) < length {
+        return embedding, fmt.Errorf("bad field length")
+    }
+    if err := json.Unmarshal(payload[n:n+int(length)], &embedding); err != nil {
+        return embedding, fmt.Errorf("bad fields: %v", err)
+    }
+    payload = payload[n+int(length):]
+
+    dimension, n := binary.Uvarint(payload)
+    if n <= 0 || uint64(len(payload)-n) != 4*dimension {
+        return embedding, fmt.Errorf("bad vector length")
+    }
+    payload = payload[n:]
+    embedding.Vector = make([]float32, dimension)
+    for i := range embedding.Vector {
+        embedding.Vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(payload[4*i:]))
+    }
+    return embedding, nil
+}
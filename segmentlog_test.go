@@ -0,0 +1,237 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func testSegmentOptions() SegmentLogOptions {
+    return SegmentLogOptions{MaxSegmentBytes: 1 << 20, SyncWrites: false, CompactRatio: 2, CompactMinRecords: 1000}
+}
+
+func testEmbedding(id string, x float32) Embedding {
+    return Embedding{ID: id, Intent: "intent " + id, Project: "project", Vector: []float32{x, 1, 0}}
+}
+
+func liveIDs(embeddings []Embedding) []string {
+    ids := make([]string, len(embeddings))
+    for i, embedding := range embeddings {
+        ids[i] = embedding.ID
+    }
+    return ids
+}
+
+func TestSegmentLogReplaysPutsAndDeletes(t *testing.T) {
+    dir := t.TempDir()
+    segmentLog, _, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := segmentLog.AppendPuts([]Embedding{testEmbedding("a", 1), testEmbedding("b", 2), testEmbedding("c", 3)}); err != nil {
+        t.Fatal(err)
+    }
+    if err := segmentLog.AppendDelete("b"); err != nil {
+        t.Fatal(err)
+    }
+    if err := segmentLog.AppendPut(testEmbedding("a", 4)); err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.Close()
+
+    segmentLog, live, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer segmentLog.Close()
+    if got := fmt.Sprint(liveIDs(live)); got != "[a c]" {
+        t.Fatalf("replayed IDs %s, want [a c]", got)
+    }
+    if live[0].Vector[0] != 4 {
+        t.Errorf("replayed a with vector %v, want the later put", live[0].Vector)
+    }
+}
+
+func TestSegmentLogTruncatesTornTail(t *testing.T) {
+    dir := t.TempDir()
+    segmentLog, _, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.AppendPut(testEmbedding("a", 1))
+    // A batch cut short by a crash must not be replayed in part
+    segmentLog.AppendPuts([]Embedding{testEmbedding("b", 2), testEmbedding("c", 3)})
+    path := segmentLog.segmentPath(segmentLog.activeSeq)
+    segmentLog.Close()
+
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Truncate(path, info.Size()-5); err != nil {
+        t.Fatal(err)
+    }
+
+    segmentLog, live, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := fmt.Sprint(liveIDs(live)); got != "[a]" {
+        t.Fatalf("replayed IDs %s after a torn batch, want [a]", got)
+    }
+    // The log keeps working after the torn tail is cut off
+    if err := segmentLog.AppendPut(testEmbedding("d", 4)); err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.Close()
+    segmentLog, live, err = OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer segmentLog.Close()
+    if got := fmt.Sprint(liveIDs(live)); got != "[a d]" {
+        t.Fatalf("replayed IDs %s, want [a d]", got)
+    }
+}
+
+func TestSegmentLogRejectsDamageBeforeTheTail(t *testing.T) {
+    dir := t.TempDir()
+    segmentLog, _, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.AppendPut(testEmbedding("a", 1))
+    sealed, err := segmentLog.StartCompaction()
+    if err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.AppendPut(testEmbedding("b", 2))
+    segmentLog.Close()
+
+    // Flip a payload byte of the sealed segment
+    path := filepath.Join(dir, fmt.Sprintf("%08d%s", sealed, segmentSuffix))
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[recordHeaderSize+2] ^= 0xff
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := OpenSegmentLog(dir, testSegmentOptions()); err == nil {
+        t.Fatal("replaying a damaged sealed segment succeeded")
+    }
+}
+
+func TestSegmentLogCompaction(t *testing.T) {
+    dir := t.TempDir()
+    segmentLog, _, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 10; i++ {
+        segmentLog.AppendPut(testEmbedding("a", float32(i)))
+    }
+    segmentLog.AppendPut(testEmbedding("b", 1))
+    sealed, err := segmentLog.StartCompaction()
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Written while the sealed segments are compacted
+    segmentLog.AppendDelete("b")
+    if err := segmentLog.CompactSealed(sealed, []Embedding{testEmbedding("a", 9), testEmbedding("b", 1)}); err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.Close()
+
+    sequences, err := listSegments(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(sequences) != 2 {
+        t.Errorf("%d segments after compaction, want the compacted and the active one", len(sequences))
+    }
+    segmentLog, live, err := OpenSegmentLog(dir, testSegmentOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer segmentLog.Close()
+    if got := fmt.Sprint(liveIDs(live)); got != "[a]" || live[0].Vector[0] != 9 {
+        t.Fatalf("replayed %s %v after compaction, want [a] with the last vector", got, live)
+    }
+}
+
+func TestSegmentLogCrashDuringCompaction(t *testing.T) {
+    dir := t.TempDir()
+    opts := testSegmentOptions()
+    // Every record starts a new segment
+    opts.MaxSegmentBytes = 1
+    segmentLog, _, err := OpenSegmentLog(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.AppendPut(testEmbedding("a", 1))
+    first, err := ioutil.ReadFile(segmentLog.segmentPath(1))
+    if err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.AppendDelete("a")
+    segmentLog.AppendPut(testEmbedding("b", 2))
+    sealed, err := segmentLog.StartCompaction()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := segmentLog.CompactSealed(sealed, []Embedding{testEmbedding("b", 2)}); err != nil {
+        t.Fatal(err)
+    }
+    segmentLog.Close()
+
+    // A crash after the compacted segment was installed but before segment 1 was removed
+    if err := ioutil.WriteFile(segmentLog.segmentPath(1), first, 0644); err != nil {
+        t.Fatal(err)
+    }
+    segmentLog, live, err := OpenSegmentLog(dir, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer segmentLog.Close()
+    if got := fmt.Sprint(liveIDs(live)); got != "[b]" {
+        t.Fatalf("replayed IDs %s after an interrupted compaction, want [b]", got)
+    }
+    if _, err := os.Stat(segmentLog.segmentPath(1)); !os.IsNotExist(err) {
+        t.Errorf("segment 1 superseded by the compaction is still there: %v", err)
+    }
+}
+
+func TestSegmentBackendImportsJSONOnlyOnce(t *testing.T) {
+    dir := t.TempDir()
+    jsonPath := filepath.Join(dir, "embeddings.json")
+    if err := writeJSONFileAtomic(jsonPath, []Embedding{testEmbedding("a", 1), testEmbedding("b", 2)}); err != nil {
+        t.Fatal(err)
+    }
+    backend := &segmentLogBackend{dir: filepath.Join(dir, "segments"), importPath: jsonPath, opts: testSegmentOptions()}
+
+    embeddings, err := backend.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(embeddings) != 2 {
+        t.Fatalf("imported %d embeddings, want 2", len(embeddings))
+    }
+    for _, id := range []string{"a", "b"} {
+        if err := backend.Delete(id, nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    embeddings, err = backend.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(embeddings) != 0 {
+        t.Fatalf("reloading an emptied log gave %d embeddings, want none", len(embeddings))
+    }
+    backend.Remove()
+}
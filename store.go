@@ -0,0 +1,785 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// EmbeddingStore keeps the intent embeddings and their search index in memory and swaps in
+// a fresh copy whenever the backing storage changes or a reload is requested. Changes made
+// through Put and Delete are made durable before they become visible.
+type EmbeddingStore struct {
+    path        string
+    backend     embeddingBackend
+    indexConfig HNSWConfig
+
+    mu sync.RWMutex
+    // dimension is fixed up front, or 0 to take it from the stored embeddings
+    dimension int
+    // model names the embedder of the stored vectors, taken from the first record that
+    // records one, or "" when none does
+    model string
+    // dropped is set once the storage has been deleted
+    dropped bool
+    // embeddings is append-only between reloads; a record's position is its index label.
+    // Replaced and deleted records stay in place and are dropped from labels and the index.
+    embeddings []Embedding
+    labels     map[string]int
+    index      *HNSWIndex
+    // lexical is the BM25 index over the same labels as index
+    lexical    *BM25Index
+    modTime    time.Time
+    loadedAt   time.Time
+    lastError  error
+    lastErrAt  time.Time
+
+    // epoch changes whenever the embeddings are swapped out wholesale, so a background
+    // rebuild of the old ones knows to discard its result
+    epoch int
+    // rebuilding is set while the indexes are rebuilt in the background
+    rebuilding bool
+    rebuilds   sync.WaitGroup
+
+    // reloadMu serialises reloads and writes
+    reloadMu sync.Mutex
+    onReload []func([]Embedding)
+    onWrite  []func()
+}
+
+// errEmbeddingNotFound is returned for operations on an unknown embedding ID
+var errEmbeddingNotFound = errors.New("embedding not found")
+
+// compactionRatio is the share of replaced or deleted slots that triggers an index rebuild
+const compactionRatio = 0.3
+
+// EmbeddingStoreStatus reports the state of the store for the admin endpoints
+type EmbeddingStoreStatus struct {
+    Path      string    `json:"path"`
+    Count     int       `json:"count"`
+    Model     string    `json:"model,omitempty"`
+    LoadedAt  time.Time `json:"loadedAt"`
+    ModTime   time.Time `json:"modTime"`
+    LastError string    `json:"lastError,omitempty"`
+    LastErrAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Sample size used to measure the recall lost to quantisation after each rebuild
+const (
+    quantizationRecallSamples = 100
+    quantizationRecallK       = 10
+)
+
+// NewEmbeddingStore creates a store over the given backend; call Reload to populate it.
+// A dimension of 0 accepts whatever dimension the first embedding has.
+func NewEmbeddingStore(backend embeddingBackend, indexConfig HNSWConfig, dimension int) *EmbeddingStore {
+    return &EmbeddingStore{
+        path:        backend.Path(),
+        backend:     backend,
+        indexConfig: indexConfig,
+        dimension:   dimension,
+        labels:      make(map[string]int),
+        index:       NewHNSWIndex(indexConfig),
+        lexical:     buildLexicalIndex(nil),
+    }
+}
+
+// Embeddings returns the live embeddings in storage order
+func (s *EmbeddingStore) Embeddings() []Embedding {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.liveEmbeddings()
+}
+
+func (s *EmbeddingStore) liveEmbeddings() []Embedding {
+    labels := s.liveLabels()
+    live := make([]Embedding, len(labels))
+    for i, label := range labels {
+        live[i] = s.embeddings[label]
+    }
+    return live
+}
+
+// liveLabels returns the labels of the live embeddings in storage order. Callers hold mu
+// or reloadMu.
+func (s *EmbeddingStore) liveLabels() []int {
+    labels := make([]int, 0, len(s.labels))
+    for label, embedding := range s.embeddings {
+        if current, exists := s.labels[embedding.ID]; exists && current == label {
+            labels = append(labels, label)
+        }
+    }
+    return labels
+}
+
+// Get returns the embedding with the given ID
+func (s *EmbeddingStore) Get(id string) (Embedding, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    label, exists := s.labels[id]
+    if !exists {
+        return Embedding{}, false
+    }
+    return s.embeddings[label], true
+}
+
+// Dimension returns the fixed vector dimension, else that of the stored embeddings, or 0
+// when there are none
+func (s *EmbeddingStore) Dimension() int {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    if s.dimension != 0 {
+        return s.dimension
+    }
+    return s.index.Dimension()
+}
+
+// Model returns the embedder name recorded on the stored vectors, or "" if unknown
+func (s *EmbeddingStore) Model() string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.model
+}
+
+// Metric returns the similarity metric the store is searched with
+func (s *EmbeddingStore) Metric() string {
+    return s.indexConfig.Metric
+}
+
+// prepareVector copies a vector for storage, normalising it under the cosine metric
+func (s *EmbeddingStore) prepareVector(vector []float32) []float32 {
+    vector = append([]float32(nil), vector...)
+    if s.indexConfig.Metric == metricCosine {
+        normalizeFloat32(vector)
+    }
+    return vector
+}
+
+// Snapshot returns the embeddings together with the vector and lexical indexes built over
+// them. The index labels are positions in the embeddings slice, which may include replaced
+// or deleted records; the indexes never return those.
+func (s *EmbeddingStore) Snapshot() ([]Embedding, *HNSWIndex, *BM25Index) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.embeddings, s.index, s.lexical
+}
+
+// LiveSnapshot is Snapshot together with the labels of the live embeddings in storage
+// order, the order Embeddings returns them in
+func (s *EmbeddingStore) LiveSnapshot() ([]Embedding, []int, *HNSWIndex) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.embeddings, s.liveLabels(), s.index
+}
+
+// buildIndex inserts every embedding into a new index. The store has already prepared the
+// vectors and the backend checked that their dimensions agree.
+func buildIndex(embeddings []Embedding, config HNSWConfig) *HNSWIndex {
+    index := NewHNSWIndex(config)
+    for i, embedding := range embeddings {
+        if err := index.Add(i, embedding.Vector); err != nil {
+            log.Printf("Not indexing embedding %d (intent '%s'): %v", i, embedding.Intent, err)
+        }
+    }
+    return index
+}
+
+// Reload reads the backing storage and atomically replaces the in-memory copy.
+// On failure the previous good copy is kept and the error is recorded.
+func (s *EmbeddingStore) Reload() error {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+
+    modTime := s.backend.ModTime()
+    embeddings, err := s.backend.Load()
+    if err != nil {
+        return s.recordError(err)
+    }
+    if len(embeddings) > 0 && s.dimension != 0 && len(embeddings[0].Vector) != s.dimension {
+        return s.recordError(fmt.Errorf("embeddings in %s have dimension %d, expected %d", s.path, len(embeddings[0].Vector), s.dimension))
+    }
+    if s.indexConfig.Metric == metricCosine {
+        for i := range embeddings {
+            normalizeFloat32(embeddings[i].Vector)
+        }
+    }
+    labels, err := assignEmbeddingIDs(embeddings)
+    if err != nil {
+        return s.recordError(fmt.Errorf("invalid embeddings in %s: %v", s.path, err))
+    }
+    model := storedModel(embeddings)
+    if mixed := countOtherModels(embeddings, model); mixed > 0 {
+        log.Printf("Warning: %d embeddings in %s were not produced by %s; re-embed the collection", mixed, s.path, model)
+    }
+
+    index := s.rebuildIndex(embeddings)
+    lexical := buildLexicalIndex(embeddings)
+
+    s.mu.Lock()
+    s.epoch++
+    s.embeddings = embeddings
+    s.labels = labels
+    s.index = index
+    s.lexical = lexical
+    s.model = model
+    s.modTime = modTime
+    s.loadedAt = time.Now()
+    s.lastError = nil
+    s.mu.Unlock()
+
+    log.Printf("Loaded %d intent embeddings from %s", len(embeddings), s.path)
+    for _, fn := range s.onReload {
+        fn(embeddings)
+    }
+    return nil
+}
+
+// rebuildIndex builds a fresh index and starts measuring its quantisation recall, which
+// its QuantizationStats report as not yet measured until the measurement finishes
+func (s *EmbeddingStore) rebuildIndex(embeddings []Embedding) *HNSWIndex {
+    start := time.Now()
+    index := buildIndex(embeddings, s.indexConfig)
+    log.Printf("Built HNSW index over %d embeddings in %s", index.Len(), time.Since(start))
+    go index.MeasureQuantizationRecall(quantizationRecallSamples, quantizationRecallK)
+    return index
+}
+
+// storedModel returns the first model recorded on the embeddings, or ""
+func storedModel(embeddings []Embedding) string {
+    for _, embedding := range embeddings {
+        if embedding.Model != "" {
+            return embedding.Model
+        }
+    }
+    return ""
+}
+
+// countOtherModels counts the embeddings that record a model other than the given one
+func countOtherModels(embeddings []Embedding, model string) int {
+    count := 0
+    for _, embedding := range embeddings {
+        if embedding.Model != "" && embedding.Model != model {
+            count++
+        }
+    }
+    return count
+}
+
+// assignEmbeddingIDs gives every record without an ID a new one and maps IDs to positions.
+// Duplicate IDs are rejected.
+func assignEmbeddingIDs(embeddings []Embedding) (map[string]int, error) {
+    labels := make(map[string]int, len(embeddings))
+    for i := range embeddings {
+        if embeddings[i].ID == "" {
+            embeddings[i].ID = newEmbeddingID()
+        }
+        if previous, exists := labels[embeddings[i].ID]; exists {
+            return nil, fmt.Errorf("embedding %d (intent '%s') reuses ID %q of embedding %d",
+                i, embeddings[i].Intent, embeddings[i].ID, previous)
+        }
+        labels[embeddings[i].ID] = i
+    }
+    return labels, nil
+}
+
+// newEmbeddingID returns a random 16 character hex ID
+func newEmbeddingID() string {
+    buf := make([]byte, 8)
+    if _, err := rand.Read(buf); err != nil {
+        return fmt.Sprintf("%016x", time.Now().UnixNano())
+    }
+    return hex.EncodeToString(buf)
+}
+
+// PutResult is the outcome of storing one embedding of a batch
+type PutResult struct {
+    Embedding Embedding
+    Created   bool
+    Err       error
+}
+
+// Put validates and stores an embedding, replacing any record with the same ID, and makes
+// the change durable before it becomes visible. A record without an ID
+// gets a new one. It reports whether a new record was created.
+func (s *EmbeddingStore) Put(embedding Embedding) (Embedding, bool, error) {
+    result := s.PutBatch([]Embedding{embedding})[0]
+    return result.Embedding, result.Created, result.Err
+}
+
+// PutBatch stores several embeddings like Put with a single durable write. An invalid
+// embedding gets its own error without stopping the others; if the write fails, every
+// valid embedding reports that error. A later record in the batch replaces an earlier one
+// with the same ID. Records must come from the same model as the stored ones.
+func (s *EmbeddingStore) PutBatch(embeddings []Embedding) []PutResult {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+
+    results := make([]PutResult, len(embeddings))
+    dimension := s.Dimension()
+    model := s.Model()
+    valid := make([]Embedding, 0, len(embeddings))
+    positions := make([]int, 0, len(embeddings))
+    for i, embedding := range embeddings {
+        if err := validateEmbedding(embedding, dimension, model); err != nil {
+            results[i] = PutResult{Embedding: embedding, Err: err}
+            continue
+        }
+        embedding.Vector = s.prepareVector(embedding.Vector)
+        if embedding.ID == "" {
+            embedding.ID = newEmbeddingID()
+        }
+        // The first valid record fixes the dimension and model of an empty store for the rest
+        dimension = len(embedding.Vector)
+        if model == "" {
+            model = embedding.Model
+        }
+        valid = append(valid, embedding)
+        positions = append(positions, i)
+    }
+    if len(valid) == 0 {
+        return results
+    }
+
+    err := s.persist(func() error {
+        return s.backend.Put(valid, func() []Embedding {
+            return mergeEmbeddings(s.Embeddings(), valid)
+        })
+    })
+    if err != nil {
+        for j, position := range positions {
+            results[position] = PutResult{Embedding: valid[j], Err: err}
+        }
+        return results
+    }
+
+    type slot struct {
+        label, previous int
+        replaced        bool
+        old             Embedding
+    }
+    slots := make([]slot, len(valid))
+    s.mu.Lock()
+    if s.model == "" {
+        s.model = model
+    }
+    for j, embedding := range valid {
+        previous, exists := s.labels[embedding.ID]
+        label := len(s.embeddings)
+        slots[j] = slot{label, previous, exists, Embedding{}}
+        if exists {
+            slots[j].old = s.embeddings[previous]
+        }
+        s.embeddings = append(s.embeddings, embedding)
+        s.labels[embedding.ID] = label
+        results[positions[j]] = PutResult{Embedding: embedding, Created: !exists}
+    }
+    index, lexical := s.index, s.lexical
+    s.mu.Unlock()
+
+    for j, embedding := range valid {
+        if err := index.Add(slots[j].label, embedding.Vector); err != nil {
+            log.Printf("Error indexing embedding %s: %v", embedding.ID, err)
+        }
+        lexical.Add(slots[j].label, &valid[j])
+        if slots[j].replaced {
+            index.Delete(slots[j].previous)
+            lexical.Delete(slots[j].previous, &slots[j].old)
+        }
+    }
+    s.compactIfNeeded()
+    s.compactStorageIfNeeded()
+    s.notifyWrite()
+    return results
+}
+
+// validateEmbedding checks a record before it is stored; dimension 0 and an empty model
+// accept any
+func validateEmbedding(embedding Embedding, dimension int, model string) error {
+    if err := validateVector(embedding.Vector); err != nil {
+        return fmt.Errorf("invalid vector: %v", err)
+    }
+    if err := validateMetadata(embedding.Metadata); err != nil {
+        return fmt.Errorf("invalid metadata: %v", err)
+    }
+    if dimension != 0 && len(embedding.Vector) != dimension {
+        return fmt.Errorf("vector has dimension %d, stored embeddings have %d", len(embedding.Vector), dimension)
+    }
+    if model != "" && embedding.Model != "" && embedding.Model != model {
+        return fmt.Errorf("vector comes from %s, stored embeddings from %s", embedding.Model, model)
+    }
+    return nil
+}
+
+// mergeEmbeddings returns live with the batch applied: records with a known ID are replaced
+// in place and new ones appended, the last of several with one ID winning
+func mergeEmbeddings(live, batch []Embedding) []Embedding {
+    latest := make(map[string]int, len(batch))
+    for i, embedding := range batch {
+        latest[embedding.ID] = i
+    }
+    for i := range live {
+        if j, exists := latest[live[i].ID]; exists {
+            live[i] = batch[j]
+            delete(latest, live[i].ID)
+        }
+    }
+    for i, embedding := range batch {
+        if j, exists := latest[embedding.ID]; exists && j == i {
+            live = append(live, embedding)
+        }
+    }
+    return live
+}
+
+// Delete removes the embedding with the given ID and makes the removal durable
+func (s *EmbeddingStore) Delete(id string) error {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+
+    s.mu.RLock()
+    label, exists := s.labels[id]
+    s.mu.RUnlock()
+    if !exists {
+        return errEmbeddingNotFound
+    }
+
+    err := s.persist(func() error {
+        return s.backend.Delete(id, func() []Embedding {
+            live := s.Embeddings()
+            remaining := make([]Embedding, 0, len(live))
+            for _, embedding := range live {
+                if embedding.ID != id {
+                    remaining = append(remaining, embedding)
+                }
+            }
+            return remaining
+        })
+    })
+    if err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    delete(s.labels, id)
+    index, lexical, removed := s.index, s.lexical, s.embeddings[label]
+    s.mu.Unlock()
+
+    index.Delete(label)
+    lexical.Delete(label, &removed)
+    s.compactIfNeeded()
+    s.compactStorageIfNeeded()
+    s.notifyWrite()
+    return nil
+}
+
+// persist runs a backend write and records the storage's new modification time so the
+// watcher does not reload our own write. Callers hold reloadMu.
+func (s *EmbeddingStore) persist(write func() error) error {
+    if err := write(); err != nil {
+        return err
+    }
+    modTime := s.backend.ModTime()
+    s.mu.Lock()
+    s.modTime = modTime
+    s.mu.Unlock()
+    return nil
+}
+
+// backgroundCompactor is implemented by backends that compact their storage after writes
+type backgroundCompactor interface {
+    CompactIfNeeded(count int, live func() []Embedding)
+}
+
+// compactStorageIfNeeded lets the backend compact once a change has been applied in memory.
+// Callers hold reloadMu.
+func (s *EmbeddingStore) compactStorageIfNeeded() {
+    compactor, ok := s.backend.(backgroundCompactor)
+    if !ok {
+        return
+    }
+    s.mu.RLock()
+    count := len(s.labels)
+    s.mu.RUnlock()
+    compactor.CompactIfNeeded(count, s.Embeddings)
+}
+
+// compactIfNeeded starts rebuilding the indexes without the replaced and deleted records
+// once they make up a large share of the slots. The rebuild runs in the background, so
+// writes do not wait for it. Callers hold reloadMu.
+func (s *EmbeddingStore) compactIfNeeded() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    stale := len(s.embeddings) - len(s.labels)
+    total := len(s.embeddings)
+    if s.rebuilding || total == 0 || float64(stale)/float64(total) < compactionRatio {
+        return
+    }
+
+    s.rebuilding = true
+    s.rebuilds.Add(1)
+    go s.rebuildCompacted(s.epoch, total, s.liveLabels(), s.liveEmbeddings())
+}
+
+// rebuildCompacted builds indexes over the embeddings that were live when compaction
+// started, then catches up with the writes made meanwhile and swaps them in. base is the
+// number of slots at the start and oldLabels the labels of the live embeddings then.
+func (s *EmbeddingStore) rebuildCompacted(epoch, base int, oldLabels []int, embeddings []Embedding) {
+    defer s.rebuilds.Done()
+    index := s.rebuildIndex(embeddings)
+    lexical := buildLexicalIndex(embeddings)
+
+    // Holding reloadMu keeps writers out, so the slots and labels can be read without mu
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+    if s.epoch != epoch {
+        s.mu.Lock()
+        s.rebuilding = false
+        s.mu.Unlock()
+        log.Printf("Discarding index rebuild of %s: the embeddings were replaced meanwhile", s.path)
+        return
+    }
+
+    relabel := make(map[int]int, len(oldLabels)+len(s.embeddings)-base)
+    for i, label := range oldLabels {
+        relabel[label] = i
+    }
+    for label := base; label < len(s.embeddings); label++ {
+        relabel[label] = len(embeddings)
+        embeddings = append(embeddings, s.embeddings[label])
+        if err := index.Add(relabel[label], s.embeddings[label].Vector); err != nil {
+            log.Printf("Error indexing embedding %s: %v", s.embeddings[label].ID, err)
+        }
+        lexical.Add(relabel[label], &s.embeddings[label])
+    }
+    labels := make(map[string]int, len(s.labels))
+    live := make([]bool, len(embeddings))
+    for id, label := range s.labels {
+        labels[id] = relabel[label]
+        live[relabel[label]] = true
+    }
+    // Records replaced or deleted since the rebuild started
+    for label := range embeddings {
+        if !live[label] {
+            index.Delete(label)
+            lexical.Delete(label, &embeddings[label])
+        }
+    }
+
+    s.mu.Lock()
+    dropped := len(s.embeddings) - len(embeddings)
+    s.embeddings = embeddings
+    s.labels = labels
+    s.index = index
+    s.lexical = lexical
+    s.rebuilding = false
+    s.mu.Unlock()
+    log.Printf("Compacted embeddings store %s: dropped %d stale records", s.path, dropped)
+}
+
+// Replace swaps in the contents of another store, such as a copy re-embedded with a new
+// model. catchUp runs first with the current live embeddings and must bring the replacement
+// up to date with them; writes wait until the swap is done, so none can be lost. The
+// replacement is made durable before it becomes visible and must not be used afterwards.
+// switched, when not nil, runs inside the swap, so whatever it changes becomes visible
+// together with the new vectors. It must not call back into the store.
+func (s *EmbeddingStore) Replace(replacement *EmbeddingStore, catchUp func(live []Embedding) error, switched func()) error {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+
+    s.mu.RLock()
+    dropped := s.dropped
+    s.mu.RUnlock()
+    if dropped {
+        return fmt.Errorf("%s was removed", s.path)
+    }
+    if err := catchUp(s.Embeddings()); err != nil {
+        return err
+    }
+
+    replacement.mu.RLock()
+    slots, labels, index, lexical, model := replacement.embeddings, replacement.labels, replacement.index, replacement.lexical, replacement.model
+    live := replacement.liveEmbeddings()
+    replacement.mu.RUnlock()
+
+    err := s.persist(func() error {
+        return s.backend.Replace(live)
+    })
+    if err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    s.epoch++
+    s.embeddings = slots
+    s.labels = labels
+    s.index = index
+    s.lexical = lexical
+    s.model = model
+    if s.dimension != 0 {
+        s.dimension = index.Dimension()
+    }
+    s.loadedAt = time.Now()
+    if switched != nil {
+        switched()
+    }
+    s.mu.Unlock()
+
+    log.Printf("Replaced the %d embeddings in %s with vectors from %s", len(live), s.path, model)
+    for _, fn := range s.onReload {
+        fn(live)
+    }
+    s.compactIfNeeded()
+    return nil
+}
+
+// Drop deletes the backing storage. The store must not be used afterwards.
+func (s *EmbeddingStore) Drop() error {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+
+    if err := s.backend.Remove(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    s.epoch++
+    s.dropped = true
+    s.embeddings = nil
+    s.labels = make(map[string]int)
+    s.index = NewHNSWIndex(s.indexConfig)
+    s.lexical = buildLexicalIndex(nil)
+    s.mu.Unlock()
+    return nil
+}
+
+// OnReload registers a function called with the new embeddings after every successful reload
+func (s *EmbeddingStore) OnReload(fn func([]Embedding)) {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+    s.onReload = append(s.onReload, fn)
+}
+
+// OnWrite registers a function called after every successful Put, PutBatch and Delete.
+// It runs while writes are held back, so it must return quickly and must not call back
+// into the store.
+func (s *EmbeddingStore) OnWrite(fn func()) {
+    s.reloadMu.Lock()
+    defer s.reloadMu.Unlock()
+    s.onWrite = append(s.onWrite, fn)
+}
+
+// notifyWrite runs the OnWrite functions. Callers hold reloadMu.
+func (s *EmbeddingStore) notifyWrite() {
+    for _, fn := range s.onWrite {
+        fn()
+    }
+}
+
+func (s *EmbeddingStore) recordError(err error) error {
+    s.mu.Lock()
+    s.lastError = err
+    s.lastErrAt = time.Now()
+    kept := len(s.labels)
+    s.mu.Unlock()
+
+    log.Printf("Error reloading embeddings from %s (keeping %d previous embeddings): %v", s.path, kept, err)
+    return err
+}
+
+// Status returns a snapshot of the store state
+func (s *EmbeddingStore) Status() EmbeddingStoreStatus {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    status := EmbeddingStoreStatus{
+        Path:     s.path,
+        Count:    len(s.labels),
+        Model:    s.model,
+        LoadedAt: s.loadedAt,
+        ModTime:  s.modTime,
+    }
+    if s.lastError != nil {
+        status.LastError = s.lastError.Error()
+        lastErrAt := s.lastErrAt
+        status.LastErrAt = &lastErrAt
+    }
+    return status
+}
+
+// Watch polls the backing file and reloads it when its modification time or size changes.
+// It returns when stop is closed.
+func (s *EmbeddingStore) Watch(interval time.Duration, stop <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    var lastSize int64 = -1
+    var lastMod time.Time
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+        }
+
+        info, err := os.Stat(s.path)
+        if err != nil {
+            continue
+        }
+        if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+            continue
+        }
+        lastMod, lastSize = info.ModTime(), info.Size()
+
+        s.mu.RLock()
+        current := s.modTime
+        s.mu.RUnlock()
+        if info.ModTime().Equal(current) {
+            continue
+        }
+
+        log.Printf("Embeddings file %s changed, reloading", s.path)
+        s.Reload()
+    }
+}
+
+// writeJSONFileAtomic writes v as indented JSON to a temporary file next to path, syncs it
+// and renames it over path, so readers never observe a partially written file
+func writeJSONFileAtomic(path string, v interface{}) error {
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to marshal %s: %v", path, err)
+    }
+
+    dir := filepath.Dir(path)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return fmt.Errorf("failed to create %s: %v", dir, err)
+    }
+    tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-*")
+    if err != nil {
+        return fmt.Errorf("failed to create temp file for %s: %v", path, err)
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to write %s: %v", tmp.Name(), err)
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to sync %s: %v", tmp.Name(), err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("failed to close %s: %v", tmp.Name(), err)
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return fmt.Errorf("failed to replace %s: %v", path, err)
+    }
+    return nil
+}
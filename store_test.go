@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestStoreRebuildsIndexInBackground(t *testing.T) {
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine, M: 8, EfConstruction: 32, EfSearch: 32}, 0)
+    var batch []Embedding
+    for i := 0; i < 100; i++ {
+        batch = append(batch, Embedding{ID: fmt.Sprint(i), Intent: fmt.Sprint("intent ", i), Vector: []float32{float32(i), 1, 2}})
+    }
+    for _, result := range store.PutBatch(batch) {
+        if result.Err != nil {
+            t.Fatal(result.Err)
+        }
+    }
+
+    // Deleting a third of the records starts a rebuild; the writes after it must survive
+    for i := 0; i < 40; i++ {
+        if err := store.Delete(fmt.Sprint(i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, _, err := store.Put(Embedding{ID: "new", Intent: "new intent", Vector: []float32{-1, 0, 0}}); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := store.Put(Embedding{ID: "50", Intent: "replaced", Vector: []float32{0, 0, 1}}); err != nil {
+        t.Fatal(err)
+    }
+    store.Delete("99")
+    store.rebuilds.Wait()
+
+    embeddings, index, lexical := store.Snapshot()
+    if got := index.Len(); got != 60 {
+        t.Errorf("index holds %d records, want 60", got)
+    }
+    if got := lexical.Len(); got != 60 {
+        t.Errorf("lexical index holds %d records, want 60", got)
+    }
+    if stale := len(embeddings) - len(store.Embeddings()); float64(stale)/float64(len(embeddings)) >= compactionRatio {
+        t.Errorf("%d of %d slots are still stale after the rebuild", stale, len(embeddings))
+    }
+    for _, id := range []string{"new", "50", "60"} {
+        embedding, ok := store.Get(id)
+        if !ok {
+            t.Fatalf("record %s is missing after the rebuild", id)
+        }
+        hits := index.SearchExact(embedding.Vector, 1)
+        if len(hits) == 0 || embeddings[hits[0].Label].ID != id {
+            t.Errorf("searching for record %s found %v", id, hits)
+        }
+    }
+    if _, ok := store.Get("99"); ok {
+        t.Error("record 99 was deleted but is still stored")
+    }
+}
+
+func TestStoreWritesRefreshCorpusStats(t *testing.T) {
+    t.Setenv("PROJECT_PATHS", t.TempDir())
+    saved := currentCorpus()
+    t.Cleanup(func() {
+        corpusMu.Lock()
+        corpus = saved
+        corpusMu.Unlock()
+    })
+
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    store.OnWrite(newCorpusRefresher(store.Embeddings).Changed)
+    // Waits for the background refresh to see the word in the given number of documents
+    waitForDocFreq := func(word string, want int) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for currentCorpus().docFreq[word] != want {
+            if time.Now().After(deadline) {
+                t.Fatalf("document frequency of %q = %d, want %d", word, currentCorpus().docFreq[word], want)
+            }
+            time.Sleep(time.Millisecond)
+        }
+    }
+
+    store.PutBatch([]Embedding{
+        {ID: "a", Intent: "scrape headlines", Project: "scraper", Vector: []float32{1, 0}},
+        {ID: "b", Intent: "summarise headlines", Project: "digest", Vector: []float32{0, 1}},
+    })
+    waitForDocFreq("headlines", 2)
+    if err := store.Delete("a"); err != nil {
+        t.Fatal(err)
+    }
+    waitForDocFreq("headlines", 1)
+    waitForDocFreq("scrape", 0)
+}
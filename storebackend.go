@@ -0,0 +1,262 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// embeddingBackend is the durable storage behind an EmbeddingStore
+type embeddingBackend interface {
+    // Path names the file or directory the embeddings are kept in
+    Path() string
+    // Load reads every stored embedding
+    Load() ([]Embedding, error)
+    // ModTime reports when the storage was last changed, or the zero time if unknown
+    ModTime() time.Time
+    // Put and Delete make a change durable. live returns the whole collection after the
+    // change, for backends that rewrite everything.
+    Put(embeddings []Embedding, live func() []Embedding) error
+    Delete(id string, live func() []Embedding) error
+    // Replace atomically swaps the whole collection for the given embeddings
+    Replace(embeddings []Embedding) error
+    // Remove deletes the storage for good
+    Remove() error
+}
+
+// Storage backends selectable with the EMBEDDINGS_STORE environment variable
+const (
+    storeJSON     = "json"
+    storeSegments = "segments"
+)
+
+// NewEmbeddingBackend builds the named storage backend. The segment log imports the JSON
+// file at jsonPath the first time it starts in a new directory.
+func NewEmbeddingBackend(name, jsonPath, segmentDir string) (embeddingBackend, error) {
+    switch name {
+    case "", storeJSON:
+        return &jsonFileBackend{path: jsonPath}, nil
+    case storeSegments:
+        return &segmentLogBackend{dir: segmentDir, importPath: jsonPath, opts: DefaultSegmentLogOptions()}, nil
+    }
+    return nil, fmt.Errorf("unknown embeddings store %q (expected %s or %s)", name, storeJSON, storeSegments)
+}
+
+// jsonFileBackend keeps the collection as one JSON array, rewritten atomically on every change
+type jsonFileBackend struct {
+    path string
+}
+
+func (b *jsonFileBackend) Path() string {
+    return b.path
+}
+
+func (b *jsonFileBackend) Load() ([]Embedding, error) {
+    return LoadEmbeddings(b.path)
+}
+
+func (b *jsonFileBackend) ModTime() time.Time {
+    info, err := os.Stat(b.path)
+    if err != nil {
+        return time.Time{}
+    }
+    return info.ModTime()
+}
+
+func (b *jsonFileBackend) Put(embeddings []Embedding, live func() []Embedding) error {
+    return writeJSONFileAtomic(b.path, live())
+}
+
+func (b *jsonFileBackend) Delete(id string, live func() []Embedding) error {
+    return writeJSONFileAtomic(b.path, live())
+}
+
+func (b *jsonFileBackend) Replace(embeddings []Embedding) error {
+    return writeJSONFileAtomic(b.path, embeddings)
+}
+
+func (b *jsonFileBackend) Remove() error {
+    if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to remove %s: %v", b.path, err)
+    }
+    return nil
+}
+
+// segmentImportMarker is created in the segment directory once the log has been
+// initialised, so the JSON file is imported only the first time
+const segmentImportMarker = "imported"
+
+// segmentLogBackend appends each change to a SegmentLog and compacts it in the background
+type segmentLogBackend struct {
+    dir        string
+    importPath string
+    opts       SegmentLogOptions
+
+    log        *SegmentLog
+    compaction sync.WaitGroup
+}
+
+func (b *segmentLogBackend) Path() string {
+    return b.dir
+}
+
+// Load replays the segment log. Reloading waits for a running compaction and reopens the
+// log, which also recovers from a torn tail.
+func (b *segmentLogBackend) Load() ([]Embedding, error) {
+    b.compaction.Wait()
+    if b.log != nil {
+        b.log.Close()
+        b.log = nil
+    }
+
+    start := time.Now()
+    segmentLog, embeddings, err := OpenSegmentLog(b.dir, b.opts)
+    if err != nil {
+        return nil, err
+    }
+    b.log = segmentLog
+    if err := validateEmbeddings(embeddings); err != nil {
+        return nil, fmt.Errorf("invalid embeddings in %s: %v", b.dir, err)
+    }
+    // A log emptied by deletes stays empty; only a new one imports the JSON file
+    marker := filepath.Join(b.dir, segmentImportMarker)
+    if _, err := os.Stat(marker); os.IsNotExist(err) {
+        if len(embeddings) == 0 {
+            if embeddings, err = b.importJSON(); err != nil {
+                return nil, err
+            }
+        }
+        if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+            return nil, fmt.Errorf("failed to mark segment log %s as initialised: %v", b.dir, err)
+        }
+        syncDir(b.dir)
+    }
+    log.Printf("Replayed segment log %s in %s", b.dir, time.Since(start))
+    return embeddings, nil
+}
+
+// importJSON copies the embeddings from the JSON file into the new, empty log. They are
+// written as a compacted segment, whose rename makes the import all or nothing.
+func (b *segmentLogBackend) importJSON() ([]Embedding, error) {
+    if _, err := os.Stat(b.importPath); err != nil {
+        return nil, nil
+    }
+    embeddings, err := LoadEmbeddings(b.importPath)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := assignEmbeddingIDs(embeddings); err != nil {
+        return nil, fmt.Errorf("invalid embeddings in %s: %v", b.importPath, err)
+    }
+    sealed, err := b.log.StartCompaction()
+    if err != nil {
+        return nil, err
+    }
+    if err := b.log.CompactSealed(sealed, embeddings); err != nil {
+        return nil, err
+    }
+    log.Printf("Imported %d embeddings from %s into segment log %s", len(embeddings), b.importPath, b.dir)
+    return embeddings, nil
+}
+
+func (b *segmentLogBackend) ModTime() time.Time {
+    return time.Time{}
+}
+
+func (b *segmentLogBackend) Put(embeddings []Embedding, live func() []Embedding) error {
+    if b.log == nil {
+        return fmt.Errorf("segment log %s is not open", b.dir)
+    }
+    return b.log.AppendPuts(embeddings)
+}
+
+func (b *segmentLogBackend) Delete(id string, live func() []Embedding) error {
+    if b.log == nil {
+        return fmt.Errorf("segment log %s is not open", b.dir)
+    }
+    return b.log.AppendDelete(id)
+}
+
+// Replace rewrites the log through a synchronous compaction, whose rename is the switchover
+func (b *segmentLogBackend) Replace(embeddings []Embedding) error {
+    b.compaction.Wait()
+    if b.log == nil {
+        return fmt.Errorf("segment log %s is not open", b.dir)
+    }
+    sealed, err := b.log.StartCompaction()
+    if err != nil {
+        return err
+    }
+    return b.log.CompactSealed(sealed, embeddings)
+}
+
+func (b *segmentLogBackend) Remove() error {
+    b.compaction.Wait()
+    if b.log != nil {
+        b.log.Close()
+        b.log = nil
+    }
+    if err := os.RemoveAll(b.dir); err != nil {
+        return fmt.Errorf("failed to remove %s: %v", b.dir, err)
+    }
+    return nil
+}
+
+// CompactIfNeeded starts a background compaction once enough records have been superseded.
+// It is called after each applied change with the store's write lock held, so live is
+// exactly what the log replays to.
+func (b *segmentLogBackend) CompactIfNeeded(count int, live func() []Embedding) {
+    if b.log == nil || !b.log.NeedsCompaction(count) {
+        return
+    }
+    sealed, err := b.log.StartCompaction()
+    if err != nil {
+        log.Printf("Error starting segment compaction: %v", err)
+        return
+    }
+    embeddings := live()
+
+    b.compaction.Add(1)
+    go func(segmentLog *SegmentLog) {
+        defer b.compaction.Done()
+        if err := segmentLog.CompactSealed(sealed, embeddings); err != nil {
+            log.Printf("Error compacting segment log %s: %v", b.dir, err)
+        }
+    }(b.log)
+}
+
+// memoryBackend keeps nothing on disk. It backs stores that are built up in memory and
+// then handed to EmbeddingStore.Replace.
+type memoryBackend struct{}
+
+func (memoryBackend) Path() string {
+    return "memory"
+}
+
+func (memoryBackend) Load() ([]Embedding, error) {
+    return nil, nil
+}
+
+func (memoryBackend) ModTime() time.Time {
+    return time.Time{}
+}
+
+func (memoryBackend) Put(embeddings []Embedding, live func() []Embedding) error {
+    return nil
+}
+
+func (memoryBackend) Delete(id string, live func() []Embedding) error {
+    return nil
+}
+
+func (memoryBackend) Replace(embeddings []Embedding) error {
+    return nil
+}
+
+func (memoryBackend) Remove() error {
+    return nil
+}
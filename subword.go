@@ -0,0 +1,169 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// subwordTable holds fastText-style character n-gram vectors hashed into a fixed number of
+// buckets, used to build a vector for words missing from the word table
+type subwordTable struct {
+    minN      int
+    maxN      int
+    buckets   int
+    dimension int
+    data      []float32
+}
+
+// subwordVectors is nil unless SUBWORD_VECTORS_PATH is configured
+var subwordVectors *subwordTable
+
+// Default n-gram lengths, matching fastText
+const (
+    defaultSubwordMinN = 3
+    defaultSubwordMaxN = 6
+)
+
+// TokenCoverage reports how the tokens of a query were resolved to vectors
+type TokenCoverage struct {
+    Tokens       int     `json:"tokens"`
+    InVocabulary int     `json:"inVocabulary"`
+    Subword      int     `json:"subword"`
+    Missing      int     `json:"missing"`
+    OOVRate      float64 `json:"oovRate"`
+}
+
+// LoadSubwordVectors reads n-gram bucket vectors in the text layout used for word vectors,
+// with the bucket number in place of the word: an optional "<buckets> <dimension>" header,
+// then "<bucket> <components...>" per line. Buckets missing from the file stay zero.
+func LoadSubwordVectors(path string, minN, maxN int) (*subwordTable, error) {
+    if minN < 1 || maxN < minN {
+        return nil, fmt.Errorf("invalid n-gram range %d-%d", minN, maxN)
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open subword vectors file: %v", err)
+    }
+    defer file.Close()
+
+    type row struct {
+        bucket int
+        vector []float32
+    }
+    var rows []row
+    buckets, dimension, skipped := 0, 0, 0
+    reader := bufio.NewReaderSize(file, 1<<20)
+
+    for lineNo := 1; ; lineNo++ {
+        line, readErr := reader.ReadString('\n')
+        if readErr != nil && readErr != io.EOF {
+            return nil, fmt.Errorf("failed to read subword vectors at line %d: %v", lineNo, readErr)
+        }
+
+        fields := strings.Fields(line)
+        if lineNo == 1 && len(fields) == 2 {
+            buckets, _ = strconv.Atoi(fields[0])
+            dimension, _ = strconv.Atoi(fields[1])
+            fields = nil
+        }
+
+        if len(fields) > 1 {
+            if dimension == 0 {
+                dimension = len(fields) - 1
+            }
+            vector := make([]float32, dimension)
+            bucket, err := strconv.Atoi(fields[0])
+            label, ok := parseTextWordVector(fields, vector)
+            if err != nil || bucket < 0 || !ok || label != fields[0] {
+                skipped++
+            } else {
+                rows = append(rows, row{bucket, vector})
+                if bucket >= buckets {
+                    buckets = bucket + 1
+                }
+            }
+        }
+
+        if readErr == io.EOF {
+            break
+        }
+    }
+
+    if len(rows) == 0 {
+        return nil, fmt.Errorf("no subword vectors found in %s", path)
+    }
+
+    table := &subwordTable{
+        minN:      minN,
+        maxN:      maxN,
+        buckets:   buckets,
+        dimension: dimension,
+        data:      make([]float32, buckets*dimension),
+    }
+    for _, r := range rows {
+        copy(table.data[r.bucket*dimension:], r.vector)
+    }
+
+    log.Printf("Loaded %d subword buckets (dimension %d, n-grams %d-%d, %d skipped lines) from %s",
+        len(rows), dimension, minN, maxN, skipped, path)
+    return table, nil
+}
+
+// hashNgram is the FNV-1a variant fastText uses, which sign-extends each byte
+func hashNgram(ngram string) uint32 {
+    h := uint32(2166136261)
+    for i := 0; i < len(ngram); i++ {
+        h ^= uint32(int8(ngram[i]))
+        h *= 16777619
+    }
+    return h
+}
+
+// wordNgrams returns the character n-grams of a word wrapped in the "<" and ">" boundary markers
+func wordNgrams(word string, minN, maxN int) []string {
+    runes := []rune("<" + word + ">")
+    var ngrams []string
+    for n := minN; n <= maxN; n++ {
+        for start := 0; start+n <= len(runes); start++ {
+            ngram := string(runes[start : start+n])
+            // The whole bracketed word is the word itself, not a subword
+            if n == len(runes) {
+                continue
+            }
+            ngrams = append(ngrams, ngram)
+        }
+    }
+    return ngrams
+}
+
+// vector averages the bucket vectors of the word's n-grams. It reports false when the
+// table has no data for any of them.
+func (t *subwordTable) vector(word string) ([]float64, bool) {
+    result := make([]float64, t.dimension)
+    found := 0
+    for _, ngram := range wordNgrams(word, t.minN, t.maxN) {
+        offset := int(hashNgram(ngram)%uint32(t.buckets)) * t.dimension
+        row := t.data[offset : offset+t.dimension]
+        nonZero := false
+        for i, value := range row {
+            result[i] += float64(value)
+            nonZero = nonZero || value != 0
+        }
+        if nonZero {
+            found++
+        }
+    }
+    if found == 0 {
+        return nil, false
+    }
+    for i := range result {
+        result[i] /= float64(found)
+    }
+    return result, true
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// Reasons for abstaining from naming the best candidate
+const (
+    abstainLowScore  = "low_score"
+    abstainAmbiguous = "ambiguous"
+    abstainHighOOV   = "high_oov"
+)
+
+// Thresholds decide when the best candidate of an intent query is too weak to name. Unset
+// thresholds are not checked. MinScore applies to the best vector similarity, MinMargin to
+// the gap between the top two, and MaxOOVRate to the share of query tokens the word vectors
+// lack, which only word-average embedders report.
+type Thresholds struct {
+    MinScore   *float64 `json:"minScore,omitempty"`
+    MinMargin  *float64 `json:"minMargin,omitempty"`
+    MaxOOVRate *float64 `json:"maxOOVRate,omitempty"`
+}
+
+// AbstainReason explains one threshold the best candidate failed
+type AbstainReason struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+// validate rejects thresholds that could never be met
+func (t Thresholds) validate() error {
+    if t.MinMargin != nil && *t.MinMargin < 0 {
+        return fmt.Errorf("minMargin must not be negative")
+    }
+    if t.MaxOOVRate != nil && (*t.MaxOOVRate < 0 || *t.MaxOOVRate > 1) {
+        return fmt.Errorf("maxOOVRate must be between 0 and 1")
+    }
+    return nil
+}
+
+// thresholdsFromEnv reads the default collection's thresholds from MATCH_MIN_SCORE,
+// MATCH_MIN_MARGIN and MATCH_MAX_OOV_RATE
+func thresholdsFromEnv() Thresholds {
+    value := func(key string) *float64 {
+        if os.Getenv(key) == "" {
+            return nil
+        }
+        parsed := envFloat(key, math.NaN())
+        if math.IsNaN(parsed) {
+            return nil
+        }
+        return &parsed
+    }
+    t := Thresholds{
+        MinScore:   value("MATCH_MIN_SCORE"),
+        MinMargin:  value("MATCH_MIN_MARGIN"),
+        MaxOOVRate: value("MATCH_MAX_OOV_RATE"),
+    }
+    if err := t.validate(); err != nil {
+        log.Printf("Ignoring match thresholds from the environment: %v", err)
+        return Thresholds{}
+    }
+    return t
+}
+
+// matchSignals are what the thresholds look at in a query's result. RunnerUp is false when
+// only one embedding was scored, so there is nothing to be ambiguous with; Coverage is
+// false when the embedder does not report token coverage.
+type matchSignals struct {
+    Score    float64
+    Margin   float64
+    RunnerUp bool
+    OOVRate  float64
+    Coverage bool
+}
+
+// accepts reports whether the signals pass every set threshold
+func (t Thresholds) accepts(s matchSignals) bool {
+    if t.MinScore != nil && s.Score < *t.MinScore {
+        return false
+    }
+    if t.MinMargin != nil && s.RunnerUp && s.Margin < *t.MinMargin {
+        return false
+    }
+    if t.MaxOOVRate != nil && s.Coverage && s.OOVRate > *t.MaxOOVRate {
+        return false
+    }
+    return true
+}
+
+// reasons lists the thresholds the signals fail, in the order accepts checks them
+func (t Thresholds) reasons(s matchSignals) []AbstainReason {
+    var reasons []AbstainReason
+    if t.MinScore != nil && s.Score < *t.MinScore {
+        reasons = append(reasons, AbstainReason{
+            Code:    abstainLowScore,
+            Message: fmt.Sprintf("best similarity %.4f is below the score floor %.4f", s.Score, *t.MinScore),
+        })
+    }
+    if t.MinMargin != nil && s.RunnerUp && s.Margin < *t.MinMargin {
+        reasons = append(reasons, AbstainReason{
+            Code:    abstainAmbiguous,
+            Message: fmt.Sprintf("top two candidates are %.4f apart, less than the minimum margin %.4f", s.Margin, *t.MinMargin),
+        })
+    }
+    if t.MaxOOVRate != nil && s.Coverage && s.OOVRate > *t.MaxOOVRate {
+        reasons = append(reasons, AbstainReason{
+            Code:    abstainHighOOV,
+            Message: fmt.Sprintf("%.0f%% of the query tokens are out of vocabulary, more than the %.0f%% allowed", 100*s.OOVRate, 100**t.MaxOOVRate),
+        })
+    }
+    return reasons
+}
+
+// LabelledIntent is one example of a calibration set. An empty Project marks an intent
+// the collection should not answer, so any match for it counts as wrong.
+type LabelledIntent struct {
+    Intent  string `json:"intent"`
+    Project string `json:"project"`
+}
+
+// ReadLabelledIntents reads a calibration set given as a JSON array or as JSONL
+func ReadLabelledIntents(r io.Reader) ([]LabelledIntent, error) {
+    reader := bufio.NewReader(r)
+    for {
+        b, err := reader.Peek(1)
+        if err == io.EOF {
+            return nil, fmt.Errorf("the labelled set is empty")
+        } else if err != nil {
+            return nil, err
+        }
+        if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+            break
+        }
+        reader.ReadByte()
+    }
+
+    var examples []LabelledIntent
+    decoder := json.NewDecoder(reader)
+    if b, _ := reader.Peek(1); b[0] == '[' {
+        if err := decoder.Decode(&examples); err != nil {
+            return nil, fmt.Errorf("invalid labelled set: %v", err)
+        }
+    } else {
+        for {
+            var example LabelledIntent
+            err := decoder.Decode(&example)
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                return nil, fmt.Errorf("invalid labelled example %d: %v", len(examples)+1, err)
+            }
+            examples = append(examples, example)
+        }
+    }
+    if len(examples) == 0 {
+        return nil, fmt.Errorf("the labelled set is empty")
+    }
+    for i, example := range examples {
+        if example.Intent == "" {
+            return nil, fmt.Errorf("labelled example %d has no intent", i+1)
+        }
+    }
+    return examples, nil
+}
+
+// defaultTargetPrecision is the share of accepted matches calibration aims to get right
+const defaultTargetPrecision = 0.9
+
+// calibrationGridSize bounds the candidate values tried for each threshold
+const calibrationGridSize = 25
+
+// CalibrationStats describes how a set of thresholds does on the labelled set. Precision is
+// the share of accepted matches naming the labelled project, Coverage the share of
+// examples accepted. CorrectAbstentions counts abstentions where the best candidate was
+// wrong.
+type CalibrationStats struct {
+    Accepted           int     `json:"accepted"`
+    Correct            int     `json:"correct"`
+    Precision          float64 `json:"precision"`
+    Coverage           float64 `json:"coverage"`
+    CorrectAbstentions int     `json:"correctAbstentions"`
+}
+
+// CalibrationReport is the outcome of fitting a collection's thresholds. Reached is false
+// when no thresholds meet the target precision; Thresholds are then the most precise found.
+// Baseline is the collection without thresholds.
+type CalibrationReport struct {
+    Collection      string           `json:"collection"`
+    Examples        int              `json:"examples"`
+    OutOfScope      int              `json:"outOfScope"`
+    TargetPrecision float64          `json:"targetPrecision"`
+    Reached         bool             `json:"reached"`
+    Thresholds      Thresholds       `json:"thresholds"`
+    Fitted          CalibrationStats `json:"fitted"`
+    Baseline        CalibrationStats `json:"baseline"`
+    Applied         bool             `json:"applied"`
+}
+
+// calibrationSample is a labelled example as the collection answered it
+type calibrationSample struct {
+    signals   matchSignals
+    candidate bool // whether any embedding was returned
+    correct   bool
+}
+
+// Calibrate queries the collection with every labelled intent and fits the thresholds that
+// accept the most examples while keeping precision at or above the target. The search
+// options other than k, the minimum score and diversification are used as given, so the
+// thresholds fit the search mode they will serve.
+func Calibrate(collection *Collection, examples []LabelledIntent, opts SearchOptions, target float64) (CalibrationReport, error) {
+    report := CalibrationReport{Collection: collection.Config.Name, Examples: len(examples), TargetPrecision: target}
+    if err := collection.CheckEmbedder(); err != nil {
+        return report, err
+    }
+    opts.K = 1
+    opts.MinScore = math.Inf(-1)
+    opts.MMR = false
+    opts.MaxPerProject = 0
+    opts.Abstain = false
+
+    embeddings, index, lexical := collection.Store.Snapshot()
+    samples := make([]calibrationSample, len(examples))
+    for i, example := range examples {
+        if example.Project == "" {
+            report.OutOfScope++
+        }
+        match, err := MapIntentToProject(example.Intent, collection.Embedder, embeddings, index, lexical, opts)
+        if err != nil {
+            return report, fmt.Errorf("labelled example %d: %v", i+1, err)
+        }
+        if match.NoMatch {
+            continue
+        }
+        samples[i] = calibrationSample{
+            signals:   match.signals,
+            candidate: true,
+            correct:   example.Project != "" && match.Candidates[0].Project == example.Project,
+        }
+    }
+
+    report.Baseline = evaluateThresholds(samples, Thresholds{})
+    var scores, margins, oovRates []float64
+    for _, sample := range samples {
+        if !sample.candidate {
+            continue
+        }
+        scores = append(scores, sample.signals.Score)
+        if sample.signals.RunnerUp {
+            margins = append(margins, sample.signals.Margin)
+        }
+        if sample.signals.Coverage {
+            oovRates = append(oovRates, sample.signals.OOVRate)
+        }
+    }
+
+    // Looser values come first, so ties keep the thresholds that abstain least
+    best, bestStats := Thresholds{}, report.Baseline
+    for _, minScore := range thresholdGrid(scores, false) {
+        for _, minMargin := range thresholdGrid(margins, false) {
+            for _, maxOOV := range thresholdGrid(oovRates, true) {
+                t := Thresholds{MinScore: minScore, MinMargin: minMargin, MaxOOVRate: maxOOV}
+                stats := evaluateThresholds(samples, t)
+                if betterCalibration(stats, bestStats, target) {
+                    best, bestStats = t, stats
+                }
+            }
+        }
+    }
+    report.Thresholds = best
+    report.Fitted = bestStats
+    report.Reached = bestStats.Accepted > 0 && bestStats.Precision >= target
+    return report, nil
+}
+
+// evaluateThresholds scores thresholds against the answered labelled set
+func evaluateThresholds(samples []calibrationSample, t Thresholds) CalibrationStats {
+    var stats CalibrationStats
+    for _, sample := range samples {
+        if sample.candidate && t.accepts(sample.signals) {
+            stats.Accepted++
+            if sample.correct {
+                stats.Correct++
+            }
+        } else if !sample.correct {
+            stats.CorrectAbstentions++
+        }
+    }
+    if stats.Accepted > 0 {
+        stats.Precision = float64(stats.Correct) / float64(stats.Accepted)
+    }
+    if len(samples) > 0 {
+        stats.Coverage = float64(stats.Accepted) / float64(len(samples))
+    }
+    return stats
+}
+
+// betterCalibration prefers thresholds meeting the target, then the higher coverage among
+// those, or the higher precision among those that miss it
+func betterCalibration(a, b CalibrationStats, target float64) bool {
+    aMeets := a.Accepted > 0 && a.Precision >= target
+    bMeets := b.Accepted > 0 && b.Precision >= target
+    if aMeets != bMeets {
+        return aMeets
+    }
+    if aMeets {
+        if a.Coverage != b.Coverage {
+            return a.Coverage > b.Coverage
+        }
+        return a.Precision > b.Precision
+    }
+    if a.Precision != b.Precision {
+        return a.Precision > b.Precision
+    }
+    return a.Coverage > b.Coverage
+}
+
+// thresholdGrid returns nil (unset) followed by up to calibrationGridSize of the observed
+// values, spread over their quantiles and ordered from loosest to strictest. An upper
+// bound is strictest at its smallest value, a lower bound at its largest.
+func thresholdGrid(values []float64, upper bool) []*float64 {
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    unique := sorted[:0]
+    for i, value := range sorted {
+        if i == 0 || value != sorted[i-1] {
+            unique = append(unique, value)
+        }
+    }
+    if len(unique) > calibrationGridSize {
+        picked := make([]float64, calibrationGridSize)
+        for i := range picked {
+            picked[i] = unique[i*(len(unique)-1)/(calibrationGridSize-1)]
+        }
+        unique = picked
+    }
+    if upper {
+        for i, j := 0, len(unique)-1; i < j; i, j = i+1, j-1 {
+            unique[i], unique[j] = unique[j], unique[i]
+        }
+    }
+
+    grid := []*float64{nil}
+    for i := range unique {
+        grid = append(grid, &unique[i])
+    }
+    return grid
+}
+
+// SetThresholds replaces a collection's thresholds and records them in the manifest
+func (r *CollectionRegistry) SetThresholds(name string, t Thresholds) (*Collection, error) {
+    if err := t.validate(); err != nil {
+        return nil, err
+    }
+    if name == "" {
+        name = defaultCollection
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    current, exists := r.collections[name]
+    if !exists {
+        return nil, errCollectionNotFound
+    }
+    config := current.Config
+    config.Thresholds = t
+    collection := &Collection{Config: config, Store: current.Store, Embedder: current.Embedder}
+    r.collections[name] = collection
+    if err := r.saveManifest(); err != nil {
+        r.collections[name] = current
+        return nil, err
+    }
+    log.Printf("Set match thresholds of collection %s", name)
+    return collection, nil
+}
+
+// SetThresholdsHandler replaces a collection's match thresholds with
+// {"minScore", "minMargin", "maxOOVRate"}; omitted thresholds are not checked
+func SetThresholdsHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    var thresholds Thresholds
+    if err := json.NewDecoder(r.Body).Decode(&thresholds); err != nil {
+        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    log.Printf("Handling request to set the thresholds of collection %s", name)
+
+    collection, err := collections.SetThresholds(name, thresholds)
+    if err == errCollectionNotFound {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, fmt.Sprintf("Error setting thresholds: %v", err), http.StatusBadRequest)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(collections.Info(collection))
+}
+
+// CalibrateCollectionHandler fits a collection's thresholds to the labelled intents in the
+// body, a JSON array or JSONL of {"intent", "project"}, and returns the CalibrationReport.
+// target sets the precision to reach, apply=true stores the fitted thresholds, and the
+// search parameters of /map-intent choose how the intents are searched.
+func CalibrateCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    collection, err := collections.Get(name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    }
+    query := r.URL.Query()
+    opts, err := parseSearchOptions(query)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    target := defaultTargetPrecision
+    if raw := query.Get("target"); raw != "" {
+        parsed, err := strconv.ParseFloat(raw, 64)
+        if err != nil || parsed <= 0 || parsed > 1 {
+            http.Error(w, "Invalid 'target' parameter: must be between 0 and 1", http.StatusBadRequest)
+            return
+        }
+        target = parsed
+    }
+    apply := false
+    if raw := query.Get("apply"); raw != "" {
+        if apply, err = strconv.ParseBool(raw); err != nil {
+            http.Error(w, fmt.Sprintf("Invalid 'apply' parameter: %v", err), http.StatusBadRequest)
+            return
+        }
+    }
+    examples, err := ReadLabelledIntents(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    log.Printf("Handling request to calibrate collection %s with %d labelled intents", name, len(examples))
+
+    if err := collection.CheckEmbedder(); err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    report, err := Calibrate(collection, examples, opts, target)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Error calibrating collection: %v", err), http.StatusBadGateway)
+        return
+    }
+    if apply {
+        if _, err := collections.SetThresholds(name, report.Thresholds); err != nil {
+            http.Error(w, fmt.Sprintf("Error applying thresholds: %v", err), http.StatusInternalServerError)
+            return
+        }
+        report.Applied = true
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+// calibrationCollection holds one scraper record at [1, 0] and embeds each labelled intent
+// to the unit vector whose cosine with it is the intent's score
+func calibrationCollection(t *testing.T, scores map[string]float64) *Collection {
+    t.Helper()
+    embedder := staticEmbedder{}
+    for intent, score := range scores {
+        embedder[intent] = []float64{score, math.Sqrt(1 - score*score)}
+    }
+    store := NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0)
+    if _, _, err := store.Put(Embedding{ID: "scraper", Intent: "scrape news", Project: "scraper", Model: embedder.Name(), Vector: []float32{1, 0}}); err != nil {
+        t.Fatal(err)
+    }
+    return &Collection{Config: CollectionConfig{Name: "calibration", Metric: metricCosine}, Store: store, Embedder: embedder}
+}
+
+func TestCalibratePicksTheLoosestCutoffMeetingTheTarget(t *testing.T) {
+    collection := calibrationCollection(t, map[string]float64{
+        "crawl headlines": 1.0, "fetch articles": 0.9, "read feeds": 0.7,
+        "book a flight": 0.8, "order pizza": 0.5,
+    })
+    examples := []LabelledIntent{
+        {Intent: "crawl headlines", Project: "scraper"},
+        {Intent: "fetch articles", Project: "scraper"},
+        {Intent: "read feeds", Project: "scraper"},
+        {Intent: "book a flight"},
+        {Intent: "order pizza"},
+    }
+    tests := []struct {
+        target    float64
+        minScore  float64
+        accepted  int
+        abstained int
+    }{
+        // Only cutting above the out-of-scope 0.8 answers nothing wrongly
+        {target: 1, minScore: 0.9, accepted: 2, abstained: 2},
+        // Three right out of four accepted is enough, so 0.7 keeps the most
+        {target: 0.75, minScore: 0.7, accepted: 4, abstained: 1},
+    }
+    for _, test := range tests {
+        report, err := Calibrate(collection, examples, SearchOptions{Mode: searchVector}, test.target)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if report.OutOfScope != 2 || report.Baseline.Accepted != 5 || report.Baseline.Correct != 3 {
+            t.Fatalf("baseline = %+v with %d out of scope, want 3 of 5 right", report.Baseline, report.OutOfScope)
+        }
+        if !report.Reached || report.Thresholds.MinScore == nil || math.Abs(*report.Thresholds.MinScore-test.minScore) > 1e-6 {
+            t.Errorf("target %v: thresholds %+v, reached %v, want a score floor of %v", test.target, report.Thresholds, report.Reached, test.minScore)
+            continue
+        }
+        if report.Thresholds.MinMargin != nil || report.Thresholds.MaxOOVRate != nil {
+            t.Errorf("target %v: thresholds %+v, want no margin or OOV limit without those signals", test.target, report.Thresholds)
+        }
+        if fitted := report.Fitted; fitted.Accepted != test.accepted || fitted.CorrectAbstentions != test.abstained {
+            t.Errorf("target %v: fitted %+v, want %d accepted and %d correct abstentions", test.target, fitted, test.accepted, test.abstained)
+        }
+    }
+}
+
+func TestThresholdGrid(t *testing.T) {
+    values := func(grid []*float64) []float64 {
+        var out []float64
+        for _, value := range grid[1:] {
+            out = append(out, *value)
+        }
+        return out
+    }
+    equal := func(a, b []float64) bool {
+        if len(a) != len(b) {
+            return false
+        }
+        for i := range a {
+            if a[i] != b[i] {
+                return false
+            }
+        }
+        return true
+    }
+
+    lower := thresholdGrid([]float64{0.3, 0.1, 0.3, 0.2}, false)
+    if lower[0] != nil || !equal(values(lower), []float64{0.1, 0.2, 0.3}) {
+        t.Errorf("lower bound grid = %v, want unset then ascending distinct values", values(lower))
+    }
+    upper := thresholdGrid([]float64{0.3, 0.1, 0.3, 0.2}, true)
+    if upper[0] != nil || !equal(values(upper), []float64{0.3, 0.2, 0.1}) {
+        t.Errorf("upper bound grid = %v, want unset then descending distinct values", values(upper))
+    }
+
+    many := make([]float64, 100)
+    for i := range many {
+        many[i] = float64(i)
+    }
+    grid := values(thresholdGrid(many, false))
+    if len(grid) != calibrationGridSize || grid[0] != 0 || grid[len(grid)-1] != 99 {
+        t.Errorf("grid over 100 values = %v, want %d quantiles from 0 to 99", grid, calibrationGridSize)
+    }
+    if empty := thresholdGrid(nil, false); len(empty) != 1 || empty[0] != nil {
+        t.Errorf("grid without values = %v, want only unset", empty)
+    }
+}
+
+func TestBetterCalibration(t *testing.T) {
+    tests := []struct {
+        name   string
+        a, b   CalibrationStats
+        better bool
+    }{
+        {"meeting the target beats coverage", CalibrationStats{Accepted: 2, Precision: 0.9, Coverage: 0.2}, CalibrationStats{Accepted: 8, Precision: 0.8, Coverage: 0.8}, true},
+        {"missing the target loses", CalibrationStats{Accepted: 8, Precision: 0.8, Coverage: 0.8}, CalibrationStats{Accepted: 2, Precision: 0.9, Coverage: 0.2}, false},
+        {"both meet: more coverage", CalibrationStats{Accepted: 5, Precision: 0.9, Coverage: 0.5}, CalibrationStats{Accepted: 4, Precision: 1, Coverage: 0.4}, true},
+        {"both meet, same coverage: more precision", CalibrationStats{Accepted: 4, Precision: 1, Coverage: 0.4}, CalibrationStats{Accepted: 4, Precision: 0.95, Coverage: 0.4}, true},
+        {"both miss: more precision", CalibrationStats{Accepted: 2, Precision: 0.7, Coverage: 0.2}, CalibrationStats{Accepted: 8, Precision: 0.6, Coverage: 0.8}, true},
+        {"both miss, same precision: more coverage", CalibrationStats{Accepted: 8, Precision: 0.6, Coverage: 0.8}, CalibrationStats{Accepted: 2, Precision: 0.6, Coverage: 0.2}, true},
+        {"accepting nothing never meets the target", CalibrationStats{}, CalibrationStats{Accepted: 8, Precision: 0.5, Coverage: 0.8}, false},
+        {"a tie is not better", CalibrationStats{Accepted: 4, Precision: 1, Coverage: 0.4}, CalibrationStats{Accepted: 4, Precision: 1, Coverage: 0.4}, false},
+    }
+    for _, test := range tests {
+        if got := betterCalibration(test.a, test.b, 0.9); got != test.better {
+            t.Errorf("%s: betterCalibration = %v, want %v", test.name, got, test.better)
+        }
+    }
+}
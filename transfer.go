@@ -0,0 +1,956 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "math"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Import and export formats
+const (
+    formatJSONL = "jsonl"
+    formatCSV   = "csv"
+    formatNPY   = "npy"
+    formatFvecs = "fvecs"
+    formatIvecs = "ivecs"
+)
+
+// Export parts of the vector-only formats
+const (
+    partVectors  = "vectors"
+    partMetadata = "metadata"
+)
+
+const (
+    // importBatchSize rows are embedded and stored together
+    importBatchSize = 500
+    // maxReportedRowErrors caps the row errors listed in an ImportReport
+    maxReportedRowErrors = 100
+    // maxImportDimension guards against reading garbage as a huge vector
+    maxImportDimension = 1 << 16
+)
+
+// detectTransferFormat picks a format from a file extension, or returns ""
+func detectTransferFormat(path string) string {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".jsonl", ".ndjson":
+        return formatJSONL
+    case ".csv":
+        return formatCSV
+    case ".npy":
+        return formatNPY
+    case ".fvecs":
+        return formatFvecs
+    case ".ivecs":
+        return formatIvecs
+    }
+    return ""
+}
+
+// vectorOnlyFormat reports whether the format carries vectors but no metadata of its own
+func vectorOnlyFormat(format string) bool {
+    return format == formatNPY || format == formatFvecs
+}
+
+// RowError reports a row an import skipped. Rows count data records from 1, leaving out
+// the CSV header and blank JSONL lines.
+type RowError struct {
+    Row   int    `json:"row"`
+    Error string `json:"error"`
+}
+
+// ImportReport summarises an import. Error is set when the import stopped early; the rows
+// stored until then are kept.
+type ImportReport struct {
+    Collection string     `json:"collection"`
+    Format     string     `json:"format"`
+    Rows       int        `json:"rows"`
+    Imported   int        `json:"imported"`
+    Failed     int        `json:"failed"`
+    Errors     []RowError `json:"errors,omitempty"`
+    Error      string     `json:"error,omitempty"`
+    Duration   string     `json:"duration"`
+}
+
+func (r *ImportReport) rowFailed(row int, err error) {
+    r.Failed++
+    if len(r.Errors) < maxReportedRowErrors {
+        r.Errors = append(r.Errors, RowError{Row: row, Error: err.Error()})
+    }
+}
+
+// importRecord is one decoded row. Records without a vector are embedded from Text, or
+// from Intent when Text is empty. A vector without a Model is taken to come from the
+// collection's embedder.
+type importRecord struct {
+    ID       string    `json:"id"`
+    Intent   string    `json:"intent"`
+    Project  string    `json:"project"`
+    Params   string    `json:"params"`
+    Metadata Metadata  `json:"metadata,omitempty"`
+    Model    string    `json:"model,omitempty"`
+    Vector   []float32 `json:"vector,omitempty"`
+    Text     string    `json:"text,omitempty"`
+}
+
+// rowError marks a bad row that the import skips
+type rowError struct {
+    err error
+}
+
+func (e *rowError) Error() string {
+    return e.err.Error()
+}
+
+func badRow(format string, args ...interface{}) error {
+    return &rowError{fmt.Errorf(format, args...)}
+}
+
+// rowReader yields one record per call to Next and io.EOF at the end. A *rowError is
+// returned for a row that cannot be decoded; any other error ends the import.
+type rowReader interface {
+    Next() (importRecord, error)
+}
+
+// newRowReader reads data in the given format. The vector-only formats take an optional
+// JSONL metadata sidecar with one record per vector, in the same order.
+func newRowReader(format string, data, metadata io.Reader) (rowReader, error) {
+    if format == formatIvecs {
+        return nil, fmt.Errorf("%s files hold neighbour indices, not vectors, and are only exported as ground truth; import the %s file instead", formatIvecs, formatFvecs)
+    }
+    if metadata != nil && !vectorOnlyFormat(format) {
+        return nil, fmt.Errorf("a metadata file is only used with %s and %s", formatNPY, formatFvecs)
+    }
+    switch format {
+    case formatJSONL:
+        return &jsonlReader{reader: bufio.NewReaderSize(data, 1<<20)}, nil
+    case formatCSV:
+        return newCSVReader(data)
+    case formatNPY:
+        source, err := newNPYSource(bufio.NewReaderSize(data, 1<<20))
+        if err != nil {
+            return nil, err
+        }
+        return newSidecarReader(source, metadata), nil
+    case formatFvecs:
+        source := &vecsSource{reader: bufio.NewReaderSize(data, 1<<20)}
+        return newSidecarReader(source, metadata), nil
+    }
+    return nil, fmt.Errorf("unknown format %q (expected %s, %s, %s or %s)", format, formatJSONL, formatCSV, formatNPY, formatFvecs)
+}
+
+// jsonlReader reads one JSON record per line, skipping blank lines
+type jsonlReader struct {
+    reader *bufio.Reader
+}
+
+func (r *jsonlReader) Next() (importRecord, error) {
+    for {
+        line, err := r.reader.ReadBytes('\n')
+        if len(bytes.TrimSpace(line)) == 0 {
+            if err != nil {
+                return importRecord{}, err
+            }
+            continue
+        }
+        if err != nil && err != io.EOF {
+            return importRecord{}, err
+        }
+        var record importRecord
+        if err := json.Unmarshal(line, &record); err != nil {
+            return importRecord{}, badRow("invalid JSON: %v", err)
+        }
+        return record, nil
+    }
+}
+
+// csvReader reads a CSV file with a header row. The columns id, intent, project, params,
+// model and text fill those fields; v0, v1, ... hold the vector components, or a single vector
+// column holds them as a JSON array or separated by spaces. Every other column is
+// metadata, with an optional "metadata." prefix; cells holding a JSON array become lists.
+type csvReader struct {
+    reader     *csv.Reader
+    fields     map[string]int
+    vector     []int
+    vectorCell int
+    metadata   map[int]string
+}
+
+var vectorColumnPattern = regexp.MustCompile(`^v(\d+)$`)
+
+func newCSVReader(data io.Reader) (*csvReader, error) {
+    reader := csv.NewReader(bufio.NewReaderSize(data, 1<<20))
+    reader.ReuseRecord = true
+    header, err := reader.Read()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read CSV header: %v", err)
+    }
+
+    r := &csvReader{reader: reader, fields: make(map[string]int), vectorCell: -1, metadata: make(map[int]string)}
+    components := make(map[int]int)
+    for column, name := range header {
+        name = strings.TrimSpace(name)
+        if match := vectorColumnPattern.FindStringSubmatch(name); match != nil {
+            component, _ := strconv.Atoi(match[1])
+            components[component] = column
+            continue
+        }
+        switch name {
+        case "id", "intent", "project", "params", "model", "text":
+            r.fields[name] = column
+        case "vector":
+            r.vectorCell = column
+        default:
+            key := strings.TrimPrefix(name, "metadata.")
+            if !metadataKeyPattern.MatchString(key) {
+                return nil, fmt.Errorf("CSV column %q is not a valid metadata key", name)
+            }
+            r.metadata[column] = key
+        }
+    }
+    for component := 0; component < len(components); component++ {
+        column, exists := components[component]
+        if !exists {
+            return nil, fmt.Errorf("CSV vector columns must be v0 to v%d without gaps; v%d is missing", len(components)-1, component)
+        }
+        r.vector = append(r.vector, column)
+    }
+    if len(r.vector) > 0 && r.vectorCell >= 0 {
+        return nil, fmt.Errorf("CSV has both a vector column and v0... columns")
+    }
+    return r, nil
+}
+
+func (r *csvReader) Next() (importRecord, error) {
+    cells, err := r.reader.Read()
+    if err == io.EOF {
+        return importRecord{}, io.EOF
+    }
+    var parseErr *csv.ParseError
+    if errors.As(err, &parseErr) {
+        return importRecord{}, badRow("%v", parseErr.Err)
+    }
+    if err != nil {
+        return importRecord{}, err
+    }
+
+    field := func(name string) string {
+        if column, exists := r.fields[name]; exists {
+            return cells[column]
+        }
+        return ""
+    }
+    record := importRecord{ID: field("id"), Intent: field("intent"), Project: field("project"), Params: field("params"), Model: field("model"), Text: field("text")}
+
+    if len(r.vector) > 0 {
+        record.Vector = make([]float32, len(r.vector))
+        for i, column := range r.vector {
+            value, err := strconv.ParseFloat(strings.TrimSpace(cells[column]), 32)
+            if err != nil {
+                return importRecord{}, badRow("v%d: %v", i, err)
+            }
+            record.Vector[i] = float32(value)
+        }
+    } else if r.vectorCell >= 0 && strings.TrimSpace(cells[r.vectorCell]) != "" {
+        vector, err := parseVectorCell(cells[r.vectorCell])
+        if err != nil {
+            return importRecord{}, badRow("vector: %v", err)
+        }
+        record.Vector = vector
+    }
+
+    for column, key := range r.metadata {
+        cell := cells[column]
+        if cell == "" {
+            continue
+        }
+        if record.Metadata == nil {
+            record.Metadata = make(Metadata)
+        }
+        var list []interface{}
+        if strings.HasPrefix(cell, "[") && json.Unmarshal([]byte(cell), &list) == nil {
+            record.Metadata[key] = list
+        } else {
+            record.Metadata[key] = cell
+        }
+    }
+    return record, nil
+}
+
+// parseVectorCell reads a JSON array or space-separated components
+func parseVectorCell(cell string) ([]float32, error) {
+    cell = strings.TrimSpace(cell)
+    if strings.HasPrefix(cell, "[") {
+        var vector []float32
+        err := json.Unmarshal([]byte(cell), &vector)
+        return vector, err
+    }
+    fields := strings.Fields(cell)
+    vector := make([]float32, len(fields))
+    for i, field := range fields {
+        value, err := strconv.ParseFloat(field, 32)
+        if err != nil {
+            return nil, err
+        }
+        vector[i] = float32(value)
+    }
+    return vector, nil
+}
+
+// vectorSource reads bare vectors, returning io.EOF at the end
+type vectorSource interface {
+    next() ([]float32, error)
+}
+
+// sidecarReader pairs bare vectors with the records of an optional JSONL metadata file
+type sidecarReader struct {
+    source   vectorSource
+    metadata *jsonlReader
+}
+
+func newSidecarReader(source vectorSource, metadata io.Reader) *sidecarReader {
+    r := &sidecarReader{source: source}
+    if metadata != nil {
+        r.metadata = &jsonlReader{reader: bufio.NewReaderSize(metadata, 1<<20)}
+    }
+    return r
+}
+
+func (r *sidecarReader) Next() (importRecord, error) {
+    vector, err := r.source.next()
+    if err == io.EOF {
+        if r.metadata != nil {
+            if _, err := r.metadata.Next(); err != io.EOF {
+                return importRecord{}, fmt.Errorf("metadata file has more records than there are vectors")
+            }
+        }
+        return importRecord{}, io.EOF
+    }
+    if err != nil {
+        return importRecord{}, err
+    }
+    if r.metadata == nil {
+        return importRecord{Vector: vector}, nil
+    }
+
+    record, err := r.metadata.Next()
+    if err == io.EOF {
+        return importRecord{}, fmt.Errorf("metadata file has fewer records than there are vectors")
+    }
+    if err != nil {
+        return importRecord{}, err
+    }
+    record.Vector = vector
+    return record, nil
+}
+
+// vecsSource reads the fvecs benchmark format: each vector is a little-endian int32
+// dimension followed by that many float32 components
+type vecsSource struct {
+    reader *bufio.Reader
+    buf    []byte
+}
+
+func (s *vecsSource) next() ([]float32, error) {
+    var header [4]byte
+    if _, err := io.ReadFull(s.reader, header[:]); err == io.EOF {
+        return nil, io.EOF
+    } else if err != nil {
+        return nil, fmt.Errorf("truncated vector header")
+    }
+    dimension := int32(binary.LittleEndian.Uint32(header[:]))
+    if dimension <= 0 || dimension > maxImportDimension {
+        return nil, fmt.Errorf("invalid vector dimension %d", dimension)
+    }
+    if cap(s.buf) < int(dimension)*4 {
+        s.buf = make([]byte, int(dimension)*4)
+    }
+    buf := s.buf[:int(dimension)*4]
+    if _, err := io.ReadFull(s.reader, buf); err != nil {
+        return nil, fmt.Errorf("truncated vector of dimension %d", dimension)
+    }
+    vector := make([]float32, dimension)
+    for i := range vector {
+        vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+    }
+    return vector, nil
+}
+
+// npySource reads a two-dimensional little-endian float32 or float64 NumPy array in C order
+type npySource struct {
+    reader    *bufio.Reader
+    rows      int
+    dimension int
+    width     int
+    read      int
+    buf       []byte
+}
+
+var (
+    npyMagic        = []byte("\x93NUMPY")
+    npyDescrPattern = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+    npyOrderPattern = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+    npyShapePattern = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+func newNPYSource(reader *bufio.Reader) (*npySource, error) {
+    prefix := make([]byte, 8)
+    if _, err := io.ReadFull(reader, prefix); err != nil || !bytes.Equal(prefix[:6], npyMagic) {
+        return nil, fmt.Errorf("not a .npy file")
+    }
+    var headerLen int
+    switch prefix[6] {
+    case 1:
+        var size [2]byte
+        if _, err := io.ReadFull(reader, size[:]); err != nil {
+            return nil, fmt.Errorf("truncated .npy header")
+        }
+        headerLen = int(binary.LittleEndian.Uint16(size[:]))
+    case 2, 3:
+        var size [4]byte
+        if _, err := io.ReadFull(reader, size[:]); err != nil {
+            return nil, fmt.Errorf("truncated .npy header")
+        }
+        headerLen = int(binary.LittleEndian.Uint32(size[:]))
+    default:
+        return nil, fmt.Errorf("unsupported .npy version %d.%d", prefix[6], prefix[7])
+    }
+    if headerLen > 1<<20 {
+        return nil, fmt.Errorf("invalid .npy header length %d", headerLen)
+    }
+    header := make([]byte, headerLen)
+    if _, err := io.ReadFull(reader, header); err != nil {
+        return nil, fmt.Errorf("truncated .npy header")
+    }
+
+    source := &npySource{reader: reader}
+    descr := npyDescrPattern.FindSubmatch(header)
+    switch {
+    case descr == nil:
+        return nil, fmt.Errorf(".npy header has no descr")
+    case string(descr[1]) == "<f4":
+        source.width = 4
+    case string(descr[1]) == "<f8":
+        source.width = 8
+    default:
+        return nil, fmt.Errorf("unsupported .npy dtype %q (expected <f4 or <f8)", descr[1])
+    }
+    if order := npyOrderPattern.FindSubmatch(header); order == nil || string(order[1]) != "False" {
+        return nil, fmt.Errorf("only C-order .npy arrays are supported")
+    }
+    shape := npyShapePattern.FindSubmatch(header)
+    if shape == nil {
+        return nil, fmt.Errorf(".npy header has no shape")
+    }
+    var dims []int
+    for _, part := range strings.Split(string(shape[1]), ",") {
+        if part = strings.TrimSpace(part); part == "" {
+            continue
+        }
+        dim, err := strconv.Atoi(part)
+        if err != nil {
+            return nil, fmt.Errorf("invalid .npy shape %q", shape[1])
+        }
+        dims = append(dims, dim)
+    }
+    if len(dims) != 2 || dims[1] < 1 || dims[1] > maxImportDimension {
+        return nil, fmt.Errorf("expected a two-dimensional array of vectors, got shape (%s)", shape[1])
+    }
+    source.rows, source.dimension = dims[0], dims[1]
+    source.buf = make([]byte, source.dimension*source.width)
+    return source, nil
+}
+
+func (s *npySource) next() ([]float32, error) {
+    if s.read == s.rows {
+        return nil, io.EOF
+    }
+    if _, err := io.ReadFull(s.reader, s.buf); err != nil {
+        return nil, fmt.Errorf(".npy data ends after %d of %d rows", s.read, s.rows)
+    }
+    s.read++
+    vector := make([]float32, s.dimension)
+    for i := range vector {
+        if s.width == 4 {
+            vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(s.buf[4*i:]))
+        } else {
+            vector[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(s.buf[8*i:])))
+        }
+    }
+    return vector, nil
+}
+
+// ImportCollection streams records into a collection in batches. Rows without a vector are
+// embedded with the collection's embedder. Bad rows are reported and skipped.
+func ImportCollection(collection *Collection, format string, data, metadata io.Reader) (report ImportReport) {
+    start := time.Now()
+    report = ImportReport{Collection: collection.Config.Name, Format: format}
+    defer func() {
+        report.Duration = time.Since(start).String()
+    }()
+
+    reader, err := newRowReader(format, data, metadata)
+    if err != nil {
+        report.Error = err.Error()
+        return report
+    }
+
+    var batch []importRecord
+    var rows []int
+    for {
+        record, err := reader.Next()
+        if err == io.EOF {
+            break
+        }
+        var bad *rowError
+        if errors.As(err, &bad) {
+            report.Rows++
+            report.rowFailed(report.Rows, bad)
+            continue
+        }
+        if err != nil {
+            report.Error = fmt.Sprintf("after row %d: %v", report.Rows, err)
+            break
+        }
+        report.Rows++
+        batch = append(batch, record)
+        rows = append(rows, report.Rows)
+        if len(batch) >= importBatchSize {
+            importBatch(collection, batch, rows, &report)
+            batch, rows = batch[:0], rows[:0]
+        }
+    }
+    importBatch(collection, batch, rows, &report)
+    return report
+}
+
+// importBatch embeds the records that have no vector and stores the batch
+func importBatch(collection *Collection, batch []importRecord, rows []int, report *ImportReport) {
+    if len(batch) == 0 {
+        return
+    }
+
+    var texts []string
+    var pending []int
+    for i, record := range batch {
+        if len(record.Vector) > 0 {
+            continue
+        }
+        text := record.Text
+        if text == "" {
+            text = record.Intent
+        }
+        if text == "" {
+            continue
+        }
+        texts = append(texts, text)
+        pending = append(pending, i)
+    }
+    failed := make(map[int]error)
+    if len(texts) > 0 {
+        vectors, err := collection.Embedder.Embed(texts)
+        for j, i := range pending {
+            if err != nil {
+                failed[i] = fmt.Errorf("failed to embed text with %s: %v", collection.Embedder.Name(), err)
+            } else {
+                batch[i].Vector = toFloat32(vectors[j])
+                batch[i].Model = collection.Embedder.Name()
+            }
+        }
+    }
+
+    embeddings := make([]Embedding, 0, len(batch))
+    positions := make([]int, 0, len(batch))
+    for i, record := range batch {
+        if err, exists := failed[i]; exists {
+            report.rowFailed(rows[i], err)
+            continue
+        }
+        if len(record.Vector) == 0 {
+            report.rowFailed(rows[i], fmt.Errorf("row has no vector and no text or intent to embed"))
+            continue
+        }
+        if record.Model == "" {
+            record.Model = collection.Embedder.Name()
+        }
+        text := record.Text
+        if text == record.Intent {
+            text = ""
+        }
+        embeddings = append(embeddings, Embedding{
+            ID:       record.ID,
+            Intent:   record.Intent,
+            Project:  record.Project,
+            Params:   record.Params,
+            Metadata: record.Metadata,
+            Model:    record.Model,
+            Text:     text,
+            Vector:   record.Vector,
+        })
+        positions = append(positions, i)
+    }
+
+    for j, result := range collection.Store.PutBatch(embeddings) {
+        if result.Err != nil {
+            report.rowFailed(rows[positions[j]], result.Err)
+        } else {
+            report.Imported++
+        }
+    }
+}
+
+// ExportCollection writes the live embeddings of a collection in the given format. For
+// npy and fvecs, part selects the vectors or the JSONL metadata sidecar that goes with
+// them. ivecs exports the exact k nearest neighbours of every vector, as row numbers in
+// the fvecs and npy exports, which is the ground truth benchmark tools expect.
+func ExportCollection(w io.Writer, collection *Collection, format, part string, k int) error {
+    slots, labels, index := collection.Store.LiveSnapshot()
+    embeddings := make([]Embedding, len(labels))
+    for row, label := range labels {
+        embeddings[row] = slots[label]
+    }
+    buffered := bufio.NewWriterSize(w, 1<<20)
+
+    var err error
+    switch {
+    case part != "" && part != partVectors && part != partMetadata:
+        return fmt.Errorf("unknown part %q (expected %s or %s)", part, partVectors, partMetadata)
+    case part == partMetadata && vectorOnlyFormat(format):
+        err = writeJSONL(buffered, embeddings, false)
+    case format == formatJSONL:
+        err = writeJSONL(buffered, embeddings, true)
+    case format == formatCSV:
+        err = writeCSV(buffered, embeddings)
+    case format == formatNPY:
+        err = writeNPY(buffered, embeddings)
+    case format == formatFvecs:
+        err = writeFvecs(buffered, embeddings)
+    case format == formatIvecs:
+        err = writeGroundTruth(buffered, slots, labels, index, k)
+    default:
+        return fmt.Errorf("unknown format %q (expected %s, %s, %s, %s or %s)", format, formatJSONL, formatCSV, formatNPY, formatFvecs, formatIvecs)
+    }
+    if err != nil {
+        return err
+    }
+    return buffered.Flush()
+}
+
+func writeJSONL(w io.Writer, embeddings []Embedding, withVectors bool) error {
+    encoder := json.NewEncoder(w)
+    for _, embedding := range embeddings {
+        if !withVectors {
+            embedding.Vector = nil
+        }
+        if err := encoder.Encode(embedding); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// writeCSV writes id, intent, project, params, model, text, one column per metadata key and v0, v1, ...
+// Metadata keys that clash with those columns get a "metadata." prefix.
+func writeCSV(w io.Writer, embeddings []Embedding) error {
+    keySet := make(map[string]bool)
+    dimension := 0
+    for _, embedding := range embeddings {
+        for key := range embedding.Metadata {
+            keySet[key] = true
+        }
+        if len(embedding.Vector) > dimension {
+            dimension = len(embedding.Vector)
+        }
+    }
+    keys := make([]string, 0, len(keySet))
+    for key := range keySet {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    header := []string{"id", "intent", "project", "params", "model", "text"}
+    for _, key := range keys {
+        switch {
+        case key == "id" || key == "intent" || key == "project" || key == "params" || key == "model" || key == "text" || key == "vector",
+            vectorColumnPattern.MatchString(key), strings.HasPrefix(key, "metadata."):
+            header = append(header, "metadata."+key)
+        default:
+            header = append(header, key)
+        }
+    }
+    for i := 0; i < dimension; i++ {
+        header = append(header, "v"+strconv.Itoa(i))
+    }
+
+    writer := csv.NewWriter(w)
+    if err := writer.Write(header); err != nil {
+        return err
+    }
+    row := make([]string, len(header))
+    for _, embedding := range embeddings {
+        row = append(row[:0], embedding.ID, embedding.Intent, embedding.Project, embedding.Params, embedding.Model, embedding.Text)
+        for _, key := range keys {
+            value, exists := embedding.Metadata[key]
+            if list, ok := value.([]interface{}); ok {
+                encoded, _ := json.Marshal(list)
+                row = append(row, string(encoded))
+            } else if exists {
+                row = append(row, scalarString(value))
+            } else {
+                row = append(row, "")
+            }
+        }
+        for _, value := range embedding.Vector {
+            row = append(row, strconv.FormatFloat(float64(value), 'g', -1, 32))
+        }
+        if err := writer.Write(row); err != nil {
+            return err
+        }
+    }
+    writer.Flush()
+    return writer.Error()
+}
+
+// writeNPY writes the vectors as a version 1.0 float32 array of shape (rows, dimension)
+func writeNPY(w io.Writer, embeddings []Embedding) error {
+    dimension := 0
+    if len(embeddings) > 0 {
+        dimension = len(embeddings[0].Vector)
+    }
+    header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", len(embeddings), dimension)
+    // Magic, version and length take 10 bytes; the header is padded to a multiple of 64
+    padding := 64 - (10+len(header)+1)%64
+    if padding == 64 {
+        padding = 0
+    }
+    header += strings.Repeat(" ", padding) + "\n"
+
+    prefix := make([]byte, 10)
+    copy(prefix, npyMagic)
+    prefix[6], prefix[7] = 1, 0
+    binary.LittleEndian.PutUint16(prefix[8:], uint16(len(header)))
+    if _, err := w.Write(prefix); err != nil {
+        return err
+    }
+    if _, err := io.WriteString(w, header); err != nil {
+        return err
+    }
+    return writeFloat32s(w, embeddings, false)
+}
+
+func writeFvecs(w io.Writer, embeddings []Embedding) error {
+    return writeFloat32s(w, embeddings, true)
+}
+
+// writeFloat32s writes each vector's components, prefixed with its dimension for fvecs
+func writeFloat32s(w io.Writer, embeddings []Embedding, withDimension bool) error {
+    var buf []byte
+    for _, embedding := range embeddings {
+        buf = buf[:0]
+        if withDimension {
+            buf = appendUint32(buf, uint32(len(embedding.Vector)))
+        }
+        for _, value := range embedding.Vector {
+            buf = appendUint32(buf, math.Float32bits(value))
+        }
+        if _, err := w.Write(buf); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+    var encoded [4]byte
+    binary.LittleEndian.PutUint32(encoded[:], value)
+    return append(buf, encoded[:]...)
+}
+
+// writeGroundTruth writes, for every live vector, the export rows of its k exact nearest
+// other vectors under the collection's metric. It scores every pair, so it suits
+// benchmark-sized collections.
+func writeGroundTruth(w io.Writer, slots []Embedding, labels []int, index *HNSWIndex, k int) error {
+    if k < 1 {
+        k = 100
+    }
+    rows := make(map[int]int, len(labels))
+    for row, label := range labels {
+        rows[label] = row
+    }
+
+    var buf []byte
+    for _, label := range labels {
+        hits := index.SearchExactFiltered(slots[label].Vector, k+1, func(other int) bool {
+            _, live := rows[other]
+            return live && other != label
+        })
+        if len(hits) > k {
+            hits = hits[:k]
+        }
+        buf = appendUint32(buf[:0], uint32(len(hits)))
+        for _, hit := range hits {
+            buf = appendUint32(buf, uint32(rows[hit.Label]))
+        }
+        if _, err := w.Write(buf); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// ImportCollectionHandler streams a file into a collection and returns the ImportReport.
+// The body is the file itself, or a multipart form with a "file" part preceded by an
+// optional "metadata" sidecar part. The format comes from the format query parameter or
+// the uploaded file name.
+func ImportCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    collection, err := collections.Get(name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    }
+    format := r.URL.Query().Get("format")
+    log.Printf("Handling request to import %s into collection %s", format, name)
+
+    var report ImportReport
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+        var status int
+        report, status, err = importMultipart(r, collection, format)
+        if err != nil {
+            http.Error(w, err.Error(), status)
+            return
+        }
+    } else {
+        if format == "" {
+            http.Error(w, "Missing format parameter", http.StatusBadRequest)
+            return
+        }
+        report = ImportCollection(collection, format, r.Body, nil)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if report.Error != "" && report.Rows == 0 {
+        w.WriteHeader(http.StatusBadRequest)
+    }
+    json.NewEncoder(w).Encode(report)
+}
+
+// importMultipart reads the parts of a multipart import. The metadata sidecar is spooled
+// to a temporary file so the vectors can be streamed against it.
+func importMultipart(r *http.Request, collection *Collection, format string) (ImportReport, int, error) {
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return ImportReport{}, http.StatusBadRequest, fmt.Errorf("Invalid multipart body: %v", err)
+    }
+    var metadata *os.File
+    defer func() {
+        if metadata != nil {
+            metadata.Close()
+            os.Remove(metadata.Name())
+        }
+    }()
+
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            return ImportReport{}, http.StatusBadRequest, fmt.Errorf("Missing file part")
+        }
+        if err != nil {
+            return ImportReport{}, http.StatusBadRequest, fmt.Errorf("Invalid multipart body: %v", err)
+        }
+        switch part.FormName() {
+        case "metadata":
+            if metadata != nil {
+                continue
+            }
+            metadata, err = ioutil.TempFile("", "import-metadata-*.jsonl")
+            if err != nil {
+                return ImportReport{}, http.StatusInternalServerError, fmt.Errorf("Error spooling metadata: %v", err)
+            }
+            if _, err := io.Copy(metadata, part); err != nil {
+                return ImportReport{}, http.StatusBadRequest, fmt.Errorf("Error reading metadata part: %v", err)
+            }
+            if _, err := metadata.Seek(0, io.SeekStart); err != nil {
+                return ImportReport{}, http.StatusInternalServerError, fmt.Errorf("Error spooling metadata: %v", err)
+            }
+        case "file":
+            if format == "" {
+                format = detectTransferFormat(part.FileName())
+            }
+            if format == "" {
+                return ImportReport{}, http.StatusBadRequest, fmt.Errorf("Missing format parameter")
+            }
+            var sidecar io.Reader
+            if metadata != nil {
+                sidecar = metadata
+            }
+            return ImportCollection(collection, format, part, sidecar), http.StatusOK, nil
+        }
+    }
+}
+
+// ExportCollectionHandler downloads a collection in the format given by the format query
+// parameter, JSONL by default. part=metadata returns the sidecar of an npy or fvecs
+// export and k sets the neighbours per vector of an ivecs ground truth export.
+func ExportCollectionHandler(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+    collection, err := collections.Get(name)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Collection %q not found", name), http.StatusNotFound)
+        return
+    }
+    query := r.URL.Query()
+    format := query.Get("format")
+    if format == "" {
+        format = formatJSONL
+    }
+    part := query.Get("part")
+    k := 100
+    if value := query.Get("k"); value != "" {
+        if k, err = strconv.Atoi(value); err != nil || k < 1 {
+            http.Error(w, fmt.Sprintf("Invalid k %q", value), http.StatusBadRequest)
+            return
+        }
+    }
+
+    extension, contentType := format, "application/octet-stream"
+    switch {
+    case detectTransferFormat("."+format) == "":
+        http.Error(w, fmt.Sprintf("Unknown format %q", format), http.StatusBadRequest)
+        return
+    case part != "" && part != partVectors && part != partMetadata:
+        http.Error(w, fmt.Sprintf("Unknown part %q", part), http.StatusBadRequest)
+        return
+    case part == partMetadata && vectorOnlyFormat(format):
+        extension, contentType = "metadata.jsonl", "application/x-ndjson"
+    case format == formatJSONL:
+        contentType = "application/x-ndjson"
+    case format == formatCSV:
+        contentType = "text/csv"
+    }
+    log.Printf("Handling request to export collection %s as %s", name, format)
+
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+extension))
+    if err := ExportCollection(w, collection, format, part, k); err != nil {
+        log.Printf("Error exporting collection %s: %v", name, err)
+    }
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "bytes"
+    "io"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func testTransferCollection() *Collection {
+    return &Collection{
+        Config:   CollectionConfig{Name: "transfer", Metric: metricCosine, Embedder: "recording"},
+        Store:    NewEmbeddingStore(memoryBackend{}, HNSWConfig{Metric: metricCosine}, 0),
+        Embedder: &recordingEmbedder{},
+    }
+}
+
+// testTransferRecords are unit vectors, so storing them under cosine leaves them as they are
+var testTransferRecords = []Embedding{
+    {ID: "a", Intent: "scrape news", Project: "scraper", Params: `{"site":"string"}`, Model: "recording",
+        Metadata: Metadata{"team": "data", "tags": []interface{}{"web", "news"}}, Vector: []float32{0.6, 0.8}},
+    {ID: "b", Intent: "rates", Project: "bank", Model: "recording", Text: "check the bank's interest rates",
+        Metadata: Metadata{"team": "finance"}, Vector: []float32{1, 0}},
+    {ID: "c", Intent: "send mail, quickly", Project: "mailer", Model: "recording", Vector: []float32{0, -1}},
+}
+
+// exportTestCollection exports a collection holding testTransferRecords, returning the
+// data and, for the vector-only formats, the metadata sidecar
+func exportTestCollection(t *testing.T, format string) ([]byte, []byte) {
+    t.Helper()
+    source := testTransferCollection()
+    for _, result := range source.Store.PutBatch(testTransferRecords) {
+        if result.Err != nil {
+            t.Fatal(result.Err)
+        }
+    }
+    var data, metadata bytes.Buffer
+    if err := ExportCollection(&data, source, format, "", 0); err != nil {
+        t.Fatal(err)
+    }
+    if vectorOnlyFormat(format) {
+        if err := ExportCollection(&metadata, source, format, partMetadata, 0); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return data.Bytes(), metadata.Bytes()
+}
+
+func TestTransferRoundTrip(t *testing.T) {
+    for _, format := range []string{formatJSONL, formatCSV, formatNPY, formatFvecs} {
+        t.Run(format, func(t *testing.T) {
+            data, metadata := exportTestCollection(t, format)
+            target := testTransferCollection()
+            var sidecar io.Reader
+            if vectorOnlyFormat(format) {
+                sidecar = bytes.NewReader(metadata)
+            }
+            report := ImportCollection(target, format, bytes.NewReader(data), sidecar)
+            if report.Error != "" || report.Imported != len(testTransferRecords) || report.Failed != 0 {
+                t.Fatalf("import report = %+v, want every row imported", report)
+            }
+
+            for _, want := range testTransferRecords {
+                got, ok := target.Store.Get(want.ID)
+                if !ok {
+                    t.Fatalf("record %s was not imported", want.ID)
+                }
+                if !reflect.DeepEqual(got, want) {
+                    t.Errorf("record %s = %+v, want %+v", want.ID, got, want)
+                }
+            }
+        })
+    }
+}
+
+func TestImportSkipsAndReportsBadRows(t *testing.T) {
+    inputs := map[string]string{
+        formatJSONL: `{"id": "a", "intent": "scrape news", "project": "scraper", "vector": [1, 0]}
+{"id": "b", "intent": broken}
+
+{"id": "c", "intent": "check rates", "project": "bank"}
+`,
+        formatCSV: `id,intent,project,vector
+a,scrape news,scraper,1 0
+b,broken,bank,1 zero
+c,check rates,bank,
+`,
+    }
+    for format, input := range inputs {
+        t.Run(format, func(t *testing.T) {
+            collection := testTransferCollection()
+            report := ImportCollection(collection, format, strings.NewReader(input), nil)
+            if report.Error != "" || report.Rows != 3 || report.Imported != 2 || report.Failed != 1 {
+                t.Fatalf("report = %+v, want 3 rows with 2 imported and 1 failed", report)
+            }
+            if len(report.Errors) != 1 || report.Errors[0].Row != 2 || report.Errors[0].Error == "" {
+                t.Errorf("errors = %+v, want row 2 reported", report.Errors)
+            }
+            if _, ok := collection.Store.Get("b"); ok {
+                t.Error("the bad row was stored")
+            }
+            if c, ok := collection.Store.Get("c"); !ok || c.Model != "recording" {
+                t.Errorf("row c = %+v, want it embedded after the bad row", c)
+            }
+        })
+    }
+}
+
+func TestImportTruncatedVectorFiles(t *testing.T) {
+    for _, format := range []string{formatNPY, formatFvecs} {
+        t.Run(format, func(t *testing.T) {
+            data, _ := exportTestCollection(t, format)
+            collection := testTransferCollection()
+            // The last vector loses its final component
+            report := ImportCollection(collection, format, bytes.NewReader(data[:len(data)-4]), nil)
+            if report.Error == "" || !strings.Contains(report.Error, "after row 2") {
+                t.Errorf("error = %q, want the import stopped after row 2", report.Error)
+            }
+            if report.Imported != 2 || len(collection.Store.Embeddings()) != 2 {
+                t.Errorf("imported %d, want the 2 complete rows kept", report.Imported)
+            }
+        })
+    }
+}
+
+func TestImportSidecarRowCountMismatch(t *testing.T) {
+    for _, format := range []string{formatNPY, formatFvecs} {
+        t.Run(format, func(t *testing.T) {
+            data, metadata := exportTestCollection(t, format)
+            lines := strings.SplitAfter(strings.TrimSpace(string(metadata)), "\n")
+
+            collection := testTransferCollection()
+            short := strings.Join(lines[:2], "")
+            report := ImportCollection(collection, format, bytes.NewReader(data), strings.NewReader(short))
+            if !strings.Contains(report.Error, "fewer records") || report.Imported != 2 {
+                t.Errorf("report = %+v, want the 2 paired rows imported and the missing metadata reported", report)
+            }
+
+            collection = testTransferCollection()
+            long := string(metadata) + `{"id": "d", "intent": "extra"}` + "\n"
+            report = ImportCollection(collection, format, bytes.NewReader(data), strings.NewReader(long))
+            if !strings.Contains(report.Error, "more records") || report.Imported != 3 {
+                t.Errorf("report = %+v, want every vector imported and the extra metadata reported", report)
+            }
+        })
+    }
+}
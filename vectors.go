@@ -0,0 +1,103 @@
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// Stored vectors are float32. Under the cosine metric they are also unit length, so cosine
+// similarity is a plain dot product.
+
+// Similarity metrics a collection can be searched with. Euclidean scores are negated
+// distances so that higher is always better.
+const (
+    metricCosine    = "cosine"
+    metricDot       = "dot"
+    metricEuclidean = "euclidean"
+)
+
+// validMetric reports whether metric is one of the supported similarity metrics
+func validMetric(metric string) bool {
+    return metric == metricCosine || metric == metricDot || metric == metricEuclidean
+}
+
+// toFloat32 converts an embedder output to the stored representation
+func toFloat32(vector []float64) []float32 {
+    converted := make([]float32, len(vector))
+    for i, value := range vector {
+        converted[i] = float32(value)
+    }
+    return converted
+}
+
+// normalizeFloat32 scales the vector to unit length in place; zero vectors are left as they are
+func normalizeFloat32(vector []float32) []float32 {
+    var sum float64
+    for _, value := range vector {
+        sum += float64(value) * float64(value)
+    }
+    if sum == 0 {
+        return vector
+    }
+    norm := math.Sqrt(sum)
+    for i, value := range vector {
+        vector[i] = float32(float64(value) / norm)
+    }
+    return vector
+}
+
+// queryVector converts and normalises an embedder output for searching
+func queryVector(vector []float64) []float32 {
+    return normalizeFloat32(toFloat32(vector))
+}
+
+// dotFloat32 returns the dot product of two equal-length vectors
+func dotFloat32(a, b []float32) float64 {
+    var sum float32
+    for i := range a {
+        sum += a[i] * b[i]
+    }
+    return float64(sum)
+}
+
+// squaredDistanceFloat32 returns the squared Euclidean distance of two equal-length vectors
+func squaredDistanceFloat32(a, b []float32) float64 {
+    var sum float32
+    for i := range a {
+        diff := a[i] - b[i]
+        sum += diff * diff
+    }
+    return float64(sum)
+}
+
+// validateVector rejects empty vectors and non-finite components
+func validateVector(vector []float32) error {
+    if len(vector) == 0 {
+        return fmt.Errorf("vector is empty")
+    }
+    for i, value := range vector {
+        if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+            return fmt.Errorf("component %d is %v", i, value)
+        }
+    }
+    return nil
+}
+
+// validateEmbeddings checks every vector against the dimension of the first one.
+// Errors name the offending record.
+func validateEmbeddings(embeddings []Embedding) error {
+    dimension := 0
+    for i := range embeddings {
+        embedding := &embeddings[i]
+        if err := validateVector(embedding.Vector); err != nil {
+            return fmt.Errorf("embedding %d (intent '%s', project '%s'): %v", i, embedding.Intent, embedding.Project, err)
+        }
+        if dimension == 0 {
+            dimension = len(embedding.Vector)
+        } else if len(embedding.Vector) != dimension {
+            return fmt.Errorf("embedding %d (intent '%s', project '%s') has dimension %d, expected %d like embedding 0",
+                i, embedding.Intent, embedding.Project, len(embedding.Vector), dimension)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "bufio"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "strings"
+)
+
+// loadWord2VecBinary streams the word2vec .bin format: a "<count> <dimension>" header line,
+// then for every word its text, a space and dimension little-endian float32 values.
+// Vectors are copied straight into the table so no per-word slices are allocated.
+func loadWord2VecBinary(path string, limit int, stats *WordVectorStats) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open word2vec file: %v", err)
+    }
+    defer file.Close()
+
+    progress := newLoadProgress(file)
+    reader := bufio.NewReaderSize(progress, 1<<20)
+
+    header, err := reader.ReadString('\n')
+    if err != nil {
+        return fmt.Errorf("failed to read word2vec header: %v", err)
+    }
+    var count, dimension int
+    if _, err := fmt.Sscanf(header, "%d %d", &count, &dimension); err != nil || count < 0 {
+        return fmt.Errorf("invalid word2vec header %q", strings.TrimSpace(header))
+    }
+    if err := checkWordVectorDimension(dimension); err != nil {
+        return fmt.Errorf("invalid word2vec header %q: %v", strings.TrimSpace(header), err)
+    }
+
+    // A record takes at least a one-byte word, its separator and the vector
+    table := newWordVectorTable(dimension, vocabularyCapacity(count, progress.total, int64(4*dimension+2), limit))
+    raw := make([]byte, 4*dimension)
+    vector := make([]float32, dimension)
+
+    for i := 0; i < count; i++ {
+        if limit > 0 && table.size() >= limit {
+            stats.Truncated = true
+            break
+        }
+
+        word, err := reader.ReadString(' ')
+        if err != nil {
+            if err == io.EOF && strings.TrimSpace(word) == "" {
+                break
+            }
+            return fmt.Errorf("failed to read word %d of %d: %v", i+1, count, err)
+        }
+        // Most writers end each record with a newline, which then prefixes the next word
+        word = strings.TrimLeft(word[:len(word)-1], "\n")
+
+        if _, err := io.ReadFull(reader, raw); err != nil {
+            return fmt.Errorf("failed to read vector for word %q: %v", word, err)
+        }
+        for j := range vector {
+            vector[j] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*j:]))
+        }
+
+        // Vocabularies are sorted by frequency, so the first spelling of a word wins
+        if !table.add(normalizeWord(word), vector) {
+            stats.Skipped++
+        }
+        progress.report(table.size())
+    }
+
+    if table.size() == 0 {
+        return fmt.Errorf("no word vectors found in %s", path)
+    }
+    setWordVectors(table)
+    return nil
+}
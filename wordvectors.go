@@ -0,0 +1,344 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// WordVectorStats summarises the word vectors loaded at startup for the dashboard
+type WordVectorStats struct {
+    Path      string        `json:"path"`
+    Format    string        `json:"format"`
+    Words     int           `json:"words"`
+    Dimension int           `json:"dimension"`
+    Skipped   int           `json:"skipped"`
+    Truncated bool          `json:"truncated"`
+    Duration  time.Duration `json:"duration"`
+    // SubwordBuckets is the number of n-gram buckets available for out-of-vocabulary words
+    SubwordBuckets int `json:"subwordBuckets"`
+    Error     string        `json:"error,omitempty"`
+}
+
+// wordVectorStats describes the currently loaded word vectors
+var wordVectorStats WordVectorStats
+
+// Supported word vector file formats
+const (
+    wordVectorFormatJSON     = "json"
+    wordVectorFormatText     = "text"
+    wordVectorFormatWord2Vec = "word2vec"
+)
+
+// maxWordVectorDimension guards against reading a corrupt header as a huge vector
+const maxWordVectorDimension = 1 << 16
+
+// checkWordVectorDimension rejects a dimension no word vector file really has
+func checkWordVectorDimension(dimension int) error {
+    if dimension <= 0 || dimension > maxWordVectorDimension {
+        return fmt.Errorf("invalid word vector dimension %d (expected 1 to %d)", dimension, maxWordVectorDimension)
+    }
+    return nil
+}
+
+// vocabularyCapacity is how many words to allocate for. The count in a header is not
+// trusted: the file size divided by the smallest record bounds the words it can hold.
+func vocabularyCapacity(count int, fileSize, minRecordBytes int64, limit int) int {
+    capacity := count
+    if fileSize > 0 {
+        if fits := fileSize / minRecordBytes; fits < int64(capacity) {
+            capacity = int(fits)
+        }
+    }
+    if limit > 0 && limit < capacity {
+        capacity = limit
+    }
+    return capacity
+}
+
+// wordVectorTable stores word vectors back to back as float32 so large vocabularies
+// cost one allocation instead of one slice per word
+type wordVectorTable struct {
+    dimension int
+    index     map[string]int32
+    data      []float32
+}
+
+func newWordVectorTable(dimension, capacity int) *wordVectorTable {
+    return &wordVectorTable{
+        dimension: dimension,
+        index:     make(map[string]int32, capacity),
+        data:      make([]float32, 0, capacity*dimension),
+    }
+}
+
+// add stores the vector under word unless the word is already present
+func (t *wordVectorTable) add(word string, vector []float32) bool {
+    if _, exists := t.index[word]; exists {
+        return false
+    }
+    t.index[word] = int32(len(t.index))
+    t.data = append(t.data, vector...)
+    return true
+}
+
+// lookup returns a view of the stored vector; callers must not modify it
+func (t *wordVectorTable) lookup(word string) ([]float32, bool) {
+    i, exists := t.index[word]
+    if !exists {
+        return nil, false
+    }
+    offset := int(i) * t.dimension
+    return t.data[offset : offset+t.dimension], true
+}
+
+func (t *wordVectorTable) size() int {
+    return len(t.index)
+}
+
+// setWordVectors installs a freshly loaded table as the global lookup table
+func setWordVectors(table *wordVectorTable) {
+    wordEmbeddings = table
+    embeddingDimension = table.dimension
+}
+
+// detectWordVectorFormat guesses the file format from its extension
+func detectWordVectorFormat(path string) string {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".json":
+        return wordVectorFormatJSON
+    case ".bin":
+        return wordVectorFormatWord2Vec
+    default:
+        // GloVe .txt and fastText .vec files share the whitespace-separated layout
+        return wordVectorFormatText
+    }
+}
+
+// LoadWordVectors loads word vectors in the given format ("" to detect it from the extension),
+// keeping at most limit words when limit is positive, and replaces the global lookup table
+func LoadWordVectors(path, format string, limit int) (WordVectorStats, error) {
+    if format == "" || format == "auto" {
+        format = detectWordVectorFormat(path)
+    }
+    stats := WordVectorStats{Path: path, Format: format}
+    start := time.Now()
+
+    var err error
+    switch format {
+    case wordVectorFormatJSON:
+        err = loadJSONWordVectors(path, limit, &stats)
+    case wordVectorFormatText, "glove", "vec":
+        stats.Format = wordVectorFormatText
+        err = loadTextWordVectors(path, limit, &stats)
+    case wordVectorFormatWord2Vec, "bin":
+        stats.Format = wordVectorFormatWord2Vec
+        err = loadWord2VecBinary(path, limit, &stats)
+    default:
+        err = fmt.Errorf("unsupported word vector format %q", format)
+    }
+
+    stats.Duration = time.Since(start)
+    if err != nil {
+        stats.Error = err.Error()
+        return stats, err
+    }
+
+    stats.Words = wordEmbeddings.size()
+    stats.Dimension = embeddingDimension
+    log.Printf("Loaded %d word vectors (dimension %d, %d skipped) from %s in %s",
+        stats.Words, stats.Dimension, stats.Skipped, path, stats.Duration)
+    return stats, nil
+}
+
+// loadJSONWordVectors reads a {"word": [components...]} map
+func loadJSONWordVectors(path string, limit int, stats *WordVectorStats) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open embeddings file: %v", err)
+    }
+    defer file.Close()
+
+    var vectors map[string][]float64
+    if err := json.NewDecoder(file).Decode(&vectors); err != nil {
+        return fmt.Errorf("failed to decode embeddings: %v", err)
+    }
+
+    // Set the embedding dimension based on the first vector in the map
+    dimension := 0
+    for _, vec := range vectors {
+        dimension = len(vec)
+        break
+    }
+    if dimension == 0 {
+        return fmt.Errorf("no word vectors found in %s", path)
+    }
+
+    table := newWordVectorTable(dimension, len(vectors))
+    vector := make([]float32, dimension)
+    // Keys already in lower case go first, so they win over other spellings of the same word
+    for _, lowercase := range []bool{true, false} {
+        for word, components := range vectors {
+            if (normalizeWord(word) == word) != lowercase {
+                continue
+            }
+            if limit > 0 && table.size() >= limit {
+                // JSON objects carry no frequency order, so the kept subset is arbitrary
+                stats.Truncated = true
+                break
+            }
+            if len(components) != dimension {
+                stats.Skipped++
+                continue
+            }
+            for i, value := range components {
+                vector[i] = float32(value)
+            }
+            if !table.add(normalizeWord(word), vector) {
+                stats.Skipped++
+            }
+        }
+    }
+
+    setWordVectors(table)
+    return nil
+}
+
+// normalizeWord keys the word vector table the way tokenize lowercases its output
+func normalizeWord(word string) string {
+    return strings.ToLower(word)
+}
+
+// loadTextWordVectors reads the GloVe and fastText .vec text formats: one word per line
+// followed by its components, with an optional "<count> <dimension>" header line
+func loadTextWordVectors(path string, limit int, stats *WordVectorStats) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open word vectors file: %v", err)
+    }
+    defer file.Close()
+
+    progress := newLoadProgress(file)
+    reader := bufio.NewReaderSize(progress, 1<<20)
+    var table *wordVectorTable
+    var vector []float32
+    count, dimension := 0, 0
+
+    for lineNo := 1; ; lineNo++ {
+        line, readErr := reader.ReadString('\n')
+        if readErr != nil && readErr != io.EOF {
+            return fmt.Errorf("failed to read word vectors at line %d: %v", lineNo, readErr)
+        }
+
+        fields := strings.Fields(line)
+        if lineNo == 1 && len(fields) == 2 {
+            // fastText header: vocabulary size and dimension
+            if words, err := strconv.Atoi(fields[0]); err == nil {
+                if dim, err := strconv.Atoi(fields[1]); err == nil {
+                    if words < 0 {
+                        return fmt.Errorf("invalid word vectors header %q", strings.TrimSpace(line))
+                    }
+                    if err := checkWordVectorDimension(dim); err != nil {
+                        return fmt.Errorf("invalid word vectors header %q: %v", strings.TrimSpace(line), err)
+                    }
+                    count, dimension = words, dim
+                    fields = nil
+                }
+            }
+        }
+
+        if len(fields) > 1 {
+            if table == nil {
+                if dimension == 0 {
+                    dimension = len(fields) - 1
+                }
+                if err := checkWordVectorDimension(dimension); err != nil {
+                    return err
+                }
+                // A record takes at least a one-character word and a space and digit per component
+                table = newWordVectorTable(dimension, vocabularyCapacity(count, progress.total, int64(2*dimension+2), limit))
+                vector = make([]float32, dimension)
+            }
+            word, ok := parseTextWordVector(fields, vector)
+            if !ok {
+                stats.Skipped++
+            } else {
+                // Files are sorted by frequency, so the first spelling of a word wins
+                table.add(word, vector)
+            }
+            progress.report(table.size())
+            if limit > 0 && table.size() >= limit {
+                stats.Truncated = readErr == nil
+                break
+            }
+        }
+
+        if readErr == io.EOF {
+            break
+        }
+    }
+
+    if table == nil || table.size() == 0 {
+        return fmt.Errorf("no word vectors found in %s", path)
+    }
+    setWordVectors(table)
+    return nil
+}
+
+// parseTextWordVector parses the trailing fields into vector. Anything before them is
+// the word, since some GloVe releases contain tokens with embedded spaces.
+func parseTextWordVector(fields []string, vector []float32) (string, bool) {
+    dimension := len(vector)
+    if len(fields) < dimension+1 {
+        return "", false
+    }
+    split := len(fields) - dimension
+    for i, field := range fields[split:] {
+        value, err := strconv.ParseFloat(field, 32)
+        if err != nil {
+            return "", false
+        }
+        vector[i] = float32(value)
+    }
+    return normalizeWord(strings.Join(fields[:split], " ")), true
+}
+
+// loadProgress counts the bytes read from a word vector file and logs every tenth of the way
+type loadProgress struct {
+    reader   io.Reader
+    name     string
+    total    int64
+    read     int64
+    nextStep int64
+}
+
+func newLoadProgress(file *os.File) *loadProgress {
+    progress := &loadProgress{reader: file, name: file.Name()}
+    if info, err := file.Stat(); err == nil {
+        progress.total = info.Size()
+        progress.nextStep = progress.total / 10
+    }
+    return progress
+}
+
+func (p *loadProgress) Read(buf []byte) (int, error) {
+    n, err := p.reader.Read(buf)
+    p.read += int64(n)
+    return n, err
+}
+
+// report logs progress once another tenth of the file has been consumed
+func (p *loadProgress) report(words int) {
+    if p.total == 0 || p.read < p.nextStep {
+        return
+    }
+    log.Printf("Loading %s: %d%% (%d words)", p.name, p.read*100/p.total, words)
+    p.nextStep += p.total / 10
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "math"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// writeTestFile writes data to a file in a fresh directory and returns its path
+func writeTestFile(t *testing.T, name string, data []byte) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), name)
+    if err := ioutil.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+// word2VecFile encodes vectors in the word2vec binary layout under the given header
+func word2VecFile(header string, words []string, vectors [][]float32) []byte {
+    var buf bytes.Buffer
+    buf.WriteString(header + "\n")
+    for i, word := range words {
+        buf.WriteString(word + " ")
+        for _, value := range vectors[i] {
+            binary.Write(&buf, binary.LittleEndian, math.Float32bits(value))
+        }
+        buf.WriteString("\n")
+    }
+    return buf.Bytes()
+}
+
+func TestWordVectorLoadersRejectHeaderDimensions(t *testing.T) {
+    savedTable, savedDimension := wordEmbeddings, embeddingDimension
+    t.Cleanup(func() {
+        wordEmbeddings, embeddingDimension = savedTable, savedDimension
+    })
+
+    for _, header := range []string{"1 0", "1 -3", "1 70000", "-1 2"} {
+        path := writeTestFile(t, "vectors.bin", word2VecFile(header, []string{"bank"}, [][]float32{{1, 0}}))
+        if err := loadWord2VecBinary(path, 0, &WordVectorStats{}); err == nil {
+            t.Errorf("word2vec header %q was accepted", header)
+        }
+        path = writeTestFile(t, "vectors.vec", []byte(header+"\nbank 1 0\n"))
+        if err := loadTextWordVectors(path, 0, &WordVectorStats{}); err == nil {
+            t.Errorf("fastText header %q was accepted", header)
+        }
+    }
+}
+
+func TestWordVectorLoadersBoundVocabularyByFileSize(t *testing.T) {
+    savedTable, savedDimension := wordEmbeddings, embeddingDimension
+    t.Cleanup(func() {
+        wordEmbeddings, embeddingDimension = savedTable, savedDimension
+    })
+
+    // A header claiming two billion words must not size the table
+    path := writeTestFile(t, "vectors.bin", word2VecFile("2000000000 2", []string{"bank", "rates"}, [][]float32{{1, 0}, {0, 1}}))
+    if err := loadWord2VecBinary(path, 0, &WordVectorStats{}); err != nil {
+        t.Fatal(err)
+    }
+    if wordEmbeddings.size() != 2 || cap(wordEmbeddings.data) > 2*10 {
+        t.Errorf("loaded %d words into capacity %d, want 2 words and a table sized by the file", wordEmbeddings.size(), cap(wordEmbeddings.data))
+    }
+
+    path = writeTestFile(t, "vectors.vec", []byte("2000000000 2\nbank 1 0\nrates 0 1\n"))
+    if err := loadTextWordVectors(path, 0, &WordVectorStats{}); err != nil {
+        t.Fatal(err)
+    }
+    if vector, ok := wordEmbeddings.lookup("rates"); !ok || vector[1] != 1 || cap(wordEmbeddings.data) > 2*10 {
+        t.Errorf("rates = %v in capacity %d, want [0 1] in a table sized by the file", vector, cap(wordEmbeddings.data))
+    }
+
+    if got := vocabularyCapacity(1000, 100, 10, 0); got != 10 {
+        t.Errorf("capacity = %d, want the 10 records the file can hold", got)
+    }
+    if got := vocabularyCapacity(1000, 0, 10, 5); got != 5 {
+        t.Errorf("capacity = %d, want the limit", got)
+    }
+    if err := checkWordVectorDimension(maxWordVectorDimension); err != nil || !strings.Contains(checkWordVectorDimension(0).Error(), "dimension 0") {
+        t.Errorf("dimension checks: %v, %v", err, checkWordVectorDimension(0))
+    }
+}